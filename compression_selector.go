@@ -1,10 +1,15 @@
 package jsonrpc
 
 import (
+	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -83,3 +88,123 @@ func (*CompressionSelector) Select(r *http.Request) Encoder {
 	}
 	return DefaultEncoder
 }
+
+// errUnsupportedEncoding is returned for request bodies in a content
+// encoding the server can't decode.
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// decompressRequest returns r with its body decompressed if it is gzipped.
+// Decompressed bodies over limit bytes, if positive, are refused with
+// errBodyTooLarge.
+func decompressRequest(r *http.Request, limit int64) (*http.Request, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return r, nil
+	case "gzip", "x-gzip":
+	default:
+		return r, errUnsupportedEncoding
+	}
+
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return r, fmt.Errorf("invalid gzip body: %v", err)
+	}
+	var reader io.Reader = zr
+	if limit > 0 {
+		reader = io.LimitReader(zr, limit+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return r, fmt.Errorf("invalid gzip body: %v", err)
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		return r, errBodyTooLarge
+	}
+	r.Body.Close()
+
+	r = r.WithContext(r.Context())
+	r.Header = r.Header.Clone()
+	r.Header.Del("Content-Encoding")
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return r, nil
+}
+
+// withoutAcceptEncoding returns a copy of r without Accept-Encoding header.
+func withoutAcceptEncoding(r *http.Request) *http.Request {
+	r = r.WithContext(r.Context())
+	r.Header = r.Header.Clone()
+	r.Header.Del("Accept-Encoding")
+	return r
+}
+
+// gzipResponseWriter gzips the body of the responses that have one.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// newGzipResponseWriter returns a writer gzipping the response to w, or nil
+// if the client doesn't accept gzip.
+func newGzipResponseWriter(w http.ResponseWriter, r *http.Request) *gzipResponseWriter {
+	if !acceptsGzip(r) {
+		return nil
+	}
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+
+	header := gw.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if status != http.StatusNoContent && status != http.StatusNotModified && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(status)
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz == nil {
+		return gw.ResponseWriter.Write(p)
+	}
+	return gw.gz.Write(p)
+}
+
+// Close ends the gzip stream, if any.
+func (gw *gzipResponseWriter) Close() error {
+	if gw.gz == nil {
+		return nil
+	}
+	return gw.gz.Close()
+}
+
+// acceptsGzip reports whether the "Accept-Encoding" header of the request
+// lists gzip, with a non-zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params := enc, ""
+		if idx := strings.Index(enc, ";"); idx != -1 {
+			name, params = enc[:idx], enc[idx+1:]
+		}
+		if strings.ToLower(strings.TrimSpace(name)) != "gzip" {
+			continue
+		}
+		params = strings.Replace(params, " ", "", -1)
+		if strings.HasPrefix(params, "q=") {
+			q, err := strconv.ParseFloat(params[2:], 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package jsonrpc
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey int
+
+const (
+	requestStateKey  contextKey = iota
+	recoverPanicsKey            // set for the requests of parallel batches
+)
+
+// requestState is the per-request state the server shares with methods and
+// hooks through the context.
+type requestState struct {
+	uncacheable bool
+	sampled     bool
+	streamed    bool // the reply was sent as events, see SSEHandler
+	info        CallInfo
+}
+
+func withRequestState(ctx context.Context) (context.Context, *requestState) {
+	state := new(requestState)
+	return context.WithValue(ctx, requestStateKey, state), state
+}
+
+func getRequestState(ctx context.Context) *requestState {
+	state, _ := ctx.Value(requestStateKey).(*requestState)
+	return state
+}
+
+// MarkUncacheable marks the response of the current request as not
+// cacheable, e.g. because it holds user-specific or volatile data. The
+// server then answers with "Cache-Control: no-store".
+//
+// It must be called from a method or a hook before the method returns and
+// is a no-op for contexts not created by the server.
+func MarkUncacheable(ctx context.Context) {
+	if state := getRequestState(ctx); state != nil {
+		state.uncacheable = true
+	}
+}
+
+// Uncacheable reports whether MarkUncacheable was called for the request.
+func Uncacheable(ctx context.Context) bool {
+	state := getRequestState(ctx)
+	return state != nil && state.uncacheable
+}
+
+// Sampled reports whether the current request was selected by the server
+// sampler, see ServerSampler. Tracing and access log hooks should skip
+// unsampled requests; metrics usually ignore sampling.
+func Sampled(ctx context.Context) bool {
+	state := getRequestState(ctx)
+	return state != nil && state.sampled
+}
+
+// RequestID returns the id of the current request as told by the codec,
+// see IDCodecRequest, and whether there is one. Notifications have none.
+// Each request of a batch has its own id.
+func RequestID(ctx context.Context) (string, bool) {
+	state := getRequestState(ctx)
+	if state == nil || state.info.ID == "" {
+		return "", false
+	}
+	return state.info.ID, true
+}
+
+// CallInfo describes the dispatch of a request, for metrics and logging
+// hooks. See Info.
+type CallInfo struct {
+	Method       string        // registered name, once aliases and case are resolved
+	ID           string        // id of the request, empty for notifications and null ids
+	Notification bool          // whether the client expects no response
+	Found        bool          // whether the method is registered
+	Handled      bool          // whether a hook of ServerBeforeV2 answered
+	BytesRead    int           // size of the request body
+	Start        time.Time     // when the server started serving the request
+	Duration     time.Duration // time spent in the method, middleware included
+}
+
+// Info returns what the server knows so far about the dispatch of the
+// current request, and whether ctx was created by the server. Before hooks
+// see Method, ID, Notification, BytesRead and Start; after hooks also see
+// Found, Handled and Duration.
+func Info(ctx context.Context) (CallInfo, bool) {
+	state := getRequestState(ctx)
+	if state == nil {
+		return CallInfo{}, false
+	}
+	return state.info, true
+}
@@ -0,0 +1,102 @@
+package jsonrpc
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures the cross-origin requests a server accepts, see
+// ServerCORS.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to call the server, like
+	// "https://app.example.com", or "*" for any.
+	AllowedOrigins []string
+
+	// AllowedMethods are the methods allowed in requests, POST if empty.
+	AllowedMethods []string
+
+	// AllowedHeaders are the headers allowed in requests, Content-Type if
+	// empty.
+	AllowedHeaders []string
+
+	// AllowCredentials lets browsers send cookies and credentials. It only
+	// applies to the origins listed by name: origins allowed through "*"
+	// never get credentialed access, or any site could act on behalf of
+	// the users of the server.
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache the answer to a preflight
+	// request, not sent if zero.
+	MaxAge time.Duration
+}
+
+// ServerCORS makes the server answer cross-origin requests from the
+// configured origins. Preflight OPTIONS requests are answered with a 204
+// status, and the other responses get Access-Control-Allow-* headers.
+// Requests from other origins get no CORS headers, so browsers block them.
+func ServerCORS(cfg CORSConfig) ServerOption {
+	return func(s *Server) { s.cors = &cfg }
+}
+
+// allowedOrigin returns the value of Access-Control-Allow-Origin for
+// origin, empty if it is not allowed, and whether origin is listed by name
+// rather than allowed through "*".
+func (c *CORSConfig) allowedOrigin(origin string) (string, bool) {
+	wildcard := false
+	for _, allowed := range c.AllowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+		wildcard = wildcard || allowed == "*"
+	}
+	if wildcard {
+		return "*", false
+	}
+	return "", false
+}
+
+// handle sets the CORS headers of the response to r and reports whether r
+// is a preflight request, answered already.
+func (c *CORSConfig) handle(w http.ResponseWriter, r *http.Request) bool {
+	preflight := r.Method == "OPTIONS"
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	allowed, listed := c.allowedOrigin(origin)
+	if allowed != "" {
+		header.Set("Access-Control-Allow-Origin", allowed)
+		if c.AllowCredentials && listed {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	if !preflight {
+		return false
+	}
+
+	if allowed != "" {
+		methods, headers := c.AllowedMethods, c.AllowedHeaders
+		if len(methods) == 0 {
+			methods = []string{"POST"}
+		}
+		if len(headers) == 0 {
+			headers = []string{"Content-Type"}
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		if c.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -73,11 +73,19 @@ When a service is registered, the server inspects the service methods
 and make available the ones that follow these rules:
 
 	- The method name is exported.
-	- The method has three arguments: *http.Request (optional), *args, *reply.
-	- All three arguments are pointers.
-	- The second and third arguments are exported or local.
-	- The method has return type error.
+	- The arguments are context.Context, *http.Request or *args, each optional.
+	- The *args are exported or local. An interface{} argument gets a
+	  pointer to the params decoded into an interface{}.
+	- The method returns a reply and an error, or only an error after
+	  filling its last argument, a pointer to the reply.
+	- A pointer reply argument may point to any exported or builtin
+	  type, like a *[]string, a *map[string]int or an *int; the value it
+	  points to is sent as the result.
 
 All other methods are ignored.
+
+Codecs whose requests implement BatchCodecRequest, like json2, accept
+batches of requests in a single body. The requests of a batch are served
+one after the other and their responses are sent together.
 */
 package jsonrpc
@@ -0,0 +1,230 @@
+package jsonrpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// ErrorCode JSON RPC error code type
+type ErrorCode int
+
+const (
+	// CodeParse Invalid JSON was received by the server.
+	CodeParse ErrorCode = -32700
+	// CodeInvalidRequest The JSON sent is not a valid Request object.
+	CodeInvalidRequest ErrorCode = -32600
+	// CodeMethodNotFound The method does not exist / is not available.
+	CodeMethodNotFound ErrorCode = -32601
+	// CodeBadParams Invalid method parameter(s).
+	CodeBadParams ErrorCode = -32602
+	// CodeInternal Internal JSON-RPC error.
+	CodeInternal ErrorCode = -32603
+	// CodeServer Reserved for implementation-defined server-errors.
+	CodeServer ErrorCode = -32000
+	// CodeTimeout The request took longer than the server timeout.
+	CodeTimeout ErrorCode = -32001
+)
+
+// Error JSON RPC error structure
+type Error struct {
+	// A Number that indicates the error type that occurred.
+	Code ErrorCode `json:"code"`
+
+	// A String providing a short description of the error.
+	// The message SHOULD be limited to a concise single sentence.
+	Message string `json:"message"`
+
+	// A Primitive or Structured value that contains additional information about the error.
+	Data interface{} `json:"data,omitempty"`
+}
+
+// NewError create a new error
+func NewError(code ErrorCode, message interface{}) *Error {
+	strErr, ok := message.(string)
+
+	if !ok {
+		err, ok := message.(error)
+
+		if ok {
+			strErr = err.Error()
+		}
+	}
+
+	return &Error{Code: code, Message: strErr}
+}
+
+// NewParseError returns an error with CodeParse.
+func NewParseError(message interface{}) *Error {
+	return NewError(CodeParse, message)
+}
+
+// NewInvalidRequestError returns an error with CodeInvalidRequest.
+func NewInvalidRequestError(message interface{}) *Error {
+	return NewError(CodeInvalidRequest, message)
+}
+
+// NewMethodNotFoundError returns an error with CodeMethodNotFound.
+func NewMethodNotFoundError(message interface{}) *Error {
+	return NewError(CodeMethodNotFound, message)
+}
+
+// NewInvalidParamsError returns an error with CodeBadParams.
+func NewInvalidParamsError(message interface{}) *Error {
+	return NewError(CodeBadParams, message)
+}
+
+// NewInternalError returns an error with CodeInternal.
+func NewInternalError(message interface{}) *Error {
+	return NewError(CodeInternal, message)
+}
+
+// NewServerError returns a server error. The code should be one of the
+// implementation-defined codes, from -32000 to -32099.
+func NewServerError(code ErrorCode, message interface{}) *Error {
+	return NewError(code, message)
+}
+
+// WithData returns a copy of the error with data as its Data, leaving e
+// untouched so it works on shared errors like ErrBadParams.
+func (e *Error) WithData(data interface{}) *Error {
+	err := *e
+	err.Data = data
+	return &err
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an *Error with the same code, so that
+// errors.Is(err, ErrBadParams) holds for any error with CodeBadParams,
+// whatever its message, wrapped or not. Errors with CodeMethodNotFound,
+// e.g. those received by clients, also match ErrMethodNotFound and
+// ErrServiceNotFound, which only match each other by identity.
+func (e *Error) Is(target error) bool {
+	if target == ErrMethodNotFound || target == ErrServiceNotFound {
+		return e != nil && e.Code == CodeMethodNotFound
+	}
+	t, ok := target.(*Error)
+	return ok && e != nil && t != nil && e.Code == t.Code
+}
+
+// Errors with the standard codes, to be matched with errors.Is.
+var (
+	ErrParse          = &Error{Code: CodeParse, Message: "rpc: parse error"}
+	ErrInvalidRequest = &Error{Code: CodeInvalidRequest, Message: "rpc: invalid request"}
+	ErrBadParams      = &Error{Code: CodeBadParams, Message: "rpc: invalid params"}
+	ErrInternal       = &Error{Code: CodeInternal, Message: "rpc: internal error"}
+	ErrServer         = &Error{Code: CodeServer, Message: "rpc: server error"}
+	ErrTimeout        = &Error{Code: CodeTimeout, Message: "rpc: request timed out"}
+)
+
+// RetryableError is returned by methods to make the client back off, e.g.
+// when a downstream service is rate limited. The server answers with HTTP
+// 429 and a Retry-After header, and writes Err as the error of the response.
+type RetryableError struct {
+	// After is how long the client should wait before retrying.
+	After time.Duration
+
+	// Err is the error sent to the client, a CodeServer error "rpc: retry
+	// later" if nil.
+	Err *Error
+}
+
+func (e *RetryableError) Error() string {
+	return e.sent().Error()
+}
+
+// Unwrap returns the error sent, so errors.As and errors.Is see it.
+func (e *RetryableError) Unwrap() error {
+	return e.sent()
+}
+
+// sent returns the error sent to the client.
+func (e *RetryableError) sent() *Error {
+	if e.Err == nil {
+		return NewError(CodeServer, "rpc: retry later")
+	}
+	return e.Err
+}
+
+// FieldError describes a problem with a single input field.
+//
+// Errors about client input, whether found while decoding params or by the
+// method itself, carry a list of field errors as their Data, so clients
+// get a single schema for all of them.
+type FieldError struct {
+	// Field is the path of the field, e.g. "Address.City".
+	Field string `json:"field"`
+
+	// Code is a short machine readable reason, e.g. "type" or "required".
+	Code string `json:"code"`
+
+	// Message is a human readable description of the problem.
+	Message string `json:"message"`
+}
+
+// FieldErrors is a list of field errors. Returned by a method, it is sent to
+// the client as a CodeBadParams error with the list as Data.
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, f := range e {
+		if f.Field == "" {
+			messages[i] = f.Message
+		} else {
+			messages[i] = f.Field + ": " + f.Message
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// ErrorCodeOf returns the code of the error sent to the client when a
+// method, or the server looking for it, fails with err.
+func ErrorCodeOf(err error) ErrorCode {
+	var fields FieldErrors
+	if errors.As(err, &fields) {
+		return CodeBadParams
+	}
+	var retryable *RetryableError
+	if errors.As(err, &retryable) {
+		return retryable.sent().Code
+	}
+	var jsonErr *Error
+	if errors.As(err, &jsonErr) {
+		return jsonErr.Code
+	}
+	switch {
+	case errors.Is(err, ErrMethodNotFound), errors.Is(err, ErrServiceNotFound):
+		return CodeMethodNotFound
+	case errors.Is(err, ErrRequestIllFormed):
+		return CodeInvalidRequest
+	}
+	return CodeServer
+}
+
+// DebugData is the Data of the errors built by a server in debug mode, see
+// ServerDebug.
+type DebugData struct {
+	// Error is the message of the Go error, or the recovered panic value.
+	Error string `json:"error"`
+
+	// Stack is the stack trace of the error or panic, if known. Errors
+	// carry one when made with github.com/pkg/errors.
+	Stack string `json:"stack,omitempty"`
+}
+
+// newDebugData returns the debug data of err.
+func newDebugData(err error) *DebugData {
+	data := &DebugData{Error: err.Error()}
+	var tracer interface{ StackTrace() pkgerrors.StackTrace }
+	if errors.As(err, &tracer) {
+		data.Stack = strings.TrimPrefix(fmt.Sprintf("%+v", tracer.StackTrace()), "\n")
+	}
+	return data
+}
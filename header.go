@@ -0,0 +1,167 @@
+package jsonrpc
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// isHeaderArgs reports whether t is a struct bound to the HTTP headers of
+// the request rather than to the params, that is one with fields tagged
+// header, like
+//
+//	type Auth struct {
+//		Token   string   `header:"Authorization"`
+//		Retries *int     `header:"X-Retries"`
+//		Tags    []string `header:"X-Tag"`
+//	}
+//
+// Methods take it as any other argument, e.g.
+// func(ctx context.Context, auth *Auth, args *Args) (*Reply, error).
+// Unexported fields are ignored, tagged or not.
+func isHeaderArgs(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := headerName(t.Field(i)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// headerName returns the header a field is bound to, false if it is bound
+// to none.
+func headerName(field reflect.StructField) (string, bool) {
+	name, ok := field.Tag.Lookup("header")
+	if !ok || name == "" || name == "-" || field.PkgPath != "" {
+		return "", false
+	}
+	return name, true
+}
+
+// checkHeaderArgs returns an error if a header struct of args has a field
+// of a type readHeader can't fill, so that methods are refused at
+// registration rather than failing on requests.
+func checkHeaderArgs(args []reflect.Type) error {
+	for _, arg := range args {
+		if !isHeaderArgs(arg) {
+			continue
+		}
+		for i := 0; i < arg.NumField(); i++ {
+			field := arg.Field(i)
+			if _, ok := headerName(field); !ok {
+				continue
+			}
+			t := field.Type
+			if t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if t.Kind() == reflect.Slice {
+				t = t.Elem()
+			}
+			if !isHeaderValueKind(t.Kind()) {
+				return fmt.Errorf("header field %s.%s has unsupported type %s", arg.Name(), field.Name, field.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// isHeaderValueKind reports whether setHeaderValue parses values of kind k.
+func isHeaderValueKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// isParamsArg reports whether an arg of type t is decoded from the params.
+func isParamsArg(t reflect.Type) bool {
+	return t != typeOfContext && t != typeOfRequest && !isHeaderArgs(t)
+}
+
+// readHeader fills the fields of the struct args points to from the headers
+// named by their header tags. Fields of absent headers are left untouched,
+// so pointer fields stay nil. Slices get all the values of a header, other
+// fields the first one; strings, bools and numbers are supported.
+func readHeader(header http.Header, args reflect.Value) error {
+	var fields FieldErrors
+	v := args.Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, ok := headerName(v.Type().Field(i))
+		if !ok {
+			continue
+		}
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+
+		field := v.Field(i)
+		if field.Kind() == reflect.Ptr {
+			field.Set(reflect.New(field.Type().Elem()))
+			field = field.Elem()
+		}
+		var err error
+		if field.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+			for j, value := range values {
+				if err = setHeaderValue(slice.Index(j), value); err != nil {
+					break
+				}
+			}
+			field.Set(slice)
+		} else {
+			err = setHeaderValue(field, values[0])
+		}
+		if err != nil {
+			fields = append(fields, FieldError{Field: name, Code: "type", Message: err.Error()})
+		}
+	}
+	if len(fields) > 0 {
+		return fields
+	}
+	return nil
+}
+
+// setHeaderValue parses value into v according to its kind.
+func setHeaderValue(v reflect.Value, value string) error {
+	var err error
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(value); err == nil {
+			v.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if n, err = strconv.ParseInt(value, 10, v.Type().Bits()); err == nil {
+			v.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if n, err = strconv.ParseUint(value, 10, v.Type().Bits()); err == nil {
+			v.SetUint(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(value, v.Type().Bits()); err == nil {
+			v.SetFloat(f)
+		}
+	default:
+		return fmt.Errorf("unsupported header field type %s", v.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("expected type %s, got %q", v.Type(), value)
+	}
+	return nil
+}
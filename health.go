@@ -0,0 +1,80 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// ServerReadiness adds a check run by the handler of HealthHandler. An error
+// it returns makes the server unavailable. Checks run in registration order.
+func ServerReadiness(check func(ctx context.Context) error) ServerOption {
+	return func(s *Server) { s.readiness = append(s.readiness, check) }
+}
+
+// healthStatus is the body written by the handler of HealthHandler.
+type healthStatus struct {
+	Status  string   `json:"status"`
+	Error   string   `json:"error,omitempty"`
+	Codecs  []string `json:"codecs"`
+	Methods int      `json:"methods"`
+}
+
+// HealthHandler returns a handler answering GET requests, e.g. from load
+// balancers, with the content types of the codecs and the number of methods
+// of the server as JSON, like
+//
+//	{"status":"ok","codecs":["application/json"],"methods":12}
+//
+// The status is 200, or 503 with "unavailable" and the error once a check
+// of ServerReadiness fails or the server is shutting down. Other HTTP
+// methods get a 405.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(s.serveHealth)
+}
+
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		WriteError(w, 405, "rpc: GET method required, received "+r.Method)
+		return
+	}
+
+	health := healthStatus{Status: "ok", Codecs: []string{}, Methods: s.serviceMap().count()}
+	for contentType := range s.codecs {
+		health.Codecs = append(health.Codecs, contentType)
+	}
+	sort.Strings(health.Codecs)
+
+	err := s.ready(r.Context())
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusServiceUnavailable
+		health.Status, health.Error = "unavailable", err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method == "GET" {
+		json.NewEncoder(w).Encode(health)
+	}
+}
+
+// ready returns the error making the server unavailable, nil if it is ready.
+func (s *Server) ready(ctx context.Context) error {
+	s.shutdownMutex.RLock()
+	shutdown := s.shutdown
+	s.shutdownMutex.RUnlock()
+	if shutdown {
+		return errShuttingDown
+	}
+
+	for _, check := range s.readiness {
+		if err := check(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package jsonrpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyStore keeps the responses of the requests carrying an
+// idempotency key, for ServerIdempotency. It is safe for concurrent use.
+type IdempotencyStore interface {
+	// Get returns the response stored under key, false if there is none
+	// or it expired.
+	Get(key string) ([]byte, bool)
+	// Set stores the response under key, as long as the store sees fit.
+	Set(key string, response []byte)
+}
+
+// ServerIdempotency makes the server answer the requests carrying the
+// header, like "Idempotency-Key", at most once per key, method and params:
+// the response of the first one is kept in store and replayed to the next
+// ones, with an Idempotent-Replayed header, instead of calling the method
+// again. Duplicates arriving while the first one runs wait for it, at most
+// until the timeout of ServerTimeout which gets them a CodeTimeout error.
+//
+// Responses are kept after the auth hooks passed, unless their status is
+// 429 or 5xx so that retries of failed calls get another chance.
+// Notifications and requests without the header are served as usual.
+func ServerIdempotency(store IdempotencyStore, header string) ServerOption {
+	return func(s *Server) {
+		s.idempotency = &idempotency{
+			store:  store,
+			header: header,
+			calls:  make(map[string]*idempotentCall),
+		}
+	}
+}
+
+// idempotency replays the responses of requests already served for the
+// same idempotency key.
+type idempotency struct {
+	store  IdempotencyStore
+	header string
+	mutex  sync.Mutex // protects calls
+	calls  map[string]*idempotentCall
+}
+
+// idempotentCall is a request being served for a key.
+type idempotentCall struct {
+	done     chan struct{}
+	response []byte // kept response, nil if not kept
+}
+
+// idempotentResponse is a response as kept in the store.
+type idempotentResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// key returns the key of the response to the call of method by r, empty if
+// r has no idempotency key.
+func (i *idempotency) key(r *http.Request, method string, codecReq CodecRequest) string {
+	key := r.Header.Get(i.header)
+	if key == "" {
+		return ""
+	}
+	hash := sha256.Sum256(codecReq.Body())
+	return key + "\x00" + method + "\x00" + hex.EncodeToString(hash[:])
+}
+
+// serve replays the response kept for key, waiting for the request being
+// served for it if any, or else serves the request and keeps its response.
+// It returns the error of ctx, writing nothing, if ctx is done while
+// waiting.
+func (i *idempotency) serve(ctx context.Context, w http.ResponseWriter, key string, serve func(w http.ResponseWriter)) error {
+	for {
+		i.mutex.Lock()
+		call, ok := i.calls[key]
+		if !ok {
+			call = &idempotentCall{done: make(chan struct{})}
+			i.calls[key] = call
+		}
+		i.mutex.Unlock()
+
+		if !ok {
+			i.run(w, key, call, serve)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-call.done:
+		}
+		if call.response != nil && replay(w, call.response) {
+			return nil
+		}
+		// The first request kept nothing, so this one has its own go.
+	}
+}
+
+// run serves the request of call, or replays the response in the store.
+func (i *idempotency) run(w http.ResponseWriter, key string, call *idempotentCall, serve func(w http.ResponseWriter)) {
+	defer func() {
+		i.mutex.Lock()
+		delete(i.calls, key)
+		i.mutex.Unlock()
+		close(call.done)
+	}()
+
+	if response, ok := i.store.Get(key); ok && replay(w, response) {
+		call.response = response
+		return
+	}
+
+	buf := newResponseBuffer(0)
+	serve(buf)
+	// Nothing is written for clients gone away.
+	if status := buf.status; (status != 0 || buf.body.Len() > 0) && status != 429 && status < 500 {
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response, err := json.Marshal(idempotentResponse{Status: status, Header: buf.header, Body: buf.body.Bytes()})
+		if err == nil {
+			i.store.Set(key, response)
+			call.response = response
+		}
+	}
+	buf.flush(w)
+}
+
+// replay writes a kept response to w, and reports whether it could.
+func replay(w http.ResponseWriter, response []byte) bool {
+	var kept idempotentResponse
+	if err := json.Unmarshal(response, &kept); err != nil {
+		return false
+	}
+	for k, v := range kept.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(kept.Status)
+	w.Write(kept.Body)
+	return true
+}
+
+// NewIdempotencyStore returns an IdempotencyStore keeping responses in
+// memory for ttl.
+func NewIdempotencyStore(ttl time.Duration) IdempotencyStore {
+	return &memoryIdempotencyStore{
+		ttl:       ttl,
+		responses: make(map[string]memoryResponse),
+		lastSweep: time.Now(),
+	}
+}
+
+type memoryIdempotencyStore struct {
+	ttl       time.Duration
+	mutex     sync.Mutex // protects the fields below
+	responses map[string]memoryResponse
+	lastSweep time.Time
+}
+
+type memoryResponse struct {
+	response []byte
+	expires  time.Time
+}
+
+func (m *memoryIdempotencyStore) Get(key string) ([]byte, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	r, ok := m.responses[key]
+	if !ok || time.Now().After(r.expires) {
+		return nil, false
+	}
+	return r.response, true
+}
+
+func (m *memoryIdempotencyStore) Set(key string, response []byte) {
+	now := time.Now()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if now.Sub(m.lastSweep) > m.ttl {
+		for k, r := range m.responses {
+			if now.After(r.expires) {
+				delete(m.responses, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.responses[key] = memoryResponse{response: response, expires: now.Add(m.ttl)}
+}
@@ -0,0 +1,105 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+)
+
+// Invoke calls a registered method with in-memory params and stores its
+// result in reply, without HTTP nor codec, e.g. for unit tests of services.
+//
+// The call goes through the same steps as a request served over HTTP:
+// hooks, middleware, timeout, error mapping and so on. Methods taking an
+// *http.Request get an empty POST request. params is copied into the args
+// of the method when it has their type, or a pointer to it, and converted
+// through encoding/json otherwise; reply is filled the same way and may be
+// nil. The error is the one a client would get, usually an *Error.
+func (s *Server) Invoke(ctx context.Context, method string, params, reply interface{}) error {
+	r, err := http.NewRequestWithContext(ctx, "POST", "/", http.NoBody)
+	if err != nil {
+		return err
+	}
+	req := &invokeRequest{method: method, params: params}
+	s.serveRequest(newResponseBuffer(0), r, req)
+	if !req.written && ctx.Err() != nil {
+		// Nothing is written once ctx is done.
+		return ctx.Err()
+	}
+	if req.err != nil || reply == nil {
+		return req.err
+	}
+	if err := assignValue(reply, req.reply); err != nil {
+		return NewError(CodeInternal, "rpc: can't store reply: "+err.Error())
+	}
+	return nil
+}
+
+// invokeRequest is the CodecRequest of Invoke, keeping the outcome of the
+// call instead of writing it.
+type invokeRequest struct {
+	method  string
+	params  interface{}
+	reply   interface{}
+	err     error
+	written bool
+}
+
+func (r *invokeRequest) Method() (string, error) {
+	return r.method, nil
+}
+
+func (r *invokeRequest) ID() interface{} {
+	return nil
+}
+
+func (r *invokeRequest) ReadRequest(args interface{}) error {
+	if r.params == nil {
+		return nil
+	}
+	if err := assignValue(args, r.params); err != nil {
+		return NewError(CodeBadParams, err.Error())
+	}
+	return nil
+}
+
+func (r *invokeRequest) WriteResponse(w http.ResponseWriter, reply interface{}) error {
+	r.reply, r.written = reply, true
+	return nil
+}
+
+func (r *invokeRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	r.err, r.written = err, true
+}
+
+func (r *invokeRequest) Body() []byte {
+	return nil
+}
+
+// assignValue stores src into the value dst points to, directly when it
+// has its type or points to a value of its type, through encoding/json
+// otherwise.
+func assignValue(dst, src interface{}) error {
+	target := reflect.ValueOf(dst)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return &json.InvalidUnmarshalError{Type: reflect.TypeOf(dst)}
+	}
+	target = target.Elem()
+
+	value := reflect.ValueOf(src)
+	if value.IsValid() && value.Type().AssignableTo(target.Type()) {
+		target.Set(value)
+		return nil
+	}
+	if value.Kind() == reflect.Ptr && !value.IsNil() && value.Elem().Type().AssignableTo(target.Type()) {
+		target.Set(value.Elem())
+		return nil
+	}
+
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
@@ -1,8 +1,10 @@
 package json2
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
+	"math/big"
 	"math/rand"
 )
 
@@ -22,8 +24,9 @@ type clientRequest struct {
 	Params interface{} `json:"params"`
 
 	// The request id. This can be of any type. It is used to match the
-	// response with the request that it is replying to.
-	ID uint64 `json:"id"`
+	// response with the request that it is replying to. Notifications have
+	// none.
+	ID interface{} `json:"id,omitempty"`
 }
 
 // clientResponse represents a JSON-RPC response returned to a client.
@@ -31,6 +34,7 @@ type clientResponse struct {
 	Version string           `json:"jsonrpc"`
 	Result  *json.RawMessage `json:"result"`
 	Error   *json.RawMessage `json:"error"`
+	ID      json.RawMessage  `json:"id"`
 }
 
 // EncodeClientRequest encodes parameters for a JSON-RPC client request.
@@ -44,8 +48,36 @@ func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
 	return json.Marshal(c)
 }
 
+// EncodeClientRequestWithID is like EncodeClientRequest with the given id,
+// typically a string or a number. A nil id is sent as null.
+func EncodeClientRequestWithID(method string, args interface{}, id interface{}) ([]byte, error) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return json.Marshal(&clientRequest{
+		Version: Version,
+		Method:  method,
+		Params:  args,
+		ID:      id,
+	})
+}
+
+// EncodeClientNotification encodes parameters for a JSON-RPC notification,
+// a request without id that the server doesn't answer.
+func EncodeClientNotification(method string, args interface{}) ([]byte, error) {
+	return json.Marshal(&clientRequest{
+		Version: Version,
+		Method:  method,
+		Params:  args,
+	})
+}
+
 // DecodeClientResponse decodes the response body of a client request into
 // the interface reply.
+//
+// If the server sent an error object, the returned error is an *Error with
+// its code, message and data; structured data is decoded as by
+// encoding/json into an interface{}. A null result gives ErrNullResult.
 func DecodeClientResponse(r io.Reader, reply interface{}) error {
 	var c clientResponse
 
@@ -53,16 +85,26 @@ func DecodeClientResponse(r io.Reader, reply interface{}) error {
 		return err
 	}
 
-	if c.Error != nil {
-		jsonErr := &Error{}
+	return c.decode(reply)
+}
 
-		if err := json.Unmarshal(*c.Error, jsonErr); err != nil {
-			return &Error{
-				Code:    ErrServer,
-				Message: string(*c.Error),
-			}
-		}
-		return jsonErr
+// DecodeClientResponseAllowNull is like DecodeClientResponse but treats a
+// null result as a successful call and leaves reply untouched.
+//
+// Use it for methods that legitimately return null. DecodeClientResponse
+// reports ErrNullResult instead, which suits methods where a null result
+// means something went wrong.
+func DecodeClientResponseAllowNull(r io.Reader, reply interface{}) error {
+	if err := DecodeClientResponse(r, reply); err != ErrNullResult {
+		return err
+	}
+	return nil
+}
+
+// decode fills reply with the result or returns the error of the response.
+func (c *clientResponse) decode(reply interface{}) error {
+	if err := c.decodeError(); err != nil {
+		return err
 	}
 
 	if c.Result == nil {
@@ -71,3 +113,83 @@ func DecodeClientResponse(r io.Reader, reply interface{}) error {
 
 	return json.Unmarshal(*c.Result, reply)
 }
+
+// decodeError returns the error of the response, nil if there is none.
+func (c *clientResponse) decodeError() error {
+	if c.Error == nil {
+		return nil
+	}
+
+	jsonErr := &Error{}
+
+	if err := json.Unmarshal(*c.Error, jsonErr); err != nil {
+		return &Error{
+			Code:    ErrServer,
+			Message: string(*c.Error),
+		}
+	}
+	return jsonErr
+}
+
+// BatchResponse is one element of the response to a batch request.
+type BatchResponse struct {
+	c clientResponse
+}
+
+// ID returns the raw id of the request the response belongs to.
+func (r *BatchResponse) ID() json.RawMessage {
+	return r.c.ID
+}
+
+// Decode decodes the result into the interface reply. Like
+// DecodeClientResponse it returns the server error or ErrNullResult.
+func (r *BatchResponse) Decode(reply interface{}) error {
+	return r.c.decode(reply)
+}
+
+// DecodeClientBatchResponse decodes the response body of a batch request.
+//
+// Responses may come in any order; use IDEqual to match them against the
+// ids of the requests.
+func DecodeClientBatchResponse(r io.Reader) ([]BatchResponse, error) {
+	var c []clientResponse
+
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+
+	res := make([]BatchResponse, len(c))
+	for i := range c {
+		res[i].c = c[i]
+	}
+	return res, nil
+}
+
+// IDEqual reports whether two raw JSON-RPC ids are equal. The comparison
+// keeps the JSON type, so the string "1" and the number 1 differ, and
+// compares numbers exactly rather than through float64.
+func IDEqual(a, b json.RawMessage) bool {
+	a, b = bytes.TrimSpace(a), bytes.TrimSpace(b)
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+
+	switch {
+	case a[0] == '"' && b[0] == '"':
+		var sa, sb string
+		if json.Unmarshal(a, &sa) != nil || json.Unmarshal(b, &sb) != nil {
+			return false
+		}
+		return sa == sb
+	case a[0] == '"' || b[0] == '"':
+		return false
+	}
+
+	fa, _, errA := big.ParseFloat(string(a), 10, 256, big.ToNearestEven)
+	fb, _, errB := big.ParseFloat(string(b), 10, 256, big.ToNearestEven)
+	if errA != nil || errB != nil {
+		// Not numbers, e.g. null.
+		return bytes.Equal(a, b)
+	}
+	return fa.Cmp(fb) == 0
+}
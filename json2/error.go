@@ -2,57 +2,40 @@ package json2
 
 import (
 	"errors"
+
+	"github.com/devimteam/jsonrpc"
 )
 
 // ErrorCode JSON RPC error code type
-type ErrorCode int
+type ErrorCode = jsonrpc.ErrorCode
 
 const (
 	// ErrParse Invalid JSON was received by the server.
-	ErrParse ErrorCode = -32700
+	ErrParse = jsonrpc.CodeParse
 	// ErrInvalidRequest The JSON sent is not a valid Request object.
-	ErrInvalidRequest ErrorCode = -32600
+	ErrInvalidRequest = jsonrpc.CodeInvalidRequest
 	// ErrMethodNotFound The method does not exist / is not available.
-	ErrMethodNotFound ErrorCode = -32601
+	ErrMethodNotFound = jsonrpc.CodeMethodNotFound
 	// ErrBadParams Invalid method parameter(s).
-	ErrBadParams ErrorCode = -32602
+	ErrBadParams = jsonrpc.CodeBadParams
 	// ErrInternal Internal JSON-RPC error.
-	ErrInternal ErrorCode = -32603
+	ErrInternal = jsonrpc.CodeInternal
 	// ErrServer Reserved for implementation-defined server-errors.
-	ErrServer ErrorCode = -32000
+	ErrServer = jsonrpc.CodeServer
+	// ErrTimeout The request took longer than the server timeout.
+	ErrTimeout = jsonrpc.CodeTimeout
 )
 
 // ErrNullResult result is null
 var ErrNullResult = errors.New("result is null")
 
-// Error JSON RPC error structure
-type Error struct {
-	// A Number that indicates the error type that occurred.
-	Code ErrorCode `json:"code"`
-
-	// A String providing a short description of the error.
-	// The message SHOULD be limited to a concise single sentence.
-	Message string `json:"message"`
+// ErrMissingResponse the response to a call of a batch is missing
+var ErrMissingResponse = errors.New("response is missing")
 
-	// A Primitive or Structured value that contains additional information about the error.
-	Data interface{} `json:"data,omitempty"`
-}
+// Error JSON RPC error structure
+type Error = jsonrpc.Error
 
 // NewError create a new error
 func NewError(code ErrorCode, message interface{}) *Error {
-	strErr, ok := message.(string)
-
-	if !ok {
-		err, ok := message.(error)
-
-		if ok {
-			strErr = err.Error()
-		}
-	}
-
-	return &Error{Code: code, Message: strErr}
-}
-
-func (e *Error) Error() string {
-	return e.Message
+	return jsonrpc.NewError(code, message)
 }
@@ -0,0 +1,153 @@
+package json2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+// Client
+// ----------------------------------------------------------------------------
+
+// Client calls the methods of a JSON-RPC 2.0 server over HTTP.
+type Client struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// HTTPClient sets the HTTP client sending the requests, instead of
+// http.DefaultClient.
+func HTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// NewClient returns a client calling the server at endpoint.
+func NewClient(endpoint string, options ...ClientOption) *Client {
+	c := &Client{endpoint: endpoint, httpClient: http.DefaultClient}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Call calls method with params and decodes its result into result. It
+// returns the *Error sent by the server, if any, or ErrNullResult like
+// DecodeClientResponse. Cancelling ctx aborts the request.
+func (c *Client) Call(ctx context.Context, method string, params, result interface{}) error {
+	body, err := EncodeClientRequest(method, params)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.post(ctx, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var response clientResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("unexpected response: %s: %v", res.Status, err)
+	}
+	return response.decode(result)
+}
+
+// BatchElem is a call of a batch. When Error is not nil, CallBatch stores
+// the error of the call where it points, nil if the call succeeded. Result
+// is left untouched for failed calls.
+type BatchElem struct {
+	Method string
+	Params interface{}
+	Result interface{}
+	Error  *error
+}
+
+// setError stores the error of the call, if the caller asked for it.
+func (e *BatchElem) setError(err error) {
+	if e.Error != nil {
+		*e.Error = err
+	}
+}
+
+// CallBatch sends the calls of batch in a single request and decodes the
+// result of each into its Result, or stores its error through its Error.
+// Calls with a nil Result are only checked for errors.
+//
+// The returned error is about the batch as a whole, like a failed request
+// or a server answering with a single error object instead of an array.
+func (c *Client) CallBatch(ctx context.Context, batch []BatchElem) error {
+	requests := make([]clientRequest, len(batch))
+	for i, elem := range batch {
+		requests[i] = clientRequest{
+			Version: Version,
+			Method:  elem.Method,
+			Params:  elem.Params,
+			ID:      uint64(i + 1),
+		}
+	}
+	body, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.post(ctx, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	// Requests the server can't handle as a batch get a single error.
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+		var response clientResponse
+		if err := json.Unmarshal(data, &response); err != nil || response.Error == nil {
+			return fmt.Errorf("unexpected response: %s", res.Status)
+		}
+		return response.decodeError()
+	}
+
+	responses, err := DecodeClientBatchResponse(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("unexpected response: %s: %v", res.Status, err)
+	}
+
+	for i := range batch {
+		batch[i].setError(ErrMissingResponse)
+	}
+	for _, response := range responses {
+		var id uint64
+		if json.Unmarshal(response.ID(), &id) != nil || id == 0 || id > uint64(len(batch)) {
+			continue
+		}
+		elem := &batch[id-1]
+		if elem.Result == nil {
+			elem.setError(response.c.decodeError())
+		} else {
+			elem.setError(response.Decode(elem.Result))
+		}
+	}
+	return nil
+}
+
+// post sends a request body to the endpoint.
+func (c *Client) post(ctx context.Context, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.httpClient.Do(req)
+}
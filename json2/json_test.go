@@ -1,12 +1,33 @@
 package json2
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/devimteam/jsonrpc"
+	"github.com/gorilla/websocket"
+	pkgerrors "github.com/pkg/errors"
+	"golang.org/x/time/rate"
 )
 
 // ResponseRecorder is an implementation of http.ResponseWriter that
@@ -82,6 +103,25 @@ type Service1ParamsArrayRequest struct {
 	ID uint64 `json:"id"`
 }
 
+type Service1PageRequest struct {
+	Limit  int
+	Offset int
+}
+
+func (r *Service1PageRequest) SetDefaults() {
+	r.Limit = 20
+}
+
+func (r *Service1PageRequest) Validate() error {
+	if r.Offset < 0 {
+		return jsonrpc.FieldErrors{{Field: "Offset", Code: "range", Message: "must not be negative"}}
+	}
+	if r.Limit > 100 {
+		return errors.New("limit must be at most 100")
+	}
+	return nil
+}
+
 type Service1Response struct {
 	Result int
 }
@@ -104,10 +144,111 @@ func (t *Service1) Multiply(req *Service1Request) (*Service1Response, error) {
 	return res, nil
 }
 
+// Service1OptionalRequest tells absent members from zero ones.
+type Service1OptionalRequest struct {
+	A *int
+	B *int
+}
+
+// Optional returns the names of the params sent.
+func (t *Service1) Optional(req *Service1OptionalRequest) ([]string, error) {
+	sent := []string{}
+	if req.A != nil {
+		sent = append(sent, "A")
+	}
+	if req.B != nil {
+		sent = append(sent, "B")
+	}
+	return sent, nil
+}
+
 func (t *Service1) ResponseError(req *Service1Request) (*Service1Response, error) {
 	return nil, ErrResponseError
 }
 
+func (t *Service1) Page(req *Service1PageRequest) (*Service1PageRequest, error) {
+	return req, nil
+}
+
+type Service1AggregateResponse struct {
+	Values []int
+	failed []string
+}
+
+func (r *Service1AggregateResponse) Warnings() []string {
+	return r.failed
+}
+
+func (t *Service1) Aggregate(req *Service1Request) (*Service1AggregateResponse, error) {
+	return &Service1AggregateResponse{
+		Values: []int{req.A, req.B},
+		failed: []string{"backend C unavailable"},
+	}, nil
+}
+
+type Service1EchoRequest struct {
+	S string
+}
+
+func (t *Service1) Echo(req *Service1EchoRequest) (*Service1EchoRequest, error) {
+	return req, nil
+}
+
+func (t *Service1) Panic(req *Service1Request) (*Service1Response, error) {
+	panic("boom")
+}
+
+func (t *Service1) Volatile(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+	jsonrpc.MarkUncacheable(ctx)
+	return &Service1Response{Result: req.A * req.B}, nil
+}
+
+func (t *Service1) Fail(req *Service1EchoRequest) (*Service1Response, error) {
+	if req.S == "" {
+		return nil, errors.New("plain failure")
+	}
+	return nil, &Error{Code: 42, Message: req.S, Data: map[string]interface{}{"retries": 3}}
+}
+
+func (t *Service1) Internal(req *Service1Request) (*Service1Response, error) {
+	return nil, NewError(ErrInternal, "internal failure")
+}
+
+func (t *Service1) Wait(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(time.Duration(req.A) * time.Millisecond):
+		return &Service1Response{Result: req.A}, nil
+	}
+}
+
+type Service1PeriodRequest struct {
+	From time.Time
+	To   time.Time
+}
+
+func (t *Service1) Period(req *Service1PeriodRequest) (*Service1PeriodRequest, error) {
+	return req, nil
+}
+
+func (t *Service1) Busy(req *Service1Request) (*Service1Response, error) {
+	if req.A < 0 {
+		return nil, &jsonrpc.RetryableError{After: time.Second}
+	}
+	return nil, &jsonrpc.RetryableError{
+		After: 1500 * time.Millisecond,
+		Err:   NewError(ErrServer, "busy"),
+	}
+}
+
+func (t *Service1) Register(req *Service1EchoRequest) (*Service1EchoRequest, error) {
+	if req.S == "" {
+		return nil, jsonrpc.FieldErrors{{Field: "S", Code: "required", Message: "must not be empty"}}
+	}
+	return req, nil
+}
+
 func execute(
 	t *testing.T,
 	s *jsonrpc.Server,
@@ -206,19 +347,3030 @@ func TestService(t *testing.T) {
 	}
 }
 
-func TestDecodeNullResult(t *testing.T) {
-	data := `{"jsonrpc": "2.0", "id": 12345, "result": null}`
-	reader := bytes.NewReader([]byte(data))
+func TestPositionalParams(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
 
-	var result interface{}
+	var res Service1Response
 
-	err := DecodeClientResponse(reader, &result)
+	w := serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":[4,2],"id":1}`)
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected result 8, but got %d, %v", res.Result, err)
+	}
 
-	if err != ErrNullResult {
-		t.Error("Expected err no be ErrNullResult, but got:", err)
+	for _, params := range []string{`[4]`, `[4,2,1]`} {
+		w := serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":`+params+`,"id":1}`)
+		err := DecodeClientResponse(w.Body, &res)
+		if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrBadParams {
+			t.Errorf("Expected ErrBadParams for %s, but got: %v", params, err)
+		}
 	}
+}
 
-	if result != nil {
-		t.Error("Expected result to be nil, but got:", result)
+func TestArgsDefaults(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1PageRequest
+
+	if err := execute(t, s, "Service1.Page", map[string]int{"Offset": 5}, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Limit != 20 || res.Offset != 5 {
+		t.Errorf("Wrong response: %+v", res)
+	}
+
+	if err := execute(t, s, "Service1.Page", map[string]int{"Limit": 0}, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Limit != 0 {
+		t.Errorf("Expected explicit Limit to win, but got %d", res.Limit)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1PageRequest
+
+	err := execute(t, s, "Service1.Page", map[string]int{"Limit": 200}, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrBadParams || jsonErr.Message != "limit must be at most 100" {
+		t.Errorf("Expected ErrBadParams, but got: %v", err)
+	}
+
+	err = execute(t, s, "Service1.Page", map[string]int{"Offset": -1}, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrBadParams || jsonErr.Message != "Offset: must not be negative" {
+		t.Errorf("Expected field errors, but got: %v", err)
+	}
+
+	if err := execute(t, s, "Service1.Page", map[string]int{"Limit": 100}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	for _, include := range []bool{false, true} {
+		s := jsonrpc.NewServer()
+		if include {
+			s.RegisterCodec(NewCodec(IncludeWarnings()), "application/json")
+		} else {
+			s.RegisterCodec(NewCodec(), "application/json")
+		}
+		s.RegisterService(new(Service1), "")
+
+		buf, _ := EncodeClientRequest("Service1.Aggregate", &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res struct {
+			Result Service1AggregateResponse
+			Meta   *struct {
+				Warnings []string
+			}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.Result.Values) != 2 {
+			t.Errorf("Wrong result: %+v", res.Result)
+		}
+
+		if !include && res.Meta != nil {
+			t.Errorf("Expected no meta, but got %+v", res.Meta)
+		}
+
+		if include && (res.Meta == nil || len(res.Meta.Warnings) != 1) {
+			t.Errorf("Expected one warning, but got %+v", res.Meta)
+		}
+	}
+}
+
+func TestValidateUTF8Params(t *testing.T) {
+	body := "{\"jsonrpc\":\"2.0\",\"method\":\"Service1.Echo\",\"params\":{\"S\":\"a\xffb\"},\"id\":1}"
+
+	for _, validate := range []bool{false, true} {
+		s := jsonrpc.NewServer()
+		if validate {
+			s.RegisterCodec(NewCodec(ValidateUTF8Params()), "application/json")
+		} else {
+			s.RegisterCodec(NewCodec(), "application/json")
+		}
+		s.RegisterService(new(Service1), "")
+
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res Service1EchoRequest
+		err := DecodeClientResponse(w.Body, &res)
+
+		if !validate {
+			if err != nil {
+				t.Error("Expected err to be nil, but got:", err)
+			}
+			continue
+		}
+
+		if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrInvalidRequest {
+			t.Errorf("Expected ErrInvalidRequest, but got: %v", err)
+		}
+	}
+}
+
+type okEnvelope struct {
+	OK   bool        `json:"ok"`
+	Data interface{} `json:"data"`
+	Err  *Error      `json:"err"`
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(ResponseEnvelope(func(result interface{}, err *Error) interface{} {
+		return &okEnvelope{OK: err == nil, Data: result, Err: err}
+	})), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for method, ok := range map[string]bool{
+		"Service1.Multiply":      true,
+		"Service1.ResponseError": false,
+	} {
+		buf, _ := EncodeClientRequest(method, &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res struct {
+			OK   bool              `json:"ok"`
+			Data *Service1Response `json:"data"`
+			Err  *Error            `json:"err"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+
+		if res.OK != ok {
+			t.Errorf("%s: expected ok to be %v, but got %v", method, ok, res.OK)
+		}
+
+		if ok && (res.Data == nil || res.Data.Result != 8 || res.Err != nil) {
+			t.Errorf("%s: wrong envelope: %s", method, w.Body)
+		}
+
+		if !ok && (res.Data != nil || res.Err == nil || res.Err.Code != ErrServer) {
+			t.Errorf("%s: wrong envelope: %s", method, w.Body)
+		}
+	}
+}
+
+func TestRegisterDynamic(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+
+	err := s.RegisterDynamic("Proxy", []jsonrpc.DynamicMethod{
+		{
+			Name: "Echo",
+			Handler: func(ctx context.Context, params json.RawMessage) (json.RawMessage, error) {
+				return params, nil
+			},
+		},
+		{
+			Name: "Fail",
+			Handler: func(ctx context.Context, params json.RawMessage) (json.RawMessage, error) {
+				return nil, ErrResponseError
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res Service1Request
+
+	if err := execute(t, s, "Proxy.Echo", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	if res.A != 4 || res.B != 2 {
+		t.Errorf("Wrong response: %+v", res)
+	}
+
+	if err := execute(t, s, "Proxy.Fail", &Service1Request{4, 2}, &res); err == nil || err.Error() != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %v", ErrResponseError, err)
+	}
+
+	if s.HasMethod("Proxy.Missing") {
+		t.Error("Expected Proxy.Missing not to be registered")
+	}
+}
+
+func TestPanicErrorCode(t *testing.T) {
+	for expose, message := range map[bool]string{
+		false: "rpc: internal error",
+		true:  "rpc: panic: boom",
+	} {
+		s := jsonrpc.NewServer(jsonrpc.ServerPanicErrorCode(ErrInternal, expose))
+		s.RegisterCodec(NewCodec(), "application/json")
+		s.RegisterService(new(Service1), "")
+
+		var res Service1Response
+		err := execute(t, s, "Service1.Panic", &Service1Request{4, 2}, &res)
+
+		jsonErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("Expected *Error, but got: %v", err)
+		}
+
+		if jsonErr.Code != ErrInternal || jsonErr.Message != message {
+			t.Errorf("Wrong error: %d %q", jsonErr.Code, jsonErr.Message)
+		}
+	}
+}
+
+func TestServerRecovery(t *testing.T) {
+	var recovered interface{}
+	var stack []byte
+
+	s := jsonrpc.NewServer(jsonrpc.ServerRecovery(func(ctx context.Context, method string, r interface{}, st []byte) error {
+		if method != "Service1.Panic" {
+			t.Errorf("Wrong method: %q", method)
+		}
+		recovered, stack = r, st
+		return nil
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	err := execute(t, s, "Service1.Panic", &Service1Request{4, 2}, &res)
+
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrInternal || jsonErr.Message != "rpc: internal error" {
+		t.Errorf("Expected internal error, but got: %v", err)
+	}
+
+	if recovered != "boom" || !bytes.Contains(stack, []byte("Panic")) {
+		t.Errorf("Wrong recovered value %v or stack:\n%s", recovered, stack)
+	}
+
+	s = jsonrpc.NewServer(jsonrpc.ServerRecovery(func(ctx context.Context, method string, r interface{}, st []byte) error {
+		return &Error{Code: ErrServer, Message: "try again"}
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	err = execute(t, s, "Service1.Panic", &Service1Request{4, 2}, &res)
+
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrServer || jsonErr.Message != "try again" {
+		t.Errorf("Expected the recovery error, but got: %v", err)
+	}
+}
+
+func TestServerTimeout(t *testing.T) {
+	s := jsonrpc.NewServer(jsonrpc.ServerTimeout(50 * time.Millisecond))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+
+	if err := execute(t, s, "Service1.Wait", &Service1Request{1, 0}, &res); err != nil || res.Result != 1 {
+		t.Errorf("Expected result 1, but got %d, %v", res.Result, err)
+	}
+
+	err := execute(t, s, "Service1.Wait", &Service1Request{10000, 0}, &res)
+
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, but got: %v", err)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	mapper := func(code ErrorCode) int {
+		if code == ErrServer {
+			return 503
+		}
+		return 0
+	}
+
+	for _, tc := range []struct {
+		options []jsonrpc.ServerOption
+		method  string
+		status  int
+	}{
+		{nil, "Service1.Unknown", 404},
+		{nil, "Service1.ResponseError", 500},
+		{nil, "Service1.Panic", 500},
+		{nil, "Service1.Register", 400},
+		{[]jsonrpc.ServerOption{jsonrpc.ServerStatusMapper(mapper)}, "Service1.ResponseError", 503},
+		{[]jsonrpc.ServerOption{jsonrpc.ServerStatusMapper(mapper)}, "Service1.Unknown", 404},
+	} {
+		options := append(tc.options, jsonrpc.ServerPanicErrorCode(ErrInternal, false))
+		s := jsonrpc.NewServer(options...)
+		s.RegisterCodec(NewCodec(), "application/json")
+		s.RegisterService(new(Service1), "")
+
+		w := serveBody(s, `{"jsonrpc":"2.0","method":"`+tc.method+`","params":{},"id":1}`)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, but got %d", tc.method, tc.status, w.Code)
+		}
+	}
+}
+
+func TestErrorStatusByCode(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{`{"jsonrpc":"2.0","method":"Service1.Internal","params":{},"id":1}`, 500, ErrInternal},
+		// Plain errors are sent as server errors, but keep a 400 status.
+		{`{"jsonrpc":"2.0","method":"Service1.Fail","params":{},"id":1}`, 400, ErrServer},
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":"x"},"id":1}`, 400, ErrBadParams},
+		{`{"jsonrpc":"1.0","method":"Service1.Multiply","params":{},"id":1}`, 400, ErrInvalidRequest},
+	} {
+		w := serveBody(s, tc.body)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, but got %d", tc.body, tc.status, w.Code)
+		}
+		var res Service1Response
+		err, ok := DecodeClientResponse(w.Body, &res).(*Error)
+		if !ok || err.Code != tc.code {
+			t.Errorf("%s: expected error %d, but got %v", tc.body, tc.code, err)
+		}
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		body    string
+		status  int
+		code    ErrorCode
+		message string
+	}{
+		{`{"jsonrpc":"2.0","method":"Service1.Unknown","id":1}`, 404, ErrMethodNotFound, "rpc: method not found: Service1.Unknown"},
+		{`{"jsonrpc":"2.0","method":"Unknown.Multiply","id":1}`, 404, ErrMethodNotFound, "rpc: method not found: Unknown.Multiply"},
+		{`{"jsonrpc":"2.0","method":"Multiply","id":1}`, 404, ErrMethodNotFound, "rpc: method not found: Multiply"},
+		{`{"jsonrpc":"2.0","method":`, 400, ErrParse, ""},
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2`, 400, ErrParse, ""},
+		{`{"jsonrpc":"2.0","params":{},"id":1}`, 400, ErrInvalidRequest, "method is required"},
+		{`{"jsonrpc":"2.0","params":{}}`, 400, ErrInvalidRequest, "method is required"},
+		{`{"jsonrpc":"2.0","method":null,"id":1}`, 400, ErrInvalidRequest, "method is required"},
+		{`{"jsonrpc":"2.0","method":1,"id":1}`, 400, ErrInvalidRequest, ""},
+		{`"{\"jsonrpc\":\"2.0\",\"method\":\"Service1.Multiply\",\"id\":1}"`, 400, ErrInvalidRequest, ""},
+	} {
+		w := serveBody(s, tc.body)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, but got %d", tc.body, tc.status, w.Code)
+		}
+		var res Service1Response
+		err, ok := DecodeClientResponse(w.Body, &res).(*Error)
+		if !ok || err.Code != tc.code || (tc.message != "" && err.Message != tc.message) {
+			t.Errorf("%s: expected error %d %q, but got %v", tc.body, tc.code, tc.message, err)
+		}
+	}
+}
+
+func TestMethodErrors(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+
+	err := execute(t, s, "Service1.Fail", &Service1EchoRequest{"custom"}, &res)
+
+	jsonErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected *Error, but got: %v", err)
+	}
+	data, _ := json.Marshal(jsonErr.Data)
+	if jsonErr.Code != 42 || jsonErr.Message != "custom" || string(data) != `{"retries":3}` {
+		t.Errorf("Wrong error: %d %q %s", jsonErr.Code, jsonErr.Message, data)
+	}
+
+	err = execute(t, s, "Service1.Fail", &Service1EchoRequest{}, &res)
+
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrServer || jsonErr.Message != "plain failure" {
+		t.Errorf("Expected a server error, but got: %v", err)
+	}
+	if !errors.Is(err, jsonrpc.ErrServer) {
+		t.Errorf("Expected %v to match jsonrpc.ErrServer", err)
+	}
+
+	w := serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Missing","id":1}`)
+	err = DecodeClientResponse(w.Body, &res)
+
+	if !errors.Is(err, jsonrpc.ErrMethodNotFound) {
+		t.Errorf("Expected %v to match jsonrpc.ErrMethodNotFound", err)
+	}
+}
+
+func TestServerMaxConcurrent(t *testing.T) {
+	s := jsonrpc.NewServer(
+		jsonrpc.ServerMaxConcurrent(1),
+		jsonrpc.ServerMaxConcurrentReject(),
+		jsonrpc.ServerPanicErrorCode(ErrInternal, false),
+	)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+
+	// A panicking call frees its slot.
+	execute(t, s, "Service1.Panic", &Service1Request{4, 2}, &res)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var res Service1Response
+		execute(t, s, "Service1.Wait", &Service1Request{200, 0}, &res)
+	}()
+
+	for s.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`)
+	err := DecodeClientResponse(w.Body, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrServer || w.Code != 503 {
+		t.Errorf("Expected ErrServer with status 503, but got %d, %v", w.Code, err)
+	}
+
+	<-done
+
+	if n := s.InFlight(); n != 0 {
+		t.Errorf("Expected no calls in flight, but got %d", n)
+	}
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	// No limit is set by n <= 0.
+	s = jsonrpc.NewServer(jsonrpc.ServerMaxConcurrent(0), jsonrpc.ServerMaxConcurrentReject())
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected no limit, but got:", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var res Service1Response
+		if err := execute(t, s, "Service1.Wait", &Service1Request{100, 0}, &res); err != nil {
+			t.Error("Expected the running call to complete, but got:", err)
+		}
+	}()
+
+	for s.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, but got %v", context.DeadlineExceeded, err)
+	}
+
+	w := serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`)
+	if w.Code != 503 {
+		t.Errorf("Expected status 503, but got %d", w.Code)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	if n := s.InFlight(); n != 0 {
+		t.Errorf("Expected Shutdown to wait for the running call, but %d are in flight", n)
+	}
+
+	<-done
+}
+
+func TestMethodMaxResponseBytes(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetMethodMaxResponseBytes("Service1.Multiply", 100)
+	s.SetMethodMaxResponseBytes("Service1.Echo", 100)
+
+	var res Service1Response
+
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	var echo Service1EchoRequest
+	err := execute(t, s, "Service1.Echo", &Service1EchoRequest{strings.Repeat("x", 100)}, &echo)
+
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrInternal {
+		t.Errorf("Expected ErrInternal, but got: %v", err)
+	}
+}
+
+func TestMarkUncacheable(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for method, cacheControl := range map[string]string{
+		"Service1.Multiply": "",
+		"Service1.Volatile": "no-store",
+	} {
+		buf, _ := EncodeClientRequest(method, &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if got := w.HeaderMap.Get("Cache-Control"); got != cacheControl {
+			t.Errorf("%s: expected Cache-Control %q, but got %q", method, cacheControl, got)
+		}
+	}
+}
+
+func TestParamsPreprocessor(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(ParamsPreprocessor(func(raw json.RawMessage) (json.RawMessage, error) {
+		var unwrapped string
+		if err := json.Unmarshal(raw, &unwrapped); err != nil {
+			return nil, err
+		}
+		return json.RawMessage(unwrapped), nil
+	})), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+
+	if err := execute(t, s, "Service1.Multiply", `{"A":4,"B":2}`, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res)
+
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrParse {
+		t.Errorf("Expected ErrParse, but got: %v", err)
+	}
+}
+
+func TestTimeLayouts(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(TimeLayouts("2006-01-02", "02.01.2006 15:04")), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1PeriodRequest
+
+	err := execute(t, s, "Service1.Period", map[string]string{
+		"From": "2020-01-02",
+		"To":   "03.01.2020 15:04",
+	}, &res)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if from := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC); !res.From.Equal(from) {
+		t.Errorf("Wrong From: got %v, want %v", res.From, from)
+	}
+
+	if to := time.Date(2020, 1, 3, 15, 4, 0, 0, time.UTC); !res.To.Equal(to) {
+		t.Errorf("Wrong To: got %v, want %v", res.To, to)
+	}
+
+	// RFC 3339 keeps working.
+	err = execute(t, s, "Service1.Period", map[string]string{
+		"From": "2020-01-02T10:00:00Z",
+	}, &res)
+
+	if from := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC); err != nil || !res.From.Equal(from) {
+		t.Errorf("Wrong From: got %v, want %v (%v)", res.From, from, err)
+	}
+
+	// Times matching no layout are bad params.
+	err = execute(t, s, "Service1.Period", map[string]string{
+		"From": "yesterday",
+	}, &res)
+
+	jsonErr, ok := err.(*Error)
+	if !ok || jsonErr.Code != ErrBadParams {
+		t.Fatalf("Expected a bad params error, got %v", err)
+	}
+	fields, _ := jsonErr.Data.([]interface{})
+	if len(fields) != 1 || fields[0].(map[string]interface{})["field"] != "From" || fields[0].(map[string]interface{})["code"] != "type" {
+		t.Errorf("Expected a type error for From, got %v", jsonErr.Data)
+	}
+}
+
+func TestRetryableError(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Busy", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != 429 {
+		t.Errorf("Status was %d, should be 429.", w.Code)
+	}
+
+	if retryAfter := w.HeaderMap.Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("Retry-After was %q, should be 2.", retryAfter)
+	}
+
+	var res Service1Response
+	err := DecodeClientResponse(w.Body, &res)
+
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrServer || jsonErr.Message != "busy" {
+		t.Errorf("Expected busy error, but got: %v", err)
+	}
+
+	// Without Err, a default error is sent, and hooks can read it.
+	logger := new(testLogger)
+	s = jsonrpc.NewServer(jsonrpc.ServerLogger(logger))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	w = serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Busy","params":{"A":-1,"B":0},"id":1}`)
+	if w.Code != 429 || w.HeaderMap.Get("Retry-After") != "1" {
+		t.Errorf("Expected a 429 with Retry-After 1, got %d %q", w.Code, w.HeaderMap.Get("Retry-After"))
+	}
+	err = DecodeClientResponse(w.Body, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrServer || jsonErr.Message != "rpc: retry later" {
+		t.Errorf("Expected the default retry error, but got: %v", err)
+	}
+	if len(logger.entries) != 2 || logger.entries[1].level != jsonrpc.LogError {
+		t.Errorf("Unexpected log entries %v", logger.entries)
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, test := range []struct {
+		method string
+		params interface{}
+		field  jsonrpc.FieldError
+	}{
+		{"Service1.Multiply", map[string]string{"A": "x"}, jsonrpc.FieldError{Field: "A", Code: "type"}},
+		{"Service1.Register", map[string]string{}, jsonrpc.FieldError{Field: "S", Code: "required", Message: "must not be empty"}},
+	} {
+		buf, _ := EncodeClientRequest(test.method, test.params)
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res struct {
+			Error struct {
+				Code ErrorCode
+				Data []jsonrpc.FieldError
+			}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Error.Code != ErrBadParams || len(res.Error.Data) != 1 {
+			t.Errorf("%s: wrong error: %s", test.method, w.Body)
+			continue
+		}
+
+		field := res.Error.Data[0]
+		if field.Field != test.field.Field || field.Code != test.field.Code || field.Message == "" ||
+			(test.field.Message != "" && field.Message != test.field.Message) {
+			t.Errorf("%s: wrong field error: %+v", test.method, field)
+		}
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	// decodeFirst ignores whatever follows the first value, as decoders
+	// reading a stream do.
+	decodeFirst := func(data []byte, v interface{}) error {
+		return json.NewDecoder(bytes.NewReader(data)).Decode(v)
+	}
+
+	for name, codec := range map[string]*Codec{
+		"encoding/json": NewCodec(),
+		"WithJSON":      NewCodec(WithJSON(json.Marshal, decodeFirst)),
+	} {
+		s := jsonrpc.NewServer()
+		s.RegisterCodec(codec, "application/json")
+		s.RegisterService(new(Service1), "")
+
+		body := `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1} junk`
+
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res Service1Response
+		err := DecodeClientResponse(w.Body, &res)
+
+		jsonErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("%s: expected *Error, but got: %v", name, err)
+		}
+
+		if jsonErr.Code != ErrParse {
+			t.Errorf("%s: expected code %d, but got %d", name, ErrParse, jsonErr.Code)
+		}
+	}
+}
+
+func serveBody(s *jsonrpc.Server, body string) *ResponseRecorder {
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestBatch(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serveBody(s, `[
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1},
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":3,"B":3}},
+		{"jsonrpc":"2.0","method":"Service1.Unknown","id":"2"},
+		1
+	]`)
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, but got %d", w.Code)
+	}
+
+	responses, err := DecodeClientBatchResponse(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("Expected 3 responses, but got %d", len(responses))
+	}
+
+	var res Service1Response
+	if !IDEqual(responses[0].ID(), json.RawMessage(`1`)) {
+		t.Errorf("Expected id 1, but got %s", responses[0].ID())
+	} else if err := responses[0].Decode(&res); err != nil || res.Result != 8 {
+		t.Errorf("Wrong response: %v, %v", res.Result, err)
+	}
+
+	if err, ok := responses[1].Decode(&res).(*Error); !ok || err.Code != ErrMethodNotFound {
+		t.Errorf("Expected method not found, but got %v", err)
+	}
+	if !IDEqual(responses[1].ID(), json.RawMessage(`"2"`)) {
+		t.Errorf("Expected id \"2\", but got %s", responses[1].ID())
+	}
+
+	if err, ok := responses[2].Decode(&res).(*Error); !ok || err.Code != ErrInvalidRequest {
+		t.Errorf("Expected invalid request, but got %v", err)
+	}
+	if !IDEqual(responses[2].ID(), json.RawMessage(`null`)) {
+		t.Errorf("Expected null id, but got %s", responses[2].ID())
+	}
+}
+
+func TestBatchEmpty(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serveBody(s, `[]`)
+
+	var res Service1Response
+	err := DecodeClientResponse(w.Body, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrInvalidRequest {
+		t.Errorf("Expected invalid request, but got %v", err)
+	}
+}
+
+func TestBatchNotifications(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := serveBody(s, `[
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2}},
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":3,"B":3}}
+	]`)
+	if w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected an empty 204 response, but got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestNotification(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+
+	called := 0
+	err := s.RegisterDynamic("Proxy", []jsonrpc.DynamicMethod{
+		{
+			Name: "Fail",
+			Handler: func(ctx context.Context, params json.RawMessage) (json.RawMessage, error) {
+				called++
+				return nil, ErrResponseError
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"Proxy.Fail"}`,
+		`{"jsonrpc":"2.0","method":"Proxy.Unknown"}`,
+		`{"jsonrpc":"2.0","method":"Proxy"}`,
+	} {
+		w := serveBody(s, body)
+		if w.Code != 204 || w.Body.Len() != 0 {
+			t.Errorf("Expected an empty 204 response to %s, but got %d %q", body, w.Code, w.Body.String())
+		}
+	}
+	if called != 1 {
+		t.Errorf("Expected the handler to be called once, but got %d", called)
+	}
+
+	w := serveBody(s, `{"jsonrpc":"2.0","method":"Proxy.Fail","id":null}`)
+
+	var res clientResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Error == nil || string(res.ID) != "null" {
+		t.Errorf("Expected an error response with a null id, but got %+v", res)
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := NewClient(ts.URL, HTTPClient(ts.Client()))
+
+	var res Service1Response
+	if err := c.Call(context.Background(), "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected result 8, but got %d, %v", res.Result, err)
+	}
+
+	err := c.Call(context.Background(), "Service1.ResponseError", &Service1Request{4, 2}, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrServer {
+		t.Errorf("Expected a server error, but got: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = c.Call(ctx, "Service1.Wait", &Service1Request{1000, 0}, &res)
+	if err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected the call to be aborted, but got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestClientCallBatch(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := NewClient(ts.URL, HTTPClient(ts.Client()))
+
+	var first, second Service1Response
+	errs := make([]error, 4)
+	batch := []BatchElem{
+		{Method: "Service1.Multiply", Params: &Service1Request{4, 2}, Result: &first, Error: &errs[0]},
+		{Method: "Service1.ResponseError", Params: &Service1Request{4, 2}, Result: &second, Error: &errs[1]},
+		{Method: "Service1.Multiply", Params: &Service1Request{3, 3}, Error: &errs[2]},
+		{Method: "Service1.Unknown", Error: &errs[3]},
+		// Errors of calls without Error are dropped.
+		{Method: "Service1.Unknown"},
+	}
+	if err := c.CallBatch(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if errs[0] != nil || first.Result != 8 {
+		t.Errorf("Expected result 8, but got %d, %v", first.Result, errs[0])
+	}
+	if jsonErr, ok := errs[1].(*Error); !ok || jsonErr.Code != ErrServer {
+		t.Errorf("Expected a server error, but got: %v", errs[1])
+	}
+	if errs[2] != nil {
+		t.Errorf("Expected no error, but got: %v", errs[2])
+	}
+	if jsonErr, ok := errs[3].(*Error); !ok || jsonErr.Code != ErrMethodNotFound {
+		t.Errorf("Expected method not found, but got: %v", errs[3])
+	}
+
+	single := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"no batches"}}`))
+	}))
+	defer single.Close()
+
+	err := NewClient(single.URL).CallBatch(context.Background(), batch)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrInvalidRequest {
+		t.Errorf("Expected invalid request, but got: %v", err)
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, id := range []string{`"abc"`, `null`, `12345678901234567890`, `1.5`, `"1"`} {
+		w := serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":`+id+`}`)
+
+		var res clientResponse
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if string(res.ID) != id {
+			t.Errorf("Expected id %s, but got %s", id, res.ID)
+		}
+	}
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	ts := httptest.NewServer(jsonrpc.WebSocketHandler(s))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, message := range []string{
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2}}`,
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`,
+		`[{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":3,"B":3},"id":2}]`,
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var responses []BatchResponse
+		if message[0] == '[' {
+			responses, err = DecodeClientBatchResponse(bytes.NewReader(message))
+		} else {
+			responses, err = DecodeClientBatchResponse(bytes.NewReader(append(append([]byte("["), message...), ']')))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, response := range responses {
+			var res Service1Response
+			if err := response.Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			results[string(response.ID())] = res.Result
+		}
+	}
+
+	if len(results) != 2 || results["1"] != 8 || results["2"] != 9 {
+		t.Errorf("Wrong results: %v", results)
+	}
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	release := make(chan struct{})
+	var started int32
+	s := jsonrpc.NewServer(
+		jsonrpc.ServerMaxBodyBytes(128),
+		jsonrpc.ServerMaxConcurrent(2),
+		jsonrpc.ServerMaxConcurrentReject(),
+	)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterFunc("Gate.Wait", func() (bool, error) {
+		atomic.AddInt32(&started, 1)
+		<-release
+		return true, nil
+	})
+
+	ts := httptest.NewServer(jsonrpc.WebSocketHandler(s))
+	defer ts.Close()
+	addr := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	// Messages over the limit of the connection wait for a free slot
+	// rather than being rejected by the server limit.
+	conn, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for id := 1; id <= 3; id++ {
+		message := fmt.Sprintf(`{"jsonrpc":"2.0","method":"Gate.Wait","id":%d}`, id)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for atomic.LoadInt32(&started) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Errorf("Expected 2 calls running, got %d", n)
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ok bool
+		if err := DecodeClientResponse(bytes.NewReader(message), &ok); err != nil || !ok {
+			t.Errorf("Expected a successful call, got %v, %s", err, message)
+		}
+	}
+
+	// Messages over ServerMaxBodyBytes close the connection.
+	big, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer big.Close()
+	message := `{"jsonrpc":"2.0","method":"Gate.Wait","id":1,"pad":"` + strings.Repeat("x", 256) + `"}`
+	if err := big.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := big.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("Expected the connection to be closed for a too big message, got %v", err)
+	}
+}
+
+func TestDecodeClientBatchResponse(t *testing.T) {
+	data := `[
+		{"jsonrpc": "2.0", "id": 1, "result": 2},
+		{"jsonrpc": "2.0", "id": "1", "result": 1},
+		{"jsonrpc": "2.0", "id": 18446744073709551615, "error": {"code": -32000, "message": "response error"}}
+	]`
+
+	responses, err := DecodeClientBatchResponse(bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(id string) *BatchResponse {
+		for i := range responses {
+			if IDEqual(responses[i].ID(), json.RawMessage(id)) {
+				return &responses[i]
+			}
+		}
+		return nil
+	}
+
+	for id, expected := range map[string]int{`"1"`: 1, `1`: 2, `1.0`: 2} {
+		var result int
+		res := find(id)
+		if res == nil {
+			t.Errorf("No response for id %s", id)
+			continue
+		}
+		if err := res.Decode(&result); err != nil || result != expected {
+			t.Errorf("Wrong response for id %s: %v, %v", id, result, err)
+		}
+	}
+
+	if res := find(`18446744073709551614`); res != nil {
+		t.Errorf("Expected no response, but got id %s", res.ID())
+	}
+
+	var result int
+	if err := find(`18446744073709551615`).Decode(&result); err == nil || err.Error() != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %v", ErrResponseError, err)
+	}
+}
+
+func TestDecodeNullResult(t *testing.T) {
+	data := `{"jsonrpc": "2.0", "id": 12345, "result": null}`
+	reader := bytes.NewReader([]byte(data))
+
+	var result interface{}
+
+	err := DecodeClientResponse(reader, &result)
+
+	if err != ErrNullResult {
+		t.Error("Expected err no be ErrNullResult, but got:", err)
+	}
+
+	if result != nil {
+		t.Error("Expected result to be nil, but got:", result)
+	}
+}
+
+func TestDecodeNullResultAllowNull(t *testing.T) {
+	data := `{"jsonrpc": "2.0", "id": 12345, "result": null}`
+	reader := bytes.NewReader([]byte(data))
+
+	var result interface{}
+
+	if err := DecodeClientResponseAllowNull(reader, &result); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	if result != nil {
+		t.Error("Expected result to be nil, but got:", result)
+	}
+
+	data = `{"jsonrpc": "2.0", "id": 12345, "error": {"code": -32000, "message": "response error"}}`
+	reader = bytes.NewReader([]byte(data))
+
+	if err := DecodeClientResponseAllowNull(reader, &result); err == nil || err.Error() != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %v", ErrResponseError, err)
+	}
+}
+
+func TestServerCompression(t *testing.T) {
+	s := jsonrpc.NewServer(jsonrpc.ServerCompression())
+	s.RegisterCodec(NewCustomCodec(&jsonrpc.CompressionSelector{}), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write([]byte(`[
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1},
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":3,"B":3},"id":2}
+	]`))
+	zw.Close()
+
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", &body)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if enc := w.HeaderMap.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Expected a gzipped response, got Content-Encoding %q", enc)
+	}
+	if v := w.HeaderMap.Get("X-Content-Type-Options"); v != "nosniff" {
+		t.Errorf("Expected X-Content-Type-Options nosniff, got %q", v)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses, err := DecodeClientBatchResponse(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(responses))
+	}
+	for i, want := range []int{8, 9} {
+		var res Service1Response
+		if err := responses[i].Decode(&res); err != nil || res.Result != want {
+			t.Errorf("Response %d: expected %d, got %d, %v", i, want, res.Result, err)
+		}
+	}
+
+	// Clients not accepting gzip get a plain response.
+	w = serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`)
+	if enc := w.HeaderMap.Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected a plain response, got Content-Encoding %q", enc)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "br")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 415 {
+		t.Errorf("Expected status 415 for an unsupported encoding, got %d", w.Code)
+	}
+
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 400 {
+		t.Errorf("Expected status 400 for an invalid gzip body, got %d", w.Code)
+	}
+}
+
+func TestRequestIDContext(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	var notified []bool
+	err := s.RegisterFunc("Ids.Get", func(ctx context.Context) (string, error) {
+		id, ok := jsonrpc.RequestID(ctx)
+		if !ok {
+			notified = append(notified, true)
+		}
+		return id, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveBody(s, `[
+		{"jsonrpc":"2.0","method":"Ids.Get","id":1},
+		{"jsonrpc":"2.0","method":"Ids.Get","id":"a"},
+		{"jsonrpc":"2.0","method":"Ids.Get"}
+	]`)
+	responses, err := DecodeClientBatchResponse(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(responses))
+	}
+	for i, want := range []string{"1", "a"} {
+		var id string
+		if err := responses[i].Decode(&id); err != nil || id != want {
+			t.Errorf("Response %d: expected id %q, got %q, %v", i, want, id, err)
+		}
+	}
+	if len(notified) != 1 {
+		t.Errorf("Expected no id for the notification only, got %d calls without id", len(notified))
+	}
+
+	if _, ok := jsonrpc.RequestID(context.Background()); ok {
+		t.Error("Expected no id outside of a request")
+	}
+}
+
+type validationError struct {
+	field string
+}
+
+func (e *validationError) Error() string {
+	return e.field + " is invalid"
+}
+
+var errNotFound = errors.New("not found")
+
+func TestMapError(t *testing.T) {
+	var afterErr error
+	s := jsonrpc.NewServer(jsonrpc.ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+		afterErr = err
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.MapError(func(err error) (*Error, bool) {
+		var validation *validationError
+		if errors.As(err, &validation) {
+			return jsonrpc.NewInvalidParamsError(err).WithData(validation.field), true
+		}
+		return nil, false
+	})
+	s.MapError(func(err error) (*Error, bool) {
+		if errors.Is(err, errNotFound) {
+			return NewError(-32004, "no such thing"), true
+		}
+		return nil, false
+	})
+	s.MapError(func(err error) (*Error, bool) {
+		return NewError(-32099, "unreachable"), errors.Is(err, errNotFound)
+	})
+
+	fail := map[string]error{
+		"Errors.Validation": fmt.Errorf("page: %w", &validationError{"limit"}),
+		"Errors.NotFound":   errNotFound,
+		"Errors.Other":      errors.New("other"),
+		"Errors.JSON":       NewError(-32042, "as is"),
+	}
+	for name, err := range fail {
+		err := err
+		s.RegisterFunc(name, func() (int, error) { return 0, err })
+	}
+
+	for _, tc := range []struct {
+		method  string
+		code    ErrorCode
+		message string
+	}{
+		{"Errors.Validation", ErrBadParams, "page: limit is invalid"},
+		{"Errors.NotFound", -32004, "no such thing"},
+		{"Errors.Other", ErrServer, "other"},
+		{"Errors.JSON", -32042, "as is"},
+	} {
+		w := serveBody(s, `{"jsonrpc":"2.0","method":"`+tc.method+`","id":1}`)
+		var res int
+		err, ok := DecodeClientResponse(w.Body, &res).(*Error)
+		if !ok || err.Code != tc.code || err.Message != tc.message {
+			t.Errorf("%s: expected error %d %q, got %v", tc.method, tc.code, tc.message, err)
+		}
+		if tc.code != ErrServer && jsonrpc.ErrorCodeOf(afterErr) != tc.code {
+			t.Errorf("%s: expected the after hooks to see code %d, got %v", tc.method, tc.code, afterErr)
+		}
+	}
+}
+
+func TestServerDebug(t *testing.T) {
+	for _, debug := range []bool{true, false} {
+		s := jsonrpc.NewServer(jsonrpc.ServerDebug(debug), jsonrpc.ServerPanicErrorCode(ErrInternal, false))
+		s.RegisterCodec(NewCodec(), "application/json")
+		s.RegisterService(new(Service1), "")
+		s.RegisterFunc("Debug.Plain", func() (int, error) { return 0, pkgerrors.New("plain failure") })
+		s.RegisterFunc("Debug.JSON", func() (int, error) { return 0, NewError(-32042, "as is") })
+
+		for _, tc := range []struct {
+			method string
+			error  string
+			stack  string
+		}{
+			{"Debug.Plain", "plain failure", "TestServerDebug"},
+			{"Debug.JSON", "", ""},
+			{"Service1.Panic", "panic: boom", "(*Service1).Panic"},
+		} {
+			w := serveBody(s, `{"jsonrpc":"2.0","method":"`+tc.method+`","params":{},"id":1}`)
+			var res int
+			err, ok := DecodeClientResponse(w.Body, &res).(*Error)
+			if !ok {
+				t.Fatalf("%s: expected an *Error, got %v", tc.method, err)
+			}
+			if !debug || tc.error == "" {
+				if err.Data != nil {
+					t.Errorf("%s, debug %v: expected no data, got %v", tc.method, debug, err.Data)
+				}
+				continue
+			}
+			data, _ := err.Data.(map[string]interface{})
+			if data["error"] != tc.error {
+				t.Errorf("%s: expected error %q, got %v", tc.method, tc.error, data["error"])
+			}
+			if stack, _ := data["stack"].(string); !strings.Contains(stack, tc.stack) {
+				t.Errorf("%s: expected a stack with %s, got %q", tc.method, tc.stack, stack)
+			}
+		}
+	}
+}
+
+func TestDecodeClientResponseError(t *testing.T) {
+	body := `{"jsonrpc":"2.0","error":{"code":-32602,"message":"invalid params","data":{"fields":[{"field":"A","code":"range"}],"retry":false}},"id":1}`
+
+	var res Service1Response
+	err := DecodeClientResponse(strings.NewReader(body), &res)
+
+	jsonErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected *Error, got %#v", err)
+	}
+	if jsonErr.Code != ErrBadParams || jsonErr.Message != "invalid params" {
+		t.Errorf("Wrong error: %d %q", jsonErr.Code, jsonErr.Message)
+	}
+	data, _ := json.Marshal(jsonErr.Data)
+	if string(data) != `{"fields":[{"code":"range","field":"A"}],"retry":false}` {
+		t.Errorf("Wrong data: %s", data)
+	}
+
+	err = DecodeClientResponse(strings.NewReader(`{"jsonrpc":"2.0","result":null,"id":1}`), &res)
+	if err != ErrNullResult {
+		t.Errorf("Expected ErrNullResult, got %v", err)
+	}
+}
+
+func TestEncodeClientRequestIDs(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		id   interface{}
+		want string
+	}{
+		{"abc", `"abc"`},
+		{42, `42`},
+		{nil, `null`},
+	} {
+		body, err := EncodeClientRequestWithID("Service1.Multiply", &Service1Request{4, 2}, tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses, err := DecodeClientBatchResponse(strings.NewReader("[" + serveBody(s, string(body)).Body.String() + "]"))
+		if err != nil || len(responses) != 1 {
+			t.Fatalf("%v: unexpected response: %v", tc.id, err)
+		}
+		if id := string(responses[0].ID()); id != tc.want {
+			t.Errorf("Expected id %s, got %s", tc.want, id)
+		}
+		var res Service1Response
+		if err := responses[0].Decode(&res); err != nil || res.Result != 8 {
+			t.Errorf("%v: expected 8, got %d, %v", tc.id, res.Result, err)
+		}
+	}
+
+	body, err := EncodeClientNotification("Service1.Multiply", &Service1Request{4, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), `"id"`) {
+		t.Errorf("Expected no id in %s", body)
+	}
+	if w := serveBody(s, string(body)); w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected an empty 204 response, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+type Service2Address struct {
+	City string `json:"city"`
+	Zip  string `json:"zip_code"`
+}
+
+type Service2Request struct {
+	UserName  string            `json:"user_name"`
+	Address   Service2Address   `json:"address"`
+	Previous  []Service2Address `json:"previous,omitempty"`
+	Untouched int
+}
+
+type Service2 struct {
+}
+
+func (t *Service2) Echo(req *Service2Request) (*Service2Request, error) {
+	return req, nil
+}
+
+type Service2Base struct {
+	X    int    `json:"x"`
+	Name string `json:"name"`
+	Tag  string
+}
+
+type Service2Embedded struct {
+	Service2Base
+	*Service2Address
+	Y    int    `json:"y"`
+	Name string `json:"name"`
+}
+
+func TestEmbeddedParams(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		var options []jsonrpc.ServerOption
+		if strict {
+			options = append(options, jsonrpc.ServerDisallowUnknownFields())
+		}
+		s := jsonrpc.NewServer(options...)
+		s.RegisterCodec(NewCodec(), "application/json")
+		s.RegisterFunc("Embedded.Echo", func(req *Service2Embedded) (*Service2Embedded, error) {
+			return req, nil
+		})
+
+		for _, params := range []string{
+			`{"x":3,"name":"ann","tag":"t","city":"Oslo","zip_code":"0150","y":4}`,
+			`[3,"t","Oslo","0150",4,"ann"]`,
+		} {
+			var res Service2Embedded
+			err := DecodeClientResponse(serveBody(s, `{"jsonrpc":"2.0","method":"Embedded.Echo","params":`+params+`,"id":1}`).Body, &res)
+			want := Service2Embedded{Service2Base{X: 3, Tag: "t"}, &Service2Address{"Oslo", "0150"}, 4, "ann"}
+			if err != nil || !reflect.DeepEqual(res, want) {
+				t.Errorf("strict %v, %s: expected %+v, got %+v, %v", strict, params, want, res, err)
+			}
+		}
+
+		err := DecodeClientResponse(serveBody(s, `{"jsonrpc":"2.0","method":"Embedded.Echo","params":{"x":3,"z":1},"id":1}`).Body, new(Service2Embedded))
+		if jsonErr, ok := err.(*Error); strict != (ok && jsonErr.Code == ErrBadParams) {
+			t.Errorf("strict %v: unexpected error for an unknown field: %v", strict, err)
+		}
+	}
+}
+
+func TestJSONTagParams(t *testing.T) {
+	const body = `{"jsonrpc":"2.0","method":"Service2.Echo","params":{
+		"user_name":"ann",
+		"address":{"city":"Oslo","zip_code":"0150"},
+		"previous":[{"city":"Bergen","zip_code":"5003"}],
+		"Untouched":7%s
+	},"id":1}`
+
+	for _, strict := range []bool{false, true} {
+		var options []jsonrpc.ServerOption
+		if strict {
+			options = append(options, jsonrpc.ServerDisallowUnknownFields())
+		}
+		s := jsonrpc.NewServer(options...)
+		s.RegisterCodec(NewCodec(), "application/json")
+		s.RegisterService(new(Service2), "")
+
+		var res Service2Request
+		if err := DecodeClientResponse(serveBody(s, fmt.Sprintf(body, "")).Body, &res); err != nil {
+			t.Fatalf("strict %v: %v", strict, err)
+		}
+		want := Service2Request{"ann", Service2Address{"Oslo", "0150"}, []Service2Address{{"Bergen", "5003"}}, 7}
+		if !reflect.DeepEqual(res, want) {
+			t.Errorf("strict %v: expected %+v, got %+v", strict, want, res)
+		}
+
+		var positional Service2Request
+		if err := DecodeClientResponse(serveBody(s, `{"jsonrpc":"2.0","method":"Service2.Echo","params":["ann",{"city":"Oslo"},[],7],"id":1}`).Body, &positional); err != nil || positional.UserName != "ann" || positional.Untouched != 7 {
+			t.Errorf("strict %v: wrong positional params %+v, %v", strict, positional, err)
+		}
+
+		// Go names of fields with a json tag are not wire names.
+		var shadowed Service2Request
+		if err := DecodeClientResponse(serveBody(s, fmt.Sprintf(body, `,"UserName":"bob"`)).Body, &shadowed); err != nil || shadowed.UserName != "ann" {
+			t.Errorf("strict %v: expected UserName to be ignored, got %q, %v", strict, shadowed.UserName, err)
+		}
+
+		for _, extra := range []string{`,"usr_name":"bob"`, `,"address":{"city":"Oslo","zip":"0150"}`} {
+			err := DecodeClientResponse(serveBody(s, fmt.Sprintf(body, extra)).Body, &res)
+			if !strict {
+				if err != nil {
+					t.Errorf("lenient: expected unknown fields %s to be ignored, got %v", extra, err)
+				}
+				continue
+			}
+			jsonErr, ok := err.(*Error)
+			if !ok || jsonErr.Code != ErrBadParams || !strings.Contains(jsonErr.Message, "unknown fields") {
+				t.Errorf("strict: expected an unknown fields error for %s, got %v", extra, err)
+			}
+		}
+	}
+}
+
+func TestServerAllowGET(t *testing.T) {
+	s := jsonrpc.NewServer(jsonrpc.ServerAllowGET("Service1.Multiply"))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	get := func(query url.Values) *ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://localhost:8080/?"+query.Encode(), nil)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get(url.Values{"method": {"Service1.Multiply"}, "params": {`{"A":4,"B":2}`}, "id": {`"a"`}})
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	responses, err := DecodeClientBatchResponse(strings.NewReader("[" + w.Body.String() + "]"))
+	if err != nil || len(responses) != 1 || string(responses[0].ID()) != `"a"` {
+		t.Fatalf("Unexpected response %s: %v", w.Body.String(), err)
+	}
+	var res Service1Response
+	if err := responses[0].Decode(&res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+
+	for _, tc := range []struct {
+		query  url.Values
+		status int
+	}{
+		{url.Values{"method": {"Service1.Multiply"}}, 200},
+		{url.Values{"method": {"Service1.Panic"}}, 405},
+		{url.Values{}, 405},
+		{url.Values{"method": {"Service1.Multiply"}, "params": {`{},"method":"Service1.Panic"`}}, 400},
+		{url.Values{"method": {"Service1.Multiply"}, "id": {`1,"method":"Service1.Panic"`}}, 400},
+	} {
+		if w := get(tc.query); w.Code != tc.status {
+			t.Errorf("%v: expected status %d, got %d: %s", tc.query, tc.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestServerMaxBodyBytes(t *testing.T) {
+	s := jsonrpc.NewServer(jsonrpc.ServerMaxBodyBytes(200), jsonrpc.ServerCompression())
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	const call = `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`
+	var res Service1Response
+	if err := DecodeClientResponse(serveBody(s, call).Body, &res); err != nil || res.Result != 8 {
+		t.Fatalf("Expected 8, got %d, %v", res.Result, err)
+	}
+
+	large := `{"jsonrpc":"2.0","method":"Service1.Echo","params":{"S":"` + strings.Repeat("x", 200) + `"},"id":1}`
+	batch := "[" + strings.Repeat(call+",", 3) + call + "]"
+
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write([]byte(large))
+	zw.Close()
+
+	for name, body := range map[string]string{"single": large, "batch": batch, "gzip": zipped.String()} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if name == "gzip" {
+			if zipped.Len() > 200 {
+				t.Fatalf("Compressed body too large for the test: %d", zipped.Len())
+			}
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != 413 {
+			t.Errorf("%s: expected status 413, got %d", name, w.Code)
+		}
+		if err, ok := DecodeClientResponse(w.Body, &res).(*Error); !ok || err.Code != ErrInvalidRequest {
+			t.Errorf("%s: expected an invalid request error, got %v", name, err)
+		}
+	}
+}
+
+// legacyCodec reads requests like Codec and writes bare results as text.
+type legacyCodec struct {
+}
+
+func (c legacyCodec) NewRequest(r *http.Request) jsonrpc.CodecRequest {
+	return legacyRequest{NewCodec().NewRequest(r)}
+}
+
+type legacyRequest struct {
+	jsonrpc.CodecRequest
+}
+
+func (r legacyRequest) WriteResponse(w http.ResponseWriter, reply interface{}) error {
+	_, err := fmt.Fprintf(w, "legacy %d", reply.(*Service1Response).Result)
+	return err
+}
+
+func TestRegisterServiceCodec(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(Service1), "Legacy")
+	s.RegisterServiceCodec("Legacy", legacyCodec{})
+
+	w := serveBody(s, `{"jsonrpc":"2.0","method":"Legacy.Multiply","params":{"A":4,"B":2},"id":1}`)
+	if body := w.Body.String(); body != "legacy 8" {
+		t.Errorf("Expected the legacy codec response, got %q", body)
+	}
+
+	w = serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`)
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 from the default codec, got %d, %v", res.Result, err)
+	}
+}
+
+func TestServerSlowLog(t *testing.T) {
+	var slow []string
+	s := jsonrpc.NewServer(jsonrpc.ServerSlowLog(20*time.Millisecond, func(method string, d time.Duration) {
+		if d < 20*time.Millisecond {
+			t.Errorf("%s logged after %s only", method, d)
+		}
+		slow = append(slow, method)
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterFunc("Sleep.NoContext", func(req *Service1Request) (int, error) {
+		time.Sleep(time.Duration(req.A) * time.Millisecond)
+		return req.A, nil
+	})
+
+	serveBody(s, `[
+		{"jsonrpc":"2.0","method":"Service1.Wait","params":{"A":40},"id":1},
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":2},
+		{"jsonrpc":"2.0","method":"Sleep.NoContext","params":{"A":40},"id":3},
+		{"jsonrpc":"2.0","method":"Sleep.NoContext","params":{"A":0},"id":4}
+	]`)
+
+	if !reflect.DeepEqual(slow, []string{"Service1.Wait", "Sleep.NoContext"}) {
+		t.Errorf("Expected the slow calls to be logged, got %v", slow)
+	}
+}
+
+func TestCodecRequestID(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		want interface{}
+	}{
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply","id":"abc"}`, "abc"},
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply","id":12345678901234567890}`, json.Number("12345678901234567890")},
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply","id":null}`, nil},
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply"}`, nil},
+		{`[{"jsonrpc":"2.0","method":"Service1.Multiply","id":1}]`, nil},
+	} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(tc.body))
+		req := NewCodec().NewRequest(r)
+		if id := req.ID(); id != tc.want {
+			t.Errorf("%s: expected id %#v, got %#v", tc.body, tc.want, id)
+		}
+		if id := req.(jsonrpc.IDCodecRequest).RequestID(); id != jsonrpc.FormatID(tc.want) {
+			t.Errorf("%s: expected request id %q, got %q", tc.body, jsonrpc.FormatID(tc.want), id)
+		}
+	}
+}
+
+func TestServerResponseError(t *testing.T) {
+	var failed []string
+	s := jsonrpc.NewServer(jsonrpc.ServerResponseError(func(ctx context.Context, method string, err error) {
+		failed = append(failed, method)
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterFunc("Float.Inf", func() (float64, error) {
+		return math.Inf(1), nil
+	})
+
+	w := serveBody(s, `{"jsonrpc":"2.0","method":"Float.Inf","id":1}`)
+	if w.Code != 500 {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+	var res Service1Response
+	err := DecodeClientResponse(w.Body, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrInternal {
+		t.Errorf("Expected an internal error, got %v", err)
+	}
+
+	serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":2}`)
+	if !reflect.DeepEqual(failed, []string{"Float.Inf"}) {
+		t.Errorf("Expected the unencodable reply to be reported, got %v", failed)
+	}
+}
+
+// countReply streams the numbers from 1 to its value.
+type countReply int
+
+func (r countReply) WriteResult(w io.Writer) error {
+	if int(r) < 0 {
+		return errors.New("negative count")
+	}
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for i := 1; i <= int(r); i++ {
+		if i > 1 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(i); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+func TestStreamCodec(t *testing.T) {
+	var failed []string
+	s := jsonrpc.NewServer(jsonrpc.ServerResponseError(func(ctx context.Context, method string, err error) {
+		failed = append(failed, err.Error())
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterFunc("Count.To", func(req *Service1Request) (countReply, error) {
+		return countReply(req.A), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveBody(s, `{"jsonrpc":"2.0","method":"Count.To","params":{"A":3},"id":"a"}`)
+	if want := "{\"jsonrpc\":\"2.0\",\"result\":[1\n,2\n,3\n],\"id\":\"a\"}\n"; w.Body.String() != want {
+		t.Errorf("Expected %q, got %q", want, w.Body.String())
+	}
+	var res []int
+	if err := DecodeClientResponse(w.Body, &res); err != nil || !reflect.DeepEqual(res, []int{1, 2, 3}) {
+		t.Errorf("Expected [1 2 3], got %v, %v", res, err)
+	}
+
+	if w := serveBody(s, `{"jsonrpc":"2.0","method":"Count.To","params":{"A":3}}`); w.Body.Len() != 0 {
+		t.Errorf("Expected no response to a notification, got %q", w.Body.String())
+	}
+
+	serveBody(s, `{"jsonrpc":"2.0","method":"Count.To","params":{"A":-1},"id":1}`)
+	if !reflect.DeepEqual(failed, []string{"negative count"}) {
+		t.Errorf("Expected the stream error to be reported, got %v", failed)
+	}
+}
+
+// tickReply streams the numbers from 1 to its value.
+type tickReply int
+
+func (r tickReply) Stream(ctx context.Context) <-chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		defer close(ch)
+		for i := 1; i <= int(r); i++ {
+			select {
+			case ch <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func TestSSEHandler(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	if err := s.RegisterFunc("Tick.Count", func(req *Service1Request) (tickReply, error) {
+		return tickReply(req.A), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	h := jsonrpc.SSEHandler(s)
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(`{"jsonrpc":"2.0","method":"Tick.Count","params":{"A":2},"id":7}`)
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %q", ct)
+	}
+	want := "data: {\"jsonrpc\":\"2.0\",\"result\":1,\"id\":7}\n\n" +
+		"data: {\"jsonrpc\":\"2.0\",\"result\":2,\"id\":7}\n\n"
+	if w.Body.String() != want {
+		t.Errorf("Expected %q, got %q", want, w.Body.String())
+	}
+
+	w = serve(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`)
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected a plain response of 8, got %d, %v", res.Result, err)
+	}
+
+	w = serve(`{"jsonrpc":"2.0","method":"Tick.Missing","id":1}`)
+	if err := DecodeClientResponse(w.Body, &res); err == nil || err.(*Error).Code != ErrMethodNotFound {
+		t.Errorf("Expected a method not found error, got %v", err)
+	}
+
+	if w := serve(`[{"jsonrpc":"2.0","method":"Tick.Count","params":{"A":2},"id":1}]`); w.Code != 400 {
+		t.Errorf("Expected batches to be refused, got %d", w.Code)
+	}
+
+	// The response limit applies to each event: the first nine responses
+	// are 36 bytes long, newline included, the tenth is over the limit.
+	s.SetMethodMaxResponseBytes("Tick.Count", 36)
+	w = serve(`{"jsonrpc":"2.0","method":"Tick.Count","params":{"A":12},"id":7}`)
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	if len(events) != 10 {
+		t.Fatalf("Expected 9 events and an error, got %q", w.Body.String())
+	}
+	if err := DecodeClientResponse(strings.NewReader(strings.TrimPrefix(events[9], "data: ")), &res); err == nil || err.(*Error).Code != ErrInternal {
+		t.Errorf("Expected the stream to end with an internal error, got %v", err)
+	}
+
+	// The body limits of ServeHTTP apply.
+	s = jsonrpc.NewServer(jsonrpc.ServerMaxBodyBytes(32))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	h = jsonrpc.SSEHandler(s)
+	if w := serve(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`); w.Code != 413 {
+		t.Errorf("Expected a body over the limit to be refused, got %d", w.Code)
+	}
+}
+
+// gateReply streams a single value once released.
+type gateReply chan struct{}
+
+func (r gateReply) Stream(ctx context.Context) <-chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		defer close(ch)
+		select {
+		case <-r:
+			ch <- true
+		case <-ctx.Done():
+		}
+	}()
+	return ch
+}
+
+func TestSSEStreamLifetime(t *testing.T) {
+	var ended int32
+	s := jsonrpc.NewServer(jsonrpc.ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+		atomic.AddInt32(&ended, 1)
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	release := make(gateReply)
+	if err := s.RegisterFunc("Gate.Stream", func() (gateReply, error) {
+		return release, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"jsonrpc":"2.0","method":"Gate.Stream","id":1}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		jsonrpc.SSEHandler(s).ServeHTTP(w, r)
+	}()
+	for s.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The open stream counts as a running call.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to wait for the stream, got %v", err)
+	}
+	if n := atomic.LoadInt32(&ended); n != 0 {
+		t.Errorf("Expected no after hook while streaming, got %d", n)
+	}
+
+	close(release)
+	<-done
+	if n := atomic.LoadInt32(&ended); n != 1 {
+		t.Errorf("Expected the after hook once the stream ended, got %d", n)
+	}
+	if n := s.InFlight(); n != 0 {
+		t.Errorf("Expected no call running once the stream ended, got %d", n)
+	}
+	if want := "data: {\"jsonrpc\":\"2.0\",\"result\":true,\"id\":1}\n\n"; w.Body.String() != want {
+		t.Errorf("Expected %q, got %q", want, w.Body.String())
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	s := jsonrpc.NewServer(
+		jsonrpc.ServerRateLimit(func(r *http.Request) string {
+			return r.Header.Get("X-Api-Key")
+		}, rate.Every(time.Hour), 2),
+		jsonrpc.ServerMethodRateLimits(map[string]jsonrpc.RateLimit{
+			"Service1.Volatile": {Limit: rate.Every(time.Hour), Burst: 1},
+		}),
+	)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	call := func(key, method string) *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(
+			`{"jsonrpc":"2.0","method":"`+method+`","params":{"A":4,"B":2},"id":1}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Api-Key", key)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for i, tc := range []struct {
+		key, method string
+		limited     bool
+	}{
+		{"a", "Service1.Multiply", false},
+		{"a", "Service1.Volatile", false},
+		{"a", "Service1.Multiply", false},
+		{"a", "Service1.Volatile", true},
+		{"a", "Service1.Multiply", true},
+		{"b", "Service1.Multiply", false},
+	} {
+		w := call(tc.key, tc.method)
+		if !tc.limited {
+			if w.Code != 200 {
+				t.Errorf("%d: expected status 200, got %d", i, w.Code)
+			}
+			continue
+		}
+		if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+			t.Errorf("%d: expected status 429 with Retry-After, got %d %q", i, w.Code, w.Header().Get("Retry-After"))
+		}
+		var res Service1Response
+		if err := DecodeClientResponse(w.Body, &res); err == nil || err.(*Error).Code != ErrServer {
+			t.Errorf("%d: expected a server error, got %v", i, err)
+		}
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	var calls []string
+	var afterErr error
+	s := jsonrpc.NewServer(
+		jsonrpc.ServerAuth(func(ctx context.Context, method string, header http.Header) error {
+			calls = append(calls, "token")
+			if header.Get("Authorization") == "" {
+				return errors.New("missing token")
+			}
+			return nil
+		}),
+		jsonrpc.ServerAuth(func(ctx context.Context, method string, header http.Header) error {
+			calls = append(calls, "admin")
+			if method == "Service1.Register" {
+				return jsonrpc.NewServerError(-32001, "forbidden")
+			}
+			return nil
+		}),
+		jsonrpc.ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			afterErr = err
+		}),
+	)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		token  string
+		method string
+		code   ErrorCode
+		calls  []string
+	}{
+		{"", "Service1.Multiply", ErrServer, []string{"token"}},
+		{"secret", "Service1.Register", -32001, []string{"token", "admin"}},
+		{"secret", "Service1.Multiply", 0, []string{"token", "admin"}},
+	} {
+		calls = nil
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(
+			`{"jsonrpc":"2.0","method":"`+tc.method+`","params":{"A":4,"B":2},"id":1}`))
+		r.Header.Set("Content-Type", "application/json")
+		if tc.token != "" {
+			r.Header.Set("Authorization", tc.token)
+		}
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if !reflect.DeepEqual(calls, tc.calls) {
+			t.Errorf("%s: expected hooks %v, got %v", tc.method, tc.calls, calls)
+		}
+		var res Service1Response
+		err := DecodeClientResponse(w.Body, &res)
+		if tc.code == 0 {
+			if w.Code != 200 || err != nil || res.Result != 8 {
+				t.Errorf("%s: expected 8, got %d %d, %v", tc.method, w.Code, res.Result, err)
+			}
+			continue
+		}
+		if w.Code != 401 {
+			t.Errorf("%s: expected status 401, got %d", tc.method, w.Code)
+		}
+		if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != tc.code {
+			t.Errorf("%s: expected error code %d, got %v", tc.method, tc.code, err)
+		}
+		if afterErr == nil {
+			t.Errorf("%s: expected the after hooks to see the error", tc.method)
+		}
+	}
+}
+
+func TestAbsentParams(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		params string
+		want   []string
+	}{
+		{``, []string{}},
+		{`,"params":null`, []string{}},
+		{`,"params":{}`, []string{}},
+		{`,"params":{"A":0}`, []string{"A"}},
+		{`,"params":[0,0]`, []string{"A", "B"}},
+	} {
+		w := serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Optional","id":1`+tc.params+`}`)
+		var sent []string
+		if err := DecodeClientResponse(w.Body, &sent); err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.params, err)
+		} else if !reflect.DeepEqual(sent, tc.want) {
+			t.Errorf("%q: expected params %v, got %v", tc.params, tc.want, sent)
+		}
+	}
+}
+
+type Service1Header struct {
+	Token   string   `header:"Authorization"`
+	Retries *int     `header:"X-Retries"`
+	Tags    []string `header:"X-Tag"`
+	secret  string   `header:"X-Secret"`
+}
+
+type Service1BadHeader struct {
+	Deadline time.Time `header:"X-Deadline"`
+}
+
+func TestHeaderArgs(t *testing.T) {
+	s := jsonrpc.NewServer(jsonrpc.ServerMaxMethodArgs(1))
+	s.RegisterCodec(NewCodec(), "application/json")
+	err := s.RegisterFunc("Header.Echo", func(h *Service1Header, req *Service1Request) (*Service1Header, error) {
+		if h.Retries != nil {
+			*h.Retries += req.A
+		}
+		return h, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if argType, _, _ := s.MethodInfo("Header.Echo"); argType != reflect.TypeOf(&Service1Request{}) {
+		t.Errorf("Expected the params arg to be Service1Request, got %v", argType)
+	}
+
+	call := func(header http.Header) (*Service1Header, error) {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(
+			`{"jsonrpc":"2.0","method":"Header.Echo","params":{"A":1},"id":1}`))
+		r.Header = header
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		var res Service1Header
+		err := DecodeClientResponse(w.Body, &res)
+		return &res, err
+	}
+
+	res, err := call(http.Header{"Authorization": {"secret"}, "X-Retries": {"2"}, "X-Tag": {"a", "b"}, "X-Secret": {"s"}})
+	if err != nil || res.Token != "secret" || res.Retries == nil || *res.Retries != 3 || !reflect.DeepEqual(res.Tags, []string{"a", "b"}) {
+		t.Errorf("Unexpected header args: %+v, %v", res, err)
+	}
+
+	res, err = call(http.Header{})
+	if err != nil || res.Token != "" || res.Retries != nil || res.Tags != nil {
+		t.Errorf("Expected absent headers to leave fields untouched, got %+v, %v", res, err)
+	}
+
+	_, err = call(http.Header{"X-Retries": {"many"}})
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrBadParams || !strings.Contains(jsonErr.Message, "X-Retries") {
+		t.Errorf("Expected a bad params error about X-Retries, got %v", err)
+	}
+
+	err = s.RegisterFunc("Header.Bad", func(h *Service1BadHeader) (*Service1Response, error) { return nil, nil })
+	if err == nil || !strings.Contains(err.Error(), "Deadline") {
+		t.Errorf("Expected an unsupported header field error, got %v", err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	strict := jsonrpc.NewServer()
+	strict.RegisterCodec(NewCodec(), "application/json")
+	strict.RegisterService(new(Service1), "")
+	v1 := jsonrpc.NewServer(jsonrpc.ServerAllowVersion1())
+	v1.RegisterCodec(NewCodec(), "application/json")
+	v1.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		version string
+		v1      bool // accepted with ServerAllowVersion1
+	}{
+		{`"jsonrpc":"2.0",`, true},
+		{`"jsonrpc":"1.0",`, true},
+		{``, true},
+		{`"jsonrpc":"2.1",`, false},
+	} {
+		body := `{` + tc.version + `"method":"Service1.Multiply","params":[4,2],"id":1}`
+		for _, s := range []*jsonrpc.Server{strict, v1} {
+			want := tc.version == `"jsonrpc":"2.0",` || (s == v1 && tc.v1)
+			var res Service1Response
+			err := DecodeClientResponse(serveBody(s, body).Body, &res)
+			if !want {
+				if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrInvalidRequest {
+					t.Errorf("%s: expected an invalid request error, got %v", body, err)
+				}
+			} else if err != nil || res.Result != 8 {
+				t.Errorf("%s: expected 8, got %d, %v", body, res.Result, err)
+			}
+		}
+	}
+
+	w := serveBody(v1, `{"method":"Service1.Multiply","params":[4,2],"id":1}`)
+	if want := "{\"result\":{\"Result\":8},\"error\":null,\"id\":1}\n"; w.Body.String() != want {
+		t.Errorf("Expected a JSON-RPC 1.0 response %q, got %q", want, w.Body.String())
+	}
+	if w := serveBody(v1, `{"method":"Service1.Multiply","params":[4,2],"id":null}`); w.Code != 204 || w.Body.Len() != 0 {
+		t.Errorf("Expected a JSON-RPC 1.0 request with a null id to be a notification, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestWithJSON(t *testing.T) {
+	var marshals, unmarshals int
+	custom := jsonrpc.NewServer()
+	custom.RegisterCodec(NewCodec(WithJSON(func(v interface{}) ([]byte, error) {
+		marshals++
+		return json.Marshal(v)
+	}, func(data []byte, v interface{}) error {
+		unmarshals++
+		return json.Unmarshal(data, v)
+	})), "application/json")
+	custom.RegisterService(new(Service1), "")
+	std := jsonrpc.NewServer()
+	std.RegisterCodec(NewCodec(), "application/json")
+	std.RegisterService(new(Service1), "")
+
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`,
+		`[{"jsonrpc":"2.0","method":"Service1.Multiply","params":[4,2],"id":"a"},{"jsonrpc":"2.0","method":"Service1.Nope","id":2}]`,
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":"x"},"id":3}`,
+	} {
+		if got, want := serveBody(custom, body).Body.String(), serveBody(std, body).Body.String(); got != want {
+			t.Errorf("%s: expected %s, got %s", body, want, got)
+		}
+	}
+	if marshals == 0 || unmarshals == 0 {
+		t.Errorf("Expected the functions to be used, got %d marshals and %d unmarshals", marshals, unmarshals)
+	}
+}
+
+func TestLazyParams(t *testing.T) {
+	var unmarshals int
+	var body string
+	s := jsonrpc.NewServer(jsonrpc.ServerBefore(func(ctx context.Context, method string, header http.Header, req jsonrpc.CodecRequest) context.Context {
+		body = string(req.Body())
+		return ctx
+	}))
+	s.RegisterCodec(NewCodec(WithJSON(json.Marshal, func(data []byte, v interface{}) error {
+		unmarshals++
+		return json.Unmarshal(data, v)
+	})), "application/json")
+	s.RegisterFunc("Tools.Answer", func(ctx context.Context) (int, error) {
+		return 42, nil
+	})
+	s.RegisterFunc("Tools.Sum", func(a *Service1Request, b *Service1Request) (int, error) {
+		return a.A + a.B + b.A + b.B, nil
+	})
+
+	for _, tc := range []struct {
+		body       string
+		result     int
+		unmarshals int
+	}{
+		{`{"jsonrpc":"2.0","method":"Tools.Answer","params":{"A":1},"id":1}`, 42, 1},
+		{`{"jsonrpc":"2.0","method":"Tools.Sum","params":{"A":1,"B":2},"id":1}`, 6, 2},
+	} {
+		unmarshals = 0
+		var result int
+		if err := DecodeClientResponse(serveBody(s, tc.body).Body, &result); err != nil || result != tc.result {
+			t.Errorf("%s: expected %d, got %d, %v", tc.body, tc.result, result, err)
+		}
+		if unmarshals != tc.unmarshals {
+			t.Errorf("%s: expected %d unmarshals, got %d", tc.body, tc.unmarshals, unmarshals)
+		}
+		if body != tc.body {
+			t.Errorf("Expected hooks to see the body %s, got %s", tc.body, body)
+		}
+	}
+}
+
+type Service3 struct{}
+
+func (t *Service3) Names(r *http.Request, req *Service1Request, reply *[]string) error {
+	for i := 0; i < req.A; i++ {
+		*reply = append(*reply, strconv.Itoa(i))
+	}
+	return nil
+}
+
+func (t *Service3) Counts(req *Service1Request, reply *map[string]int) error {
+	*reply = map[string]int{"A": req.A, "B": req.B}
+	return nil
+}
+
+func (t *Service3) Product(req *Service1Request, reply *int) error {
+	if req.A < 0 {
+		return NewError(ErrBadParams, "negative A")
+	}
+	*reply = req.A * req.B
+	return nil
+}
+
+func TestReplyArgs(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service3), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method string
+		params string
+		result string
+	}{
+		{"Service3.Names", `{"A":3}`, `["0","1","2"]`},
+		{"Service3.Counts", `{"A":2,"B":5}`, `{"A":2,"B":5}`},
+		{"Service3.Product", `{"A":4,"B":3}`, `12`},
+	} {
+		w := serveBody(s, `{"jsonrpc":"2.0","method":"`+tc.method+`","params":`+tc.params+`,"id":1}`)
+		var result json.RawMessage
+		if err := DecodeClientResponse(w.Body, &result); err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.method, err)
+		} else if string(result) != tc.result {
+			t.Errorf("%s: expected result %s, got %s", tc.method, tc.result, result)
+		}
+	}
+
+	w := serveBody(s, `{"jsonrpc":"2.0","method":"Service3.Product","params":{"A":-1},"id":1}`)
+	var result int
+	if err, ok := DecodeClientResponse(w.Body, &result).(*Error); !ok || err.Code != ErrBadParams {
+		t.Errorf("Expected ErrBadParams, but got %v", err)
+	}
+
+	if _, replyType, _ := s.MethodInfo("Service3.Counts"); replyType != reflect.TypeOf(map[string]int{}) {
+		t.Errorf("Expected reply type map[string]int, got %v", replyType)
+	}
+}
+
+type Counter struct {
+	calls int32
+}
+
+func (t *Counter) Next(req *Service1Request) (*Service1Response, error) {
+	n := atomic.AddInt32(&t.calls, 1)
+	if req.A < 0 {
+		return nil, NewError(ErrInternal, "internal failure")
+	}
+	time.Sleep(time.Duration(req.A) * time.Millisecond)
+	return &Service1Response{Result: int(n)}, nil
+}
+
+func TestIdempotency(t *testing.T) {
+	s := jsonrpc.NewServer(jsonrpc.ServerIdempotency(jsonrpc.NewIdempotencyStore(time.Minute), "Idempotency-Key"))
+	s.RegisterCodec(NewCodec(), "application/json")
+	counter := new(Counter)
+	s.RegisterService(counter, "")
+
+	serve := func(key, params string) *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(`{"jsonrpc":"2.0","method":"Counter.Next","params":`+params+`,"id":1}`))
+		r.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, tc := range []struct {
+		key      string
+		params   string
+		calls    int32
+		replayed bool
+		status   int
+	}{
+		{"a", `{"A":0}`, 1, false, 200},
+		{"a", `{"A":0}`, 1, true, 200},
+		{"a", `{"A":1}`, 2, false, 200},
+		{"b", `{"A":0}`, 3, false, 200},
+		{"", `{"A":0}`, 4, false, 200},
+		{"", `{"A":0}`, 5, false, 200},
+		{"c", `{"A":-1}`, 6, false, 500},
+		{"c", `{"A":-1}`, 7, false, 500},
+	} {
+		w := serve(tc.key, tc.params)
+		if w.Code != tc.status {
+			t.Errorf("%q %s: expected status %d, got %d", tc.key, tc.params, tc.status, w.Code)
+		}
+		if replayed := w.HeaderMap.Get("Idempotent-Replayed") != ""; replayed != tc.replayed {
+			t.Errorf("%q %s: expected replayed %v, got %v", tc.key, tc.params, tc.replayed, replayed)
+		}
+		if calls := atomic.LoadInt32(&counter.calls); calls != tc.calls {
+			t.Errorf("%q %s: expected %d calls, got %d", tc.key, tc.params, tc.calls, calls)
+		}
+	}
+
+	// Duplicates wait for the first request and get its response.
+	atomic.StoreInt32(&counter.calls, 0)
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = serve("d", `{"A":50}`).Body.String()
+		}(i)
+	}
+	wg.Wait()
+	if calls := atomic.LoadInt32(&counter.calls); calls != 1 {
+		t.Errorf("Expected 1 call for concurrent duplicates, got %d", calls)
+	}
+	for _, body := range bodies[1:] {
+		if body != bodies[0] {
+			t.Errorf("Expected response %q, got %q", bodies[0], body)
+		}
+	}
+
+	// Duplicates waiting past the server timeout get a timeout error.
+	var mutex sync.Mutex
+	var afterErrs []error
+	s = jsonrpc.NewServer(
+		jsonrpc.ServerIdempotency(jsonrpc.NewIdempotencyStore(time.Minute), "Idempotency-Key"),
+		jsonrpc.ServerTimeout(30*time.Millisecond),
+		jsonrpc.ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			mutex.Lock()
+			afterErrs = append(afterErrs, err)
+			mutex.Unlock()
+		}),
+	)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Counter), "")
+	done := make(chan struct{})
+	go func() {
+		serve("e", `{"A":100}`)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	w := serve("e", `{"A":100}`)
+	<-done
+	var res Service1Response
+	err := DecodeClientResponse(w.Body, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrTimeout {
+		t.Errorf("Expected a timeout error for the waiting duplicate, got %v (%q)", err, w.Body)
+	}
+	if len(afterErrs) != 2 {
+		t.Fatalf("Expected after hooks to run twice, got %v", afterErrs)
+	}
+	for _, err := range afterErrs {
+		if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrTimeout {
+			t.Errorf("Expected after hooks to see a timeout error, got %v", err)
+		}
+	}
+}
+
+func TestBeforeV2(t *testing.T) {
+	var afterReply interface{}
+	var skipped bool
+	s := jsonrpc.NewServer(
+		jsonrpc.ServerBeforeV2(func(ctx context.Context, method string, header http.Header, req jsonrpc.CodecRequest) (context.Context, bool, interface{}, error) {
+			switch header.Get("X-Cached") {
+			case "reply":
+				return ctx, true, &Service1Response{Result: 42}, nil
+			case "error":
+				return ctx, true, nil, NewError(ErrServer, "cache failure")
+			}
+			return ctx, false, nil, nil
+		}),
+		jsonrpc.ServerBefore(func(ctx context.Context, method string, header http.Header, req jsonrpc.CodecRequest) context.Context {
+			skipped = false
+			return ctx
+		}),
+		jsonrpc.ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			afterReply = reply
+		}),
+	)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		cached  string
+		status  int
+		result  int
+		code    ErrorCode
+		skipped bool
+	}{
+		{"", 200, 6, 0, false},
+		{"reply", 200, 42, 0, true},
+		{"error", 500, 0, ErrServer, true},
+	} {
+		skipped = true
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3},"id":1}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Cached", tc.cached)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("%q: expected status %d, got %d", tc.cached, tc.status, w.Code)
+		}
+		if skipped != tc.skipped {
+			t.Errorf("%q: expected next hooks skipped %v, got %v", tc.cached, tc.skipped, skipped)
+		}
+		var res Service1Response
+		err := DecodeClientResponse(w.Body, &res)
+		if tc.code != 0 {
+			if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != tc.code {
+				t.Errorf("%q: expected error %d, got %v", tc.cached, tc.code, err)
+			}
+			continue
+		}
+		if err != nil || res.Result != tc.result {
+			t.Errorf("%q: expected result %d, got %d, %v", tc.cached, tc.result, res.Result, err)
+		}
+		if reply, ok := afterReply.(*Service1Response); !ok || reply.Result != tc.result {
+			t.Errorf("%q: expected after hooks to see result %d, got %v", tc.cached, tc.result, afterReply)
+		}
+	}
+}
+
+func TestExtra(t *testing.T) {
+	var extras []map[string]json.RawMessage
+	s := jsonrpc.NewServer(jsonrpc.ServerBefore(func(ctx context.Context, method string, header http.Header, req jsonrpc.CodecRequest) context.Context {
+		extras = append(extras, req.(*CodecRequest).Extra())
+		return ctx
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		body  string
+		extra []map[string]json.RawMessage
+	}{
+		{
+			`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3},"id":1}`,
+			[]map[string]json.RawMessage{{}},
+		},
+		{
+			`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3},"id":1,"meta":{"tenant":"t1"},"ID":2}`,
+			[]map[string]json.RawMessage{{"meta": json.RawMessage(`{"tenant":"t1"}`)}},
+		},
+		{
+			`[{"jsonrpc":"2.0","method":"Service1.Multiply","id":1,"trace":"x"},{"jsonrpc":"2.0","method":"Service1.Multiply","id":2}]`,
+			[]map[string]json.RawMessage{{"trace": json.RawMessage(`"x"`)}, {}},
+		},
+	} {
+		extras = nil
+		serveBody(s, tc.body)
+		if !reflect.DeepEqual(extras, tc.extra) {
+			t.Errorf("%s: expected extra members %s, got %s", tc.body, tc.extra, extras)
+		}
+	}
+
+	for _, body := range []string{`[{"jsonrpc":"2.0","method":"Service1.Multiply","id":1}]`, `"Service1.Multiply"`} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		if extra := NewCodec().NewRequest(r).(*CodecRequest).Extra(); extra != nil {
+			t.Errorf("%s: expected no extra members, got %s", body, extra)
+		}
+	}
+}
+
+func TestResponseDecorator(t *testing.T) {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(ResponseDecorator(func(envelope map[string]json.RawMessage) map[string]json.RawMessage {
+		envelope["served_by"] = json.RawMessage(`"host1"`)
+		envelope["id"] = json.RawMessage(`"forged"`)
+		delete(envelope, "jsonrpc")
+		return envelope
+	})), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{
+			`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3},"id":1}`,
+			`{"id":1,"jsonrpc":"2.0","result":{"Result":6},"served_by":"host1"}` + "\n",
+		},
+		{
+			`{"jsonrpc":"2.0","method":"Service1.Unknown","id":1}`,
+			`{"error":{"code":-32601,"message":"rpc: method not found: Service1.Unknown"},"id":1,"jsonrpc":"2.0","served_by":"host1"}` + "\n",
+		},
+		{
+			`[{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3},"id":1},{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":1,"B":3},"id":2}]`,
+			`[{"id":1,"jsonrpc":"2.0","result":{"Result":6},"served_by":"host1"},{"id":2,"jsonrpc":"2.0","result":{"Result":3},"served_by":"host1"}]`,
+		},
+	} {
+		w := serveBody(s, tc.body)
+		if got := w.Body.String(); strings.TrimSpace(got) != strings.TrimSpace(tc.want) {
+			t.Errorf("%s: expected response %s, got %s", tc.body, tc.want, got)
+		}
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	var afterErr error
+	s := jsonrpc.NewServer(jsonrpc.ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+		afterErr = err
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		method string
+		cancel time.Duration
+	}{
+		{"Service1.Wait", 10 * time.Millisecond},
+		{"Service1.Multiply", 0},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		if tc.cancel > 0 {
+			time.AfterFunc(tc.cancel, cancel)
+		} else {
+			cancel()
+		}
+		r, _ := http.NewRequestWithContext(ctx, "POST", "http://localhost:8080/", strings.NewReader(`{"jsonrpc":"2.0","method":"`+tc.method+`","params":{"A":1000},"id":1}`))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		afterErr = nil
+		s.ServeHTTP(w, r)
+		cancel()
+
+		if w.Body.Len() != 0 {
+			t.Errorf("%s: expected no response, got %s", tc.method, w.Body)
+		}
+		if !errors.Is(afterErr, context.Canceled) {
+			t.Errorf("%s: expected after hooks to get context.Canceled, got %v", tc.method, afterErr)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var res Service1Response
+	if err := s.Invoke(ctx, "Service1.Multiply", &Service1Request{A: 2, B: 3}, &res); err != context.Canceled {
+		t.Errorf("Expected Invoke to return context.Canceled, got %v", err)
+	}
+}
+
+type logEntry struct {
+	level jsonrpc.LogLevel
+	msg   string
+	kv    []interface{}
+}
+
+type testLogger struct {
+	entries []logEntry
+}
+
+func (l *testLogger) Log(ctx context.Context, level jsonrpc.LogLevel, msg string, kv ...interface{}) {
+	l.entries = append(l.entries, logEntry{level, msg, kv})
+}
+
+func TestServerLogger(t *testing.T) {
+	logger := new(testLogger)
+	s := jsonrpc.NewServer(jsonrpc.ServerLogger(logger))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		method string
+		params string
+		level  jsonrpc.LogLevel
+		msg    string
+		code   interface{}
+	}{
+		{"Service1.Multiply", `{"A":2,"B":3}`, jsonrpc.LogInfo, "rpc: request done", nil},
+		{"Service1.Multiply", `{"A":"x"}`, jsonrpc.LogWarn, "rpc: request failed", int(ErrBadParams)},
+		{"Service1.Internal", `{}`, jsonrpc.LogError, "rpc: request failed", int(ErrInternal)},
+	} {
+		logger.entries = nil
+		serveBody(s, `{"jsonrpc":"2.0","method":"`+tc.method+`","params":`+tc.params+`,"id":1}`)
+		if len(logger.entries) != 2 {
+			t.Fatalf("%s: expected 2 entries, got %v", tc.method, logger.entries)
+		}
+		start, end := logger.entries[0], logger.entries[1]
+		if start.level != jsonrpc.LogDebug || !reflect.DeepEqual(start.kv, []interface{}{"method", tc.method, "id", "1"}) {
+			t.Errorf("%s: unexpected start entry %v", tc.method, start)
+		}
+		if end.level != tc.level || end.msg != tc.msg {
+			t.Errorf("%s: expected %v %q, got %v %q", tc.method, tc.level, tc.msg, end.level, end.msg)
+		}
+		if len(end.kv) < 6 || end.kv[4] != "duration" {
+			t.Fatalf("%s: expected a duration, got %v", tc.method, end.kv)
+		}
+		if tc.code != nil && (len(end.kv) != 10 || end.kv[6] != "code" || end.kv[7] != tc.code) {
+			t.Errorf("%s: expected code %v, got %v", tc.method, tc.code, end.kv)
+		}
+	}
+
+	var buf bytes.Buffer
+	s = jsonrpc.NewServer(jsonrpc.ServerLogger(jsonrpc.NewStdLogger(log.New(&buf, "", 0), jsonrpc.LogWarn)))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3},"id":1}`)
+	serveBody(s, `{"jsonrpc":"2.0","method":"Service1.Internal","params":{},"id":"a b"}`)
+	if got, want := buf.String(), `error rpc: request failed method=Service1.Internal id="a b" duration=`; !strings.HasPrefix(got, want) ||
+		!strings.HasSuffix(got, ` code=-32603 error="internal failure"`+"\n") {
+		t.Errorf("Unexpected log %q", got)
+	}
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	batch := func(n int) string {
+		elements := make([]string, n)
+		for i := range elements {
+			elements[i] = `{"jsonrpc":"2.0","method":"Counter.Next","params":{},"id":` + strconv.Itoa(i) + `}`
+		}
+		return "[" + strings.Join(elements, ",") + "]"
+	}
+
+	for _, tc := range []struct {
+		options []jsonrpc.ServerOption
+		size    int
+		status  int
+	}{
+		{nil, 100, 200},
+		{nil, 101, 400},
+		{[]jsonrpc.ServerOption{jsonrpc.ServerMaxBatchSize(2)}, 2, 200},
+		{[]jsonrpc.ServerOption{jsonrpc.ServerMaxBatchSize(2)}, 3, 400},
+		{[]jsonrpc.ServerOption{jsonrpc.ServerMaxBatchSize(0)}, 150, 200},
+	} {
+		s := jsonrpc.NewServer(tc.options...)
+		s.RegisterCodec(NewCodec(), "application/json")
+		counter := new(Counter)
+		s.RegisterService(counter, "")
+
+		w := serveBody(s, batch(tc.size))
+		if w.Code != tc.status {
+			t.Errorf("%d requests: expected status %d, got %d", tc.size, tc.status, w.Code)
+		}
+		calls := int(atomic.LoadInt32(&counter.calls))
+		if tc.status == 400 {
+			var res Service1Response
+			if err, ok := DecodeClientResponse(w.Body, &res).(*Error); !ok || err.Code != ErrInvalidRequest {
+				t.Errorf("%d requests: expected ErrInvalidRequest, got %v", tc.size, err)
+			}
+			if calls != 0 {
+				t.Errorf("%d requests: expected no calls, got %d", tc.size, calls)
+			}
+		} else if calls != tc.size {
+			t.Errorf("%d requests: expected %d calls, got %d", tc.size, tc.size, calls)
+		}
+	}
+
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(batch(1000)))
+	req := NewCodec().NewRequest(r).(*CodecRequest)
+	req.LimitBatch(5)
+	if n := len(req.Requests()); n != 6 {
+		t.Errorf("Expected 6 decoded requests, got %d", n)
+	}
+}
+
+func TestBatchParallel(t *testing.T) {
+	var mutex sync.Mutex
+	var afterErrs []error
+	s := jsonrpc.NewServer(
+		jsonrpc.ServerBatchParallel(4),
+		jsonrpc.ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			if method == "Service1.Panic" {
+				mutex.Lock()
+				afterErrs = append(afterErrs, err)
+				mutex.Unlock()
+			}
+		}),
+	)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	// The barrier only opens once its 4 requests run at the same time.
+	var barrier sync.WaitGroup
+	barrier.Add(4)
+	open := make(chan struct{})
+	go func() {
+		barrier.Wait()
+		close(open)
+	}()
+	s.RegisterFunc("Barrier.Wait", func(req *Service1Request) (*Service1Response, error) {
+		barrier.Done()
+		select {
+		case <-open:
+			return &Service1Response{Result: req.A}, nil
+		case <-time.After(5 * time.Second):
+			return nil, NewError(ErrServer, "requests ran one after the other")
+		}
+	})
+
+	w := serveBody(s, `[
+		{"jsonrpc":"2.0","method":"Barrier.Wait","params":{"A":1},"id":1},
+		{"jsonrpc":"2.0","method":"Barrier.Wait","params":{"A":2},"id":2},
+		{"jsonrpc":"2.0","method":"Service1.Panic","params":{},"id":3},
+		{"jsonrpc":"2.0","method":"Service1.Panic","params":{}},
+		{"jsonrpc":"2.0","method":"Barrier.Wait","params":{"A":4},"id":4},
+		{"jsonrpc":"2.0","method":"Barrier.Wait","params":{"A":5},"id":5}
+	]`)
+
+	var responses []struct {
+		Result *Service1Response `json:"result"`
+		Error  *Error            `json:"error"`
+		ID     int               `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 5 {
+		t.Fatalf("Expected 5 responses, the notification having none, got %s", w.Body)
+	}
+	for i, res := range responses {
+		if res.ID != i+1 {
+			t.Errorf("Expected response %d to have id %d, got %d", i, i+1, res.ID)
+		}
+		if res.ID == 3 {
+			if res.Error == nil || res.Error.Code != ErrInternal {
+				t.Errorf("Expected ErrInternal for the panic, got %v", res.Error)
+			}
+		} else if res.Result == nil {
+			t.Errorf("Expected a result for id %d, got %v", res.ID, res.Error)
+		}
+	}
+
+	if len(afterErrs) != 2 {
+		t.Fatalf("Expected after hooks to run for both panics, got %v", afterErrs)
+	}
+	for _, err := range afterErrs {
+		if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != ErrInternal {
+			t.Errorf("Expected after hooks to see an internal error, got %v", err)
+		}
+	}
+}
+
+func TestCallInfo(t *testing.T) {
+	var infos []jsonrpc.CallInfo
+	s := jsonrpc.NewServer(
+		jsonrpc.ServerBeforeV2(func(ctx context.Context, method string, header http.Header, req jsonrpc.CodecRequest) (context.Context, bool, interface{}, error) {
+			return ctx, method == "Service1.Cached", &Service1Response{Result: 1}, nil
+		}),
+		jsonrpc.ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			info, ok := jsonrpc.Info(ctx)
+			if !ok {
+				t.Errorf("%s: expected a call info", method)
+			}
+			infos = append(infos, info)
+		}),
+	)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Counter), "")
+	s.RegisterService(new(Service1), "")
+
+	for _, tc := range []struct {
+		body string
+		want jsonrpc.CallInfo
+	}{
+		{`{"jsonrpc":"2.0","method":"Counter.Next","params":{"A":5},"id":1}`,
+			jsonrpc.CallInfo{Method: "Counter.Next", ID: "1", Found: true}},
+		{`{"jsonrpc":"2.0","method":"Counter.Nope","params":{},"id":"a"}`,
+			jsonrpc.CallInfo{Method: "Counter.Nope", ID: "a"}},
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3}}`,
+			jsonrpc.CallInfo{Method: "Service1.Multiply", Notification: true, Found: true}},
+		{`{"jsonrpc":"2.0","method":"Service1.Cached","params":{},"id":2}`,
+			jsonrpc.CallInfo{Method: "Service1.Cached", ID: "2", Handled: true}},
+	} {
+		infos = nil
+		serveBody(s, tc.body)
+		if len(infos) != 1 {
+			t.Fatalf("%s: expected 1 call info, got %v", tc.want.Method, infos)
+		}
+		got := infos[0]
+		if got.Start.IsZero() || got.BytesRead != len(tc.body) {
+			t.Errorf("%s: expected a start and %d bytes read, got %v", tc.want.Method, len(tc.body), got)
+		}
+		if tc.want.Method == "Counter.Next" && got.Duration < 5*time.Millisecond {
+			t.Errorf("%s: expected a duration of 5ms at least, got %v", tc.want.Method, got.Duration)
+		}
+		got.Start, got.BytesRead, got.Duration = time.Time{}, 0, 0
+		if got != tc.want {
+			t.Errorf("%s: expected %+v, got %+v", tc.want.Method, tc.want, got)
+		}
+	}
+
+	if _, ok := jsonrpc.Info(context.Background()); ok {
+		t.Error("Expected no call info outside of the server")
+	}
+}
+
+func TestStopBatchOnError(t *testing.T) {
+	body := `[
+		{"jsonrpc":"2.0","method":"Counter.Next","params":{"A":0},"id":1},
+		{"jsonrpc":"2.0","method":"Counter.Next","params":{"A":-1},"id":2},
+		{"jsonrpc":"2.0","method":"Counter.Next","params":{"A":0},"id":3},
+		{"jsonrpc":"2.0","method":"Counter.Next","params":{"A":0}},
+		{"jsonrpc":"2.0","method":"Counter.Next","params":{"A":0},"id":4}
+	]`
+
+	for _, tc := range []struct {
+		options []jsonrpc.ServerOption
+		calls   int32
+		skipped bool
+	}{
+		{nil, 5, false},
+		{[]jsonrpc.ServerOption{jsonrpc.ServerStopBatchOnError()}, 2, true},
+	} {
+		s := jsonrpc.NewServer(tc.options...)
+		s.RegisterCodec(NewCodec(), "application/json")
+		counter := new(Counter)
+		s.RegisterService(counter, "")
+
+		w := serveBody(s, body)
+		if calls := atomic.LoadInt32(&counter.calls); calls != tc.calls {
+			t.Errorf("Expected %d calls, got %d", tc.calls, calls)
+		}
+		var responses []struct {
+			Result *Service1Response `json:"result"`
+			Error  *Error            `json:"error"`
+			ID     int               `json:"id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+			t.Fatal(err)
+		}
+		if len(responses) != 4 {
+			t.Fatalf("Expected 4 responses, got %s", w.Body)
+		}
+		for i, res := range responses {
+			if res.ID != i+1 {
+				t.Errorf("Expected response %d to have id %d, got %d", i, i+1, res.ID)
+			}
+		}
+		if responses[0].Result == nil || responses[1].Error == nil || responses[1].Error.Code != ErrInternal {
+			t.Errorf("Unexpected responses %s", w.Body)
+		}
+		for _, res := range responses[2:] {
+			if skipped := res.Error != nil && res.Error.Message == "rpc: skipped due to prior error"; skipped != tc.skipped {
+				t.Errorf("Expected skipped %v for id %d, got %v", tc.skipped, res.ID, res.Error)
+			}
+		}
+	}
+}
+
+func TestBodyReadTimeoutError(t *testing.T) {
+	s := jsonrpc.NewServer(jsonrpc.ServerBodyReadTimeout(50 * time.Millisecond))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	goroutines := runtime.NumGoroutine()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Send the body one byte at a time, much slower than the timeout.
+	body := `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", len(body))
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < len(body); i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			if _, err := conn.Write([]byte{body[i]}); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 408 {
+		t.Errorf("Expected status 408, got %d", resp.StatusCode)
+	}
+	var res Service1Response
+	if err, ok := DecodeClientResponse(resp.Body, &res).(*Error); !ok || err.Code != ErrParse {
+		t.Errorf("Expected a parse error, got %v", err)
+	}
+
+	// The server closes the connection without waiting for the rest of
+	// the body, and leaves nothing running behind.
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+	close(stop)
+	<-sent
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected at most %d goroutines once answered, got %d", goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
@@ -1,11 +1,17 @@
 package json2
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"regexp"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/devimteam/jsonrpc"
 	"github.com/mitchellh/mapstructure"
@@ -31,8 +37,9 @@ type serverRequest struct {
 
 	// The request id. MUST be a string, number or null.
 	// Our implementation will not do type checking for id.
-	// It will be copied as it is.
-	ID *json.RawMessage `json:"id"`
+	// It will be copied as it is. Empty if the member is absent, which
+	// makes the request a notification, and "null" if it is null.
+	ID json.RawMessage `json:"id"`
 }
 
 // serverResponse represents a JSON-RPC response returned by the server.
@@ -52,6 +59,41 @@ type serverResponse struct {
 
 	// This must be the same id as the request it is responding to.
 	ID *json.RawMessage `json:"id"`
+
+	// Non-standard extension member, only sent when enabled on the codec.
+	Meta *responseMeta `json:"meta,omitempty"`
+}
+
+// serverResponseV1 is the response to a JSON-RPC 1.0 request, which has
+// both result and error members.
+type serverResponseV1 struct {
+	Result interface{}      `json:"result"`
+	Error  *Error           `json:"error"`
+	ID     *json.RawMessage `json:"id"`
+}
+
+// responseMeta holds the non-standard "meta" response member.
+type responseMeta struct {
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Warner is implemented by replies that carry non-fatal warnings alongside
+// the result, e.g. from best-effort aggregation. The warnings are sent in
+// the "meta" response member when the codec uses the IncludeWarnings option.
+type Warner interface {
+	Warnings() []string
+}
+
+// StreamCodec is implemented by replies that write their own result, like
+// large result sets encoded element by element with a json.Encoder, instead
+// of being encoded as a whole in memory. WriteResult must write a single
+// JSON value.
+//
+// The response is then written as it goes, so an error of WriteResult
+// leaves the client with a truncated response; it is returned by
+// WriteResponse. Codecs with an envelope encode the reply as usual.
+type StreamCodec interface {
+	WriteResult(w io.Writer) error
 }
 
 type CodecOption func(*Codec)
@@ -62,7 +104,7 @@ type CodecOption func(*Codec)
 
 // NewCustomCodec returns a new JSON Codec based on passed encoder selector.
 func NewCustomCodec(encSel jsonrpc.EncoderSelector, options ...CodecOption) *Codec {
-	c := &Codec{encSel: encSel}
+	c := &Codec{encSel: encSel, marshal: json.Marshal, unmarshal: json.Unmarshal}
 	for _, o := range options {
 		o(c)
 	}
@@ -80,15 +122,115 @@ func SetDateTimeFormat(format string) CodecOption {
 	}
 }
 
+// IncludeWarnings makes the codec send the warnings of replies implementing
+// Warner in the "meta" response member. This is a non-standard extension.
+func IncludeWarnings() CodecOption {
+	return func(c *Codec) {
+		c.warnings = true
+	}
+}
+
+// ValidateUTF8Params makes the codec reject params that are not valid UTF-8
+// with ErrInvalidRequest. encoding/json silently replaces invalid bytes in
+// strings with U+FFFD, which may otherwise reach storage unnoticed. The check
+// runs over the raw params bytes, which is much cheaper than walking the
+// decoded arguments.
+func ValidateUTF8Params() CodecOption {
+	return func(c *Codec) {
+		c.validateUTF8 = true
+	}
+}
+
+// EnvelopeFunc builds the value written to the wire in place of the
+// JSON-RPC response object. err is nil when the method succeeded, in which
+// case result is its reply, which may be nil too; result is nil on errors.
+type EnvelopeFunc func(result interface{}, err *Error) interface{}
+
+// ResponseEnvelope replaces the JSON-RPC response envelope with the value
+// returned by fn, for clients that expect a different shape such as
+// {"ok":true,"data":...,"err":null}. Requests are still parsed and
+// dispatched as JSON-RPC; only the written response differs.
+//
+// The shape is usually given by the json tags of the struct fn returns:
+//
+//	type envelope struct {
+//		OK   bool         `json:"ok"`
+//		Data interface{}  `json:"data"`
+//		Err  *json2.Error `json:"err"`
+//	}
+//
+//	json2.ResponseEnvelope(func(result interface{}, err *json2.Error) interface{} {
+//		return envelope{OK: err == nil, Data: result, Err: err}
+//	})
+func ResponseEnvelope(fn EnvelopeFunc) CodecOption {
+	return func(c *Codec) {
+		c.envelope = fn
+	}
+}
+
+// DecoratorFunc returns the members of a response object to write, given
+// those of the response, each encoded.
+type DecoratorFunc func(envelope map[string]json.RawMessage) map[string]json.RawMessage
+
+// ResponseDecorator sets a function adding members to every response
+// object, batch elements included, such as the name of the serving host.
+// The jsonrpc, result, error and id members stay as the codec set them,
+// whatever fn does with them. Responses are then written with their
+// members sorted by name, and results are not streamed.
+func ResponseDecorator(fn DecoratorFunc) CodecOption {
+	return func(c *Codec) {
+		c.decorate = fn
+	}
+}
+
+// ParamsPreprocessor sets a function rewriting the raw params of every
+// request before they are decoded into the method arguments, e.g. to unwrap
+// params double-encoded as a JSON string. An error returned by fn is sent to
+// the client as ErrParse.
+func ParamsPreprocessor(fn func(raw json.RawMessage) (json.RawMessage, error)) CodecOption {
+	return func(c *Codec) {
+		c.preprocess = fn
+	}
+}
+
+// TimeLayouts sets more layouts to try, in order, when decoding a string
+// param into a time.Time field. They are tried after the SetDateTimeFormat
+// one, RFC 3339 by default. Strings matching none of them are bad params.
+func TimeLayouts(layouts ...string) CodecOption {
+	return func(c *Codec) {
+		c.timeLayouts = append(c.timeLayouts, layouts...)
+	}
+}
+
+// WithJSON sets the functions encoding and decoding requests, params and
+// responses in place of those of encoding/json, e.g. those of a faster
+// library. They must behave as encoding/json does, json.RawMessage and
+// json.Marshaler included, so the wire format stays the same. Requests with
+// trailing data are refused even if unmarshal ignores it.
+func WithJSON(marshal func(v interface{}) ([]byte, error), unmarshal func(data []byte, v interface{}) error) CodecOption {
+	return func(c *Codec) {
+		c.marshal = marshal
+		c.unmarshal = unmarshal
+	}
+}
+
 // Codec creates a CodecRequest to process each request.
 type Codec struct {
 	encSel         jsonrpc.EncoderSelector
 	dateTimeFormat string
+	timeLayouts    []string
+	warnings       bool
+	validateUTF8   bool
+	envelope       EnvelopeFunc
+	decorate       DecoratorFunc
+	preprocess     func(raw json.RawMessage) (json.RawMessage, error)
+	marshal        func(v interface{}) ([]byte, error)
+	unmarshal      func(data []byte, v interface{}) error
 }
 
 // NewRequest returns a CodecRequest.
 func (c *Codec) NewRequest(r *http.Request) jsonrpc.CodecRequest {
-	return newCodecRequest(r, c.encSel.Select(r), c.dateTimeFormat)
+	return newCodecRequest(r, c.encSel.Select(r), c)
 }
 
 // ----------------------------------------------------------------------------
@@ -96,17 +238,42 @@ func (c *Codec) NewRequest(r *http.Request) jsonrpc.CodecRequest {
 // ----------------------------------------------------------------------------
 
 // newCodecRequest returns a new CodecRequest.
-func newCodecRequest(r *http.Request, encoder jsonrpc.Encoder, dateTimeFormat string) jsonrpc.CodecRequest {
+func newCodecRequest(r *http.Request, encoder jsonrpc.Encoder, codec *Codec) jsonrpc.CodecRequest {
 	defer r.Body.Close()
 
-	// Decode the request body and check if RPC method is valid.
 	body, _ := ioutil.ReadAll(r.Body)
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' && json.Valid(trimmed) {
+		return newBatchRequest(body, encoder, codec)
+	}
+	return parseRequest(body, encoder, codec, ErrParse)
+}
+
+// parseRequest decodes a single request and checks if RPC method is valid.
+// A body that isn't JSON gets the invalid error code, while JSON that isn't
+// a request object, like a double-encoded request or a method that is not a
+// string, gets ErrInvalidRequest.
+//
+// Anything but whitespace after the request object, like a concatenated
+// request, gets the invalid error code too, whatever the unmarshal function
+// of the codec accepts.
+func parseRequest(body []byte, encoder jsonrpc.Encoder, codec *Codec, invalid ErrorCode) *CodecRequest {
 	req := new(serverRequest)
-	err := json.Unmarshal(body, req)
+	err := codec.unmarshal(body, req)
 
-	if err != nil {
+	if err == nil && !json.Valid(body) {
+		req = new(serverRequest)
 		err = &Error{
-			Code:    ErrParse,
+			Code:    invalid,
+			Message: "trailing data after the request",
+		}
+	} else if err != nil {
+		code := invalid
+		if json.Valid(body) {
+			code = ErrInvalidRequest
+		}
+		req = new(serverRequest)
+		err = &Error{
+			Code:    code,
 			Message: err.Error(),
 		}
 	} else if req.Version != Version {
@@ -114,23 +281,206 @@ func newCodecRequest(r *http.Request, encoder jsonrpc.Encoder, dateTimeFormat st
 			Code:    ErrInvalidRequest,
 			Message: "jsonrpc must be " + Version,
 		}
+	} else if req.Method == "" {
+		err = &Error{
+			Code:    ErrInvalidRequest,
+			Message: "method is required",
+		}
+	} else {
+		err = preprocessParams(req, codec)
+	}
+	return &CodecRequest{request: req, err: err, encoder: encoder, body: body, codec: codec}
+}
+
+// preprocessParams runs the params preprocessor of the codec, if any.
+func preprocessParams(req *serverRequest, codec *Codec) error {
+	if req.Params == nil || codec.preprocess == nil {
+		return nil
+	}
+	params, err := codec.preprocess(*req.Params)
+	if err != nil {
+		return &Error{
+			Code:    ErrParse,
+			Message: err.Error(),
+		}
+	}
+	req.Params = (*json.RawMessage)(&params)
+	return nil
+}
+
+// newBatchRequest returns a CodecRequest for a batch, whose elements are
+// decoded by Requests.
+func newBatchRequest(body []byte, encoder jsonrpc.Encoder, codec *Codec) *CodecRequest {
+	return &CodecRequest{
+		request: new(serverRequest),
+		err:     &Error{Code: ErrInvalidRequest, Message: "batch has no single method"},
+		encoder: encoder,
+		body:    body,
+		codec:   codec,
+		isBatch: true,
+	}
+}
+
+// decodeBatch returns a request for each element of the batch, up to one
+// past the limit if any. An element that is valid JSON but not a request
+// object gets an ErrInvalidRequest response with a null id.
+func (c *CodecRequest) decodeBatch() []jsonrpc.CodecRequest {
+	batch := []jsonrpc.CodecRequest{}
+	dec := json.NewDecoder(bytes.NewReader(c.body))
+	if _, err := dec.Token(); err != nil {
+		return batch
+	}
+	for dec.More() && (c.batchLimit <= 0 || len(batch) <= c.batchLimit) {
+		var element json.RawMessage
+		if err := dec.Decode(&element); err != nil {
+			break
+		}
+		// Responses of elements are buffered and encoded once for the batch.
+		batch = append(batch, parseRequest(element, jsonrpc.DefaultEncoder, c.codec, ErrInvalidRequest))
 	}
-	return &CodecRequest{request: req, err: err, encoder: encoder, body: body, dateTimeFormat: dateTimeFormat}
+	return batch
 }
 
-// CodecRequest decodes and encodes a single request.
+// CodecRequest decodes and encodes a single request, or a batch.
 type CodecRequest struct {
-	request        *serverRequest
-	err            error
-	encoder        jsonrpc.Encoder
-	body           []byte
-	dateTimeFormat string
+	request    *serverRequest
+	err        error
+	encoder    jsonrpc.Encoder
+	body       []byte
+	codec      *Codec
+	isBatch    bool
+	batch      []jsonrpc.CodecRequest // decoded by the first Requests
+	batchLimit int                    // decoding stops past it, unlimited if zero
+	strict     bool                   // unknown params fields are errors
+	version1   bool                   // accepted as a JSON-RPC 1.0 request
+
+	// Params decoded by the first ReadRequest.
+	params        interface{}
+	paramsDecoded bool
+
+	// Extra members decoded by the first Extra.
+	extra        map[string]json.RawMessage
+	extraDecoded bool
+}
+
+// IsNotification reports whether the request is a valid request without
+// an id member. A request with a null id is not a notification, unless it
+// is a JSON-RPC 1.0 request.
+func (c *CodecRequest) IsNotification() bool {
+	if c.version1 && c.err == nil && string(c.request.ID) == "null" {
+		return true
+	}
+	return c.err == nil && !c.isBatch && len(c.request.ID) == 0
+}
+
+// AllowVersion1 makes the codec accept the request if it is a JSON-RPC 1.0
+// one, without a jsonrpc member or with "1.0". It is then answered in the
+// JSON-RPC 1.0 format, with both result and error members and no jsonrpc
+// member, and a null id makes it a notification.
+func (c *CodecRequest) AllowVersion1() {
+	// Only the version check failed for decoded requests without a
+	// jsonrpc member or with "1.0".
+	if c.err == nil || c.isBatch || c.request.Method == "" ||
+		(c.request.Version != "" && c.request.Version != "1.0") {
+		return
+	}
+	c.version1 = true
+	c.err = preprocessParams(c.request, c.codec)
+}
+
+// ID returns the id of the request: a string, a json.Number, or nil for
+// notifications, null ids, batches and bodies that could not be decoded.
+func (c *CodecRequest) ID() interface{} {
+	if c.isBatch || len(c.request.ID) == 0 {
+		return nil
+	}
+	var id interface{}
+	d := json.NewDecoder(bytes.NewReader(c.request.ID))
+	d.UseNumber()
+	if d.Decode(&id) != nil {
+		return nil
+	}
+	return id
+}
+
+// RequestID returns the id of the request formatted by jsonrpc.FormatID,
+// empty for notifications and null ids.
+func (c *CodecRequest) RequestID() string {
+	return jsonrpc.FormatID(c.ID())
+}
+
+// DisallowUnknownFields makes ReadRequest fail on params fields the args
+// don't have.
+func (c *CodecRequest) DisallowUnknownFields() {
+	c.strict = true
+}
+
+// IsBatch reports whether the body holds a batch.
+func (c *CodecRequest) IsBatch() bool {
+	return c.isBatch
+}
+
+// LimitBatch makes Requests decode at most n+1 requests of a batch.
+func (c *CodecRequest) LimitBatch(n int) {
+	c.batchLimit = n
+}
+
+// Requests returns the requests of a batch, decoding them on first call.
+func (c *CodecRequest) Requests() []jsonrpc.CodecRequest {
+	if c.isBatch && c.batch == nil {
+		c.batch = c.decodeBatch()
+	}
+	return c.batch
+}
+
+// WriteBatch writes the responses of the batch requests as a JSON array.
+func (c *CodecRequest) WriteBatch(w http.ResponseWriter, responses [][]byte) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, res := range responses {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(bytes.TrimSpace(res))
+	}
+	buf.WriteString("]\n")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	ew := c.encoder.Encode(w)
+	w.WriteHeader(http.StatusOK)
+	ew.Write(buf.Bytes())
 }
 
 func (c *CodecRequest) Body() []byte {
 	return c.body
 }
 
+// Extra returns the members of the request object besides jsonrpc, method,
+// params and id, like a "meta" object some clients add, undecoded. It is
+// nil for batches and bodies that are not an object. The body is decoded
+// on first call only, so hooks may call it freely.
+func (c *CodecRequest) Extra() map[string]json.RawMessage {
+	if c.extraDecoded || c.isBatch {
+		return c.extra
+	}
+	c.extraDecoded = true
+
+	var members map[string]json.RawMessage
+	if err := c.codec.unmarshal(c.body, &members); err != nil {
+		return nil
+	}
+	for name := range members {
+		// Members are matched to the request fields case insensitively.
+		for _, known := range []string{"jsonrpc", "method", "params", "id"} {
+			if strings.EqualFold(name, known) {
+				delete(members, name)
+			}
+		}
+	}
+	c.extra = members
+	return c.extra
+}
+
 // Method returns the RPC method for the current request.
 //
 // The method uses a dotted notation as in "Service.Method".
@@ -141,17 +491,21 @@ func (c *CodecRequest) Method() (string, error) {
 	return "", c.err
 }
 
+// typeOfTime is the type of time.Time, decoded from strings.
+var typeOfTime = reflect.TypeOf(time.Time{})
+
 func (c *CodecRequest) decoder(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
-	if t == reflect.TypeOf(time.Time{}) && f == reflect.TypeOf("") {
+	if t == typeOfTime && f == reflect.TypeOf("") {
 		format := time.RFC3339
-		if c.dateTimeFormat != "" {
-			format = c.dateTimeFormat
+		if c.codec.dateTimeFormat != "" {
+			format = c.codec.dateTimeFormat
 		}
-		res, err := time.Parse(format, data.(string))
-		if err != nil {
-            return time.Time{}, nil
+		for _, layout := range append([]string{format}, c.codec.timeLayouts...) {
+			if res, err := time.Parse(layout, data.(string)); err == nil {
+				return res, nil
+			}
 		}
-        return res, nil
+		return nil, fmt.Errorf("expected type %s, got %q", t, data)
 	}
 	return data, nil
 }
@@ -170,29 +524,52 @@ func (c *CodecRequest) decoder(f reflect.Type, t reflect.Type, data interface{})
 // absence of expected names MAY result in an error being
 // generated. The names MUST match exactly, including
 // case, to the method's expected parameters.
+//
+// Members are matched against the fields of args, nested structs included,
+// by their json tags as with encoding/json, or by their ms tags when set.
+//
+// Params are copied verbatim when args is a *json.RawMessage.
+//
+// Missing or null params are not an error: args is left untouched, at its
+// zero value or its defaults, and the method is called. Members absent from
+// params leave their fields untouched too, so pointer fields stay nil and
+// tell an absent member from a zero one.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
 	if c.err == nil && c.request.Params != nil {
-		var data map[string]interface{}
-		if err := json.Unmarshal(*c.request.Params, &data); err != nil {
+		var data interface{}
+		raw, isRaw := args.(*json.RawMessage)
+		if c.codec.validateUTF8 && !utf8.Valid(*c.request.Params) {
+			c.err = &Error{
+				Code:    ErrInvalidRequest,
+				Message: "params must be valid UTF-8",
+			}
+		} else if isRaw {
+			*raw = append((*raw)[:0], *c.request.Params...)
+		} else if err := c.decodeParams(&data); err != nil {
 			c.err = &Error{
 				Code:    ErrInvalidRequest,
 				Message: err.Error(),
 				Data:    c.request.Params,
 			}
+		} else if data, err = structuredParams(data, args); err != nil {
+			c.err = err
 		} else {
 			decoder, _ := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
 				DecodeHook:       c.decoder,
 				TagName:          "ms",
 				Result:           args,
 				WeaklyTypedInput: false,
+				ErrorUnused:      c.strict,
+				MatchName:        matchName,
 			})
 
-			err := decoder.Decode(data)
+			err := decoder.Decode(jsonNames(data, reflect.TypeOf(args)))
 			if err != nil {
+				fields := fieldErrors(err)
 				c.err = &Error{
 					Code:    ErrBadParams,
-					Message: err.Error(),
-					Data:    c.request.Params,
+					Message: fields.Error(),
+					Data:    fields,
 				}
 			}
 		}
@@ -200,14 +577,286 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 	return c.err
 }
 
+// decodeParams decodes the params into data on first use only, so methods
+// taking several params args decode them once.
+func (c *CodecRequest) decodeParams(data *interface{}) error {
+	if !c.paramsDecoded {
+		if err := c.codec.unmarshal(*c.request.Params, &c.params); err != nil {
+			return err
+		}
+		c.paramsDecoded = true
+	}
+	*data = c.params
+	return nil
+}
+
+// structuredParams checks that params are an object or an array. Arrays
+// given for struct args are turned into an object, their elements being
+// mapped onto the exported fields of the struct in declaration order, those
+// of embedded structs in place.
+func structuredParams(params interface{}, args interface{}) (interface{}, error) {
+	switch params := params.(type) {
+	case map[string]interface{}:
+		return params, nil
+	case []interface{}:
+		t := reflect.TypeOf(args)
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return params, nil
+		}
+		var names []string
+		for _, field := range paramFields(t) {
+			if field.wire != "-" {
+				names = append(names, field.wire)
+			}
+		}
+		if len(params) != len(names) {
+			return nil, &Error{
+				Code:    ErrBadParams,
+				Message: fmt.Sprintf("expected %d params, got %d", len(names), len(params)),
+			}
+		}
+		object := make(map[string]interface{}, len(names))
+		for i, name := range names {
+			object[name] = params[i]
+		}
+		return object, nil
+	default:
+		return nil, &Error{
+			Code:    ErrInvalidRequest,
+			Message: "params must be an object or an array",
+		}
+	}
+}
+
+// paramField is a field of a struct params are decoded into.
+type paramField struct {
+	wire string       // name of the member in params
+	path []string     // names of the field for mapstructure, embedded structs first
+	t    reflect.Type // type of the field
+}
+
+// paramFields returns the exported fields of struct t in declaration order.
+// As with encoding/json, the fields of embedded structs without a tag name
+// are promoted in place of the embedded struct, unless a field of an outer
+// struct has the same wire name.
+func paramFields(t reflect.Type) []paramField {
+	fields := appendParamFields(nil, t, nil)
+	depth := make(map[string]int, len(fields))
+	for _, field := range fields {
+		if d, ok := depth[field.wire]; !ok || len(field.path) < d {
+			depth[field.wire] = len(field.path)
+		}
+	}
+	visible := fields[:0]
+	for _, field := range fields {
+		if len(field.path) == depth[field.wire] {
+			visible = append(visible, field)
+		}
+	}
+	return visible
+}
+
+// maxEmbedDepth bounds the promotion of the fields of embedded structs, which
+// may embed each other through pointers.
+const maxEmbedDepth = 8
+
+// appendParamFields appends the fields of struct t to fields, path being the
+// names of the structs t is embedded in.
+func appendParamFields(fields []paramField, t reflect.Type, path []string) []paramField {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("ms"), ",")[0]
+		wire := name
+		if name == "" {
+			name, wire = field.Name, field.Name
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+				wire = tag
+			} else if field.Anonymous && tag == "" {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Ptr {
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct && embedded != typeOfTime && len(path) < maxEmbedDepth {
+					fields = appendParamFields(fields, embedded, append(path[:len(path):len(path)], name))
+					continue
+				}
+			}
+		}
+		fields = append(fields, paramField{wire, append(path[:len(path):len(path)], name), field.Type})
+	}
+	return fields
+}
+
+// jsonNames returns params decoded for a value of type t with the members
+// of objects named after the json tags of the fields of t, nested ones
+// included, renamed to the names mapstructure expects. Fields with an ms
+// tag keep it as their wire name, untagged ones their Go name. Members of
+// the fields of embedded structs are moved into an object for the embedded
+// struct. Other members are left as they are, to be ignored or reported as
+// unknown.
+func jsonNames(data interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := data.(map[string]interface{})
+		if !ok || t == typeOfTime {
+			return data
+		}
+		targets := paramFields(t)
+
+		// Members match the wire names exactly or, like encoding/json does,
+		// case-insensitively.
+		renamed := make(map[string]interface{}, len(object))
+		for key, value := range object {
+			match, shadowed := -1, false
+			for i, target := range targets {
+				if target.wire == key {
+					match = i
+					break
+				}
+				if match < 0 && strings.EqualFold(target.wire, key) {
+					match = i
+				}
+				for _, name := range target.path {
+					shadowed = shadowed || name == key
+				}
+			}
+			if match < 0 {
+				// Go names of fields with another wire name, embedded
+				// structs included, are ignored as encoding/json does.
+				if !shadowed {
+					renamed[key] = value
+				}
+				continue
+			}
+			target := targets[match]
+			object := renamed
+			for _, name := range target.path[:len(target.path)-1] {
+				embedded, ok := object[name].(map[string]interface{})
+				if !ok {
+					embedded = make(map[string]interface{})
+					object[name] = embedded
+				}
+				object = embedded
+			}
+			object[target.path[len(target.path)-1]] = jsonNames(value, target.t)
+		}
+		return renamed
+	case reflect.Slice, reflect.Array:
+		array, ok := data.([]interface{})
+		if !ok {
+			return data
+		}
+		renamed := make([]interface{}, len(array))
+		for i, value := range array {
+			renamed[i] = jsonNames(value, t.Elem())
+		}
+		return renamed
+	case reflect.Map:
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			return data
+		}
+		renamed := make(map[string]interface{}, len(object))
+		for key, value := range object {
+			renamed[key] = jsonNames(value, t.Elem())
+		}
+		return renamed
+	}
+	return data
+}
+
+// matchName matches the members renamed by jsonNames to the names of the
+// fields exactly, so fields are only set through their wire names.
+func matchName(key, name string) bool {
+	return key == name
+}
+
+// fieldErrorRe splits a mapstructure error into field and message, those of
+// decode hooks included.
+var fieldErrorRe = regexp.MustCompile(`^(?:error decoding )?'([^']*)':? (.*)$`)
+
+// fieldErrors converts a params decoding error into field errors.
+func fieldErrors(err error) jsonrpc.FieldErrors {
+	msErr, ok := err.(*mapstructure.Error)
+	if !ok {
+		return jsonrpc.FieldErrors{{Code: "invalid", Message: err.Error()}}
+	}
+
+	fields := make(jsonrpc.FieldErrors, 0, len(msErr.Errors))
+	for _, e := range msErr.Errors {
+		field := jsonrpc.FieldError{Code: "invalid", Message: e}
+		if m := fieldErrorRe.FindStringSubmatch(e); m != nil {
+			field.Field, field.Message = m[1], m[2]
+		}
+		if strings.HasPrefix(field.Message, "expected type") {
+			field.Code = "type"
+		} else if strings.HasPrefix(field.Message, "has invalid keys: ") {
+			field.Code = "unknown"
+			field.Message = "unknown fields: " + strings.TrimPrefix(field.Message, "has invalid keys: ")
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
 // WriteResponse encodes the response and writes it to the ResponseWriter.
-func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+//
+// A reply that can't be encoded is answered with an internal error and the
+// encoding error is returned, as is any error writing the response.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) error {
 	res := &serverResponse{
 		Version: Version,
 		Result:  reply,
-		ID:      c.request.ID,
+		ID:      c.responseID(),
+	}
+	if warner, ok := reply.(Warner); ok && c.codec.warnings {
+		if warnings := warner.Warnings(); len(warnings) > 0 {
+			res.Meta = &responseMeta{Warnings: warnings}
+		}
+	}
+	if stream, ok := reply.(StreamCodec); ok && c.codec.envelope == nil && c.codec.decorate == nil && !c.version1 && len(c.request.ID) > 0 {
+		return c.streamServerResponse(w, stream, res)
+	}
+	return c.writeServerResponse(w, http.StatusOK, res)
+}
+
+// streamServerResponse writes res with the result written by stream.
+func (c *CodecRequest) streamServerResponse(w http.ResponseWriter, stream StreamCodec, res *serverResponse) error {
+	version, err := c.codec.marshal(res.Version)
+	if err != nil {
+		return err
+	}
+	// The members following the result, with the leading brace replaced.
+	tail, err := c.codec.marshal(struct {
+		ID   *json.RawMessage `json:"id"`
+		Meta *responseMeta    `json:"meta,omitempty"`
+	}{res.ID, res.Meta})
+	if err != nil {
+		return err
+	}
+	tail[0] = ','
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	ew := c.encoder.Encode(w)
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(ew, `{"jsonrpc":%s,"result":`, version); err != nil {
+		return err
+	}
+	if err := stream.WriteResult(ew); err != nil {
+		return err
 	}
-	c.writeServerResponse(w, res)
+	_, err = ew.Write(append(tail, '\n'))
+	return err
 }
 
 // WriteError send error response.
@@ -230,26 +879,99 @@ func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error)
 	res := &serverResponse{
 		Version: Version,
 		Error:   jsonErr,
-		ID:      c.request.ID,
+		ID:      c.responseID(),
 	}
 
-	c.writeServerResponse(w, res)
+	c.writeServerResponse(w, status, res)
 }
 
-func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, res *serverResponse) {
-	// Id is null for notifications and they don't have a response.
-	if c.request.ID != nil || (res.Error != nil && (res.Error.Code == ErrParse || res.Error.Code == ErrInvalidRequest)) {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		encoder := json.NewEncoder(c.encoder.Encode(w))
-		err := encoder.Encode(res)
-		// Not sure in which case will this happen. But seems harmless.
-		if err != nil {
-			jsonrpc.WriteError(w, 400, err.Error())
-		}
-	} else {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+// responseID returns the id of the response, null if the request has none.
+func (c *CodecRequest) responseID() *json.RawMessage {
+	if len(c.request.ID) == 0 {
+		return nil
+	}
+	return &c.request.ID
+}
+
+// writeServerResponse writes res, unless the request is a notification.
+func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, status int, res *serverResponse) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	// Id is absent for notifications and they don't have a response.
+	if len(c.request.ID) == 0 && (res.Error == nil || (res.Error.Code != ErrParse && res.Error.Code != ErrInvalidRequest)) {
 		w.Header().Set("Json-Rpc", "notify")
+		return nil
+	}
+
+	body, err := c.encodeResponse(res)
+	if err != nil {
+		// The reply or error data can't be encoded; an internal error can.
+		status = http.StatusInternalServerError
+		body, _ = c.encodeResponse(&serverResponse{
+			Version: Version,
+			Error:   &Error{Code: ErrInternal, Message: "rpc: " + err.Error()},
+			ID:      res.ID,
+		})
+		if body == nil {
+			jsonrpc.WriteError(w, status, err.Error())
+			return err
+		}
+	}
+
+	ew := c.encoder.Encode(w)
+	w.WriteHeader(status)
+	if _, errWrite := ew.Write(body); err == nil {
+		err = errWrite
+	}
+	return err
+}
+
+// encodeResponse encodes res, through the envelope and decorator of the
+// codec if any.
+func (c *CodecRequest) encodeResponse(res *serverResponse) ([]byte, error) {
+	var v interface{} = res
+	if c.codec.envelope != nil {
+		v = c.codec.envelope(res.Result, res.Error)
+	} else if c.version1 {
+		v = &serverResponseV1{Result: res.Result, Error: res.Error, ID: res.ID}
+	}
+	body, err := c.codec.marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if c.codec.decorate != nil {
+		if body, err = c.decorateResponse(body); err != nil {
+			return nil, err
+		}
+	}
+	return append(body, '\n'), nil
+}
+
+// decorateResponse returns the response object body with the members set
+// by the decorator of the codec, the standard ones left unchanged.
+func (c *CodecRequest) decorateResponse(body []byte) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if err := c.codec.unmarshal(body, &members); err != nil {
+		// Not an object, e.g. the value of an envelope.
+		return body, nil
+	}
+	standard := make(map[string]json.RawMessage)
+	for _, name := range []string{"jsonrpc", "result", "error", "id"} {
+		if value, ok := members[name]; ok {
+			standard[name] = value
+		}
+	}
+
+	decorated := c.codec.decorate(members)
+	if decorated == nil {
+		decorated = make(map[string]json.RawMessage)
+	}
+	for _, name := range []string{"jsonrpc", "result", "error", "id"} {
+		delete(decorated, name)
+	}
+	for name, value := range standard {
+		decorated[name] = value
 	}
+	return c.codec.marshal(decorated)
 }
 
 // EmptyResponse empty response
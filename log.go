@@ -0,0 +1,149 @@
+package jsonrpc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogLevel is the severity of a log entry.
+type LogLevel int
+
+// Log levels, from the least to the most severe.
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	default:
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// Logger writes the log entries of a server, see ServerLogger. kv holds
+// alternating keys and values.
+//
+// Loggers may also have an Enabled(level LogLevel) bool method, so the
+// server doesn't build entries of levels they would drop.
+type Logger interface {
+	Log(ctx context.Context, level LogLevel, msg string, kv ...interface{})
+}
+
+// levelEnabler is implemented by loggers dropping some levels.
+type levelEnabler interface {
+	Enabled(level LogLevel) bool
+}
+
+// NopLogger drops all entries.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(ctx context.Context, level LogLevel, msg string, kv ...interface{}) {}
+
+func (nopLogger) Enabled(level LogLevel) bool { return false }
+
+// NewStdLogger returns a Logger writing entries of level min and above to
+// l, one line each like
+//
+//	info rpc: request done method=Service1.Multiply id=1 duration=1.2ms
+func NewStdLogger(l *log.Logger, min LogLevel) Logger {
+	return &stdLogger{logger: l, min: min}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	min    LogLevel
+}
+
+func (l *stdLogger) Enabled(level LogLevel) bool {
+	return level >= l.min
+}
+
+func (l *stdLogger) Log(ctx context.Context, level LogLevel, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		value := fmt.Sprint(kv[i+1])
+		if strings.ContainsAny(value, " =\"") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %v=%s", kv[i], value)
+	}
+	l.logger.Output(2, b.String())
+}
+
+// ServerLogger makes the server log each request: its start at debug
+// level, then its end with the duration at info level, or its failure with
+// the error code at warn level for client errors and error level for
+// server ones. Entries have the method and the id of the request if any.
+//
+// The entries are written by hooks added as by ServerBefore and
+// ServerAfter, so they run in option order with the other hooks.
+func ServerLogger(l Logger) ServerOption {
+	return func(s *Server) {
+		enabled := func(level LogLevel) bool { return true }
+		if e, ok := l.(levelEnabler); ok {
+			enabled = e.Enabled
+		}
+		ServerBefore(func(ctx context.Context, method string, header http.Header, req CodecRequest) context.Context {
+			if enabled(LogDebug) {
+				l.Log(ctx, LogDebug, "rpc: request started", logFields(ctx, method)...)
+			}
+			return ctx
+		})(s)
+		ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			level := LogInfo
+			if err != nil {
+				level = LogWarn
+				if ErrorStatus(ErrorCodeOf(err)) >= 500 {
+					level = LogError
+				}
+			}
+			if !enabled(level) {
+				return
+			}
+			kv := logFields(ctx, method)
+			if info, ok := Info(ctx); ok {
+				kv = append(kv, "duration", time.Since(info.Start))
+			}
+			if err == nil {
+				l.Log(ctx, level, "rpc: request done", kv...)
+				return
+			}
+			kv = append(kv, "code", int(ErrorCodeOf(err)), "error", err.Error())
+			l.Log(ctx, level, "rpc: request failed", kv...)
+		})(s)
+	}
+}
+
+// logFields returns the method and id of the request, with room for more.
+func logFields(ctx context.Context, method string) []interface{} {
+	kv := make([]interface{}, 0, 8)
+	kv = append(kv, "method", method)
+	if id, ok := RequestID(ctx); ok {
+		kv = append(kv, "id", id)
+	}
+	return kv
+}
@@ -2,10 +2,14 @@ package jsonrpc
 
 import (
     "context"
+    "encoding/json"
     "fmt"
+    "net/http"
     "reflect"
+    "sort"
     "strings"
     "sync"
+    "sync/atomic"
     "unicode"
     "unicode/utf8"
 
@@ -16,12 +20,19 @@ var (
     // Precompute the reflect.Type of error and http.Request
     typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
     typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+    typeOfRequest = reflect.TypeOf((*http.Request)(nil)).Elem()
+
+    typeOfRawMessage = reflect.TypeOf(json.RawMessage(nil))
 )
 
 var (
     ErrRequestIllFormed = errors.New("service/method request ill-formed")
     ErrServiceNotFound  = errors.New("can't find service")
     ErrMethodNotFound   = errors.New("rpc: can't find method")
+
+    // ErrDuplicate is wrapped by the errors of registrations of services or
+    // methods already registered, see ServerOnDuplicate.
+    ErrDuplicate = errors.New("rpc: already defined")
 )
 
 // ----------------------------------------------------------------------------
@@ -29,16 +40,52 @@ var (
 // ----------------------------------------------------------------------------
 
 type service struct {
-    name     string                    // name of service
-    rcvr     reflect.Value             // receiver of methods for the service
-    rcvrType reflect.Type              // type of the receiver
-    methods  map[string]*serviceMethod // registered methods
+    name     string                      // name of service
+    rcvr     reflect.Value               // receiver of methods for the service
+    rcvrType reflect.Type                // type of the receiver
+    methods  map[string]*serviceMethod   // registered methods
+    factory  func() (interface{}, error) // builds rcvr on first use if set
+    mutex    sync.Mutex                  // protects rcvr of lazy services
+}
+
+// receiver returns the receiver of the methods, building it on first use
+// for lazily registered services. A failed build is retried on next use.
+func (s *service) receiver() (reflect.Value, error) {
+    if s.factory == nil {
+        return s.rcvr, nil
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if !s.rcvr.IsValid() {
+        rcvr, err := s.factory()
+        if err != nil {
+            return reflect.Value{}, err
+        }
+        if reflect.TypeOf(rcvr) != s.rcvrType {
+            return reflect.Value{}, fmt.Errorf("rpc: factory of %q returned %T, expected %s", s.name, rcvr, s.rcvrType)
+        }
+        s.rcvr = reflect.ValueOf(rcvr)
+    }
+    return s.rcvr, nil
 }
 
 type serviceMethod struct {
     method    reflect.Method // receiver method
     argsType  []reflect.Type // type of the request argument
     replyType reflect.Type   // type of the response argument
+    replyArg  bool           // whether the reply is the last arg rather than a result
+    dynamic   DynamicHandler // handler of a dynamic method, replaces method
+    fn        reflect.Value  // function registered as a method, replaces method
+    typed     *typedMethod   // method registered with RegisterTyped, replaces method
+}
+
+// typedMethod is a method whose args are decoded and passed without
+// reflection.
+type typedMethod struct {
+    read func(codecReq CodecRequest) (args interface{}, err error)
+    call func(ctx context.Context, args interface{}) (reply interface{}, err error)
 }
 
 // ----------------------------------------------------------------------------
@@ -47,68 +94,389 @@ type serviceMethod struct {
 
 // serviceMap is a registry for services.
 type serviceMap struct {
-    mutex    sync.Mutex
-    services map[string]*service
+    mutex     sync.RWMutex
+    services  map[string]*service
+    maxArgs   int    // maximum params args per method, unlimited if zero
+    separator string // between service and method names, "." if empty
+
+    // Full method names in lower case, when looked up ignoring case.
+    caseInsensitive bool
+    index           map[string]methodRef
+
+    aliases    map[string]string // target full names by alias
+    hasAliases int32             // set atomically once an alias is added
+
+    duplicates DuplicatePolicy // what registering a known name does
+}
+
+// methodRef is a method in the case-insensitive index.
+type methodRef struct {
+    service, method string
+}
+
+// empty returns a new registry with the same settings and no services.
+func (m *serviceMap) empty() *serviceMap {
+    return &serviceMap{maxArgs: m.maxArgs, separator: m.separator, caseInsensitive: m.caseInsensitive, duplicates: m.duplicates}
 }
 
 // register adds a new service using reflection to extract its methods.
 func (m *serviceMap) register(rcvr interface{}, name string) error {
+    s, err := m.newService(rcvr, name)
+    if err != nil {
+        return err
+    }
+    return m.add(s)
+}
+
+// registerAll adds services using reflection to extract their methods, with
+// names inferred from their types. Either all of them are added or none.
+func (m *serviceMap) registerAll(rcvrs []interface{}) error {
+    services := make([]*service, len(rcvrs))
+    for i, rcvr := range rcvrs {
+        s, err := m.newService(rcvr, "")
+        if err != nil {
+            return err
+        }
+        services[i] = s
+    }
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    names := make(map[string]bool, len(services))
+    var added, replaced []*service
+    for _, s := range services {
+        if err := m.checkName(s.name); err != nil {
+            return err
+        }
+        if names[s.name] {
+            return fmt.Errorf("%w: service %q", ErrDuplicate, s.name)
+        }
+        names[s.name] = true
+        if existing, ok := m.services[s.name]; ok {
+            switch m.duplicates {
+            case DuplicateIgnore:
+                continue
+            case DuplicateOverride:
+                replaced = append(replaced, existing)
+            default:
+                return m.duplicateError(existing, s)
+            }
+        }
+        added = append(added, s)
+    }
+    for _, s := range replaced {
+        m.unindex(s)
+    }
+    if err := m.indexMethods(added...); err != nil {
+        m.indexMethods(replaced...)
+        return err
+    }
+
+    if m.services == nil {
+        m.services = make(map[string]*service)
+    }
+    for _, s := range added {
+        m.services[s.name] = s
+    }
+
+    return nil
+}
+
+// registerLazy adds a new service whose receiver is built by factory on
+// first use. The methods are extracted from the type of sample.
+func (m *serviceMap) registerLazy(sample interface{}, name string, factory func() (interface{}, error)) error {
+    s, err := m.newService(sample, name)
+    if err != nil {
+        return err
+    }
+    s.rcvr = reflect.Value{}
+    s.factory = factory
+    return m.add(s)
+}
+
+// newService builds a service using reflection to extract its methods.
+func (m *serviceMap) newService(rcvr interface{}, name string) (*service, error) {
     s := &service{
         name:     name,
         rcvr:     reflect.ValueOf(rcvr),
         rcvrType: reflect.TypeOf(rcvr),
         methods:  make(map[string]*serviceMethod),
     }
+    if s.rcvrType == nil {
+        return nil, fmt.Errorf("rpc: no receiver for service %q", name)
+    }
     if name == "" {
-        s.name = reflect.Indirect(s.rcvr).Type().Name()
+        t := s.rcvrType
+        if t.Kind() == reflect.Ptr {
+            t = t.Elem()
+        }
+        s.name = t.Name()
         if !isExported(s.name) {
-            return fmt.Errorf("rpc: type %q is not exported", s.name)
+            return nil, fmt.Errorf("rpc: type %q is not exported", s.name)
         }
     }
     if s.name == "" {
-        return fmt.Errorf("rpc: no service name for type %q", s.rcvrType.String())
+        return nil, fmt.Errorf("rpc: no service name for type %q", s.rcvrType.String())
+    }
+    var names map[string]string
+    if namer, ok := rcvr.(RPCNamer); ok {
+        names = namer.RPCNames()
+    }
+    for goName, name := range names {
+        method, ok := s.rcvrType.MethodByName(goName)
+        if !ok || method.PkgPath != "" {
+            return nil, fmt.Errorf("rpc: RPCNames of %q names unknown method %q", s.name, goName)
+        }
+        if name == "" || strings.Contains(name, m.methodSeparator()) {
+            return nil, fmt.Errorf("rpc: RPC name %q of method %q is empty or contains the method separator %q", name, s.name+"."+goName, m.methodSeparator())
+        }
+        if _, ok := methodSignature(method.Type, 1); !ok {
+            return nil, fmt.Errorf("rpc: method %q is not of suitable type", s.name+"."+goName)
+        }
     }
     for i := 0; i < s.rcvrType.NumMethod(); i++ {
         method := s.rcvrType.Method(i)
         mtype := method.Type
 
-        // Method must be exported.
+        name, renamed := names[method.Name]
+        if !renamed {
+            name = method.Name
+        }
+        // Method must be exported, and reachable with the separator.
+        if method.PkgPath != "" || strings.Contains(name, m.methodSeparator()) {
+            continue
+        }
+
+        spec, ok := methodSignature(mtype, 1)
+        if !ok {
+            continue
+        }
+        if n := countParamsArgs(spec.argsType); m.maxArgs > 0 && n > m.maxArgs {
+            return nil, fmt.Errorf("rpc: method %q has %d arguments, at most %d allowed", s.name+"."+name, n, m.maxArgs)
+        }
+        if err := checkHeaderArgs(spec.argsType); err != nil {
+            return nil, fmt.Errorf("rpc: method %q: %v", s.name+"."+name, err)
+        }
+        if _, ok := s.methods[name]; ok {
+            return nil, fmt.Errorf("rpc: method already defined: %q", s.name+"."+name)
+        }
+        spec.method = method
+        s.methods[name] = spec
+    }
+
+    if len(s.methods) == 0 {
+        return nil, fmt.Errorf("rpc: %q has no exported methods of suitable type", s.name)
+    }
+
+    return s, nil
+}
+
+// registerInterface adds a new service made of the methods of an interface,
+// given as a pointer to it, called on impl.
+func (m *serviceMap) registerInterface(iface interface{}, impl interface{}, name string) error {
+    ifaceType := reflect.TypeOf(iface)
+    if ifaceType == nil || ifaceType.Kind() != reflect.Ptr || ifaceType.Elem().Kind() != reflect.Interface {
+        return fmt.Errorf("rpc: %T is not a pointer to an interface", iface)
+    }
+    ifaceType = ifaceType.Elem()
+
+    implValue := reflect.ValueOf(impl)
+    if !implValue.IsValid() || !implValue.Type().Implements(ifaceType) {
+        return fmt.Errorf("rpc: %T does not implement %s", impl, ifaceType)
+    }
+
+    if name == "" {
+        name = ifaceType.Name()
+        if !isExported(name) {
+            return fmt.Errorf("rpc: type %q is not exported", name)
+        }
+    }
+
+    s := &service{
+        name:     name,
+        rcvr:     implValue,
+        rcvrType: ifaceType,
+        methods:  make(map[string]*serviceMethod),
+    }
+    for i := 0; i < ifaceType.NumMethod(); i++ {
+        method := ifaceType.Method(i)
+
+        // Unexported methods of the interface are not exposed.
         if method.PkgPath != "" {
             continue
         }
 
-        var args []reflect.Type
+        if strings.Contains(method.Name, m.methodSeparator()) {
+            return fmt.Errorf("rpc: method %q contains the method separator %q", method.Name, m.methodSeparator())
+        }
+        spec, ok := methodSignature(method.Type, 0)
+        if !ok {
+            return fmt.Errorf("rpc: method %q is not of suitable type", name+"."+method.Name)
+        }
+        if n := countParamsArgs(spec.argsType); m.maxArgs > 0 && n > m.maxArgs {
+            return fmt.Errorf("rpc: method %q has %d arguments, at most %d allowed", name+"."+method.Name, n, m.maxArgs)
+        }
+        if err := checkHeaderArgs(spec.argsType); err != nil {
+            return fmt.Errorf("rpc: method %q: %v", name+"."+method.Name, err)
+        }
+        spec.fn = implValue.MethodByName(method.Name)
+        s.methods[method.Name] = spec
+    }
 
-        numIn := mtype.NumIn()
+    if len(s.methods) == 0 {
+        return fmt.Errorf("rpc: %q has no exported methods", name)
+    }
 
-        for i := 1; i < numIn; i++ {
-            arg := mtype.In(i)
-            if arg.Kind() != reflect.Interface && (arg.Kind() != reflect.Ptr || !isExportedOrBuiltin(arg)) {
-                continue
-            }
-            if arg.Kind() != typeOfContext.Kind() {
-                arg = arg.Elem()
+    return m.add(s)
+}
+
+// registerFunc adds a function as a method given its full name.
+func (m *serviceMap) registerFunc(name string, fn interface{}) error {
+    value := reflect.ValueOf(fn)
+    if value.Kind() != reflect.Func || value.IsNil() {
+        return fmt.Errorf("rpc: %q is not a function", name)
+    }
+    spec, ok := methodSignature(value.Type(), 0)
+    if !ok {
+        return fmt.Errorf("rpc: function %q is not of suitable type", name)
+    }
+    if n := countParamsArgs(spec.argsType); m.maxArgs > 0 && n > m.maxArgs {
+        return fmt.Errorf("rpc: method %q has %d arguments, at most %d allowed", name, n, m.maxArgs)
+    }
+    if err := checkHeaderArgs(spec.argsType); err != nil {
+        return fmt.Errorf("rpc: method %q: %v", name, err)
+    }
+    spec.fn = value
+    return m.addMethod(name, spec)
+}
+
+// addMethod adds a method given its full name. Methods can only be added to
+// services made of functions, typed or dynamic methods.
+func (m *serviceMap) addMethod(name string, method *serviceMethod) error {
+    separator := m.methodSeparator()
+    parts := strings.Split(name, separator)
+    if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+        return fmt.Errorf("rpc: method name %q is not of the form \"Service%sMethod\"", name, separator)
+    }
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    // Services are read without locking, so the new method goes into a copy.
+    s := &service{name: parts[0], methods: make(map[string]*serviceMethod)}
+    if existing, ok := m.services[parts[0]]; ok {
+        if _, ok := existing.methods[parts[1]]; ok {
+            switch m.duplicates {
+            case DuplicateIgnore:
+                return nil
+            case DuplicateOverride:
+            default:
+                return fmt.Errorf("%w: method %q", ErrDuplicate, name)
             }
-            args = append(args, arg)
+        } else if existing.rcvrType != nil {
+            return fmt.Errorf("rpc: service already defined: %q", parts[0])
         }
-        if numIn-1 != len(args) {
-            continue
+        s.rcvr, s.rcvrType, s.factory = existing.rcvr, existing.rcvrType, existing.factory
+        for methodName, method := range existing.methods {
+            s.methods[methodName] = method
         }
-        // Method needs two out: mixed, error.
-        if mtype.NumOut() != 2 {
+    }
+    s.methods[parts[1]] = method
+    if err := m.indexMethods(s); err != nil {
+        return err
+    }
+
+    if m.services == nil {
+        m.services = make(map[string]*service)
+    }
+    m.services[s.name] = s
+
+    return nil
+}
+
+// methodSignature returns the spec of a method or function, args and reply,
+// skipping the first args, and whether its signature is suitable: args are
+// context.Context, interface{} or pointers to exported or builtin types,
+// and results are a reply and an error. interface{} args get a pointer to
+// the decoded params. Any of the args may be left out. Methods with
+// an error as only result take a pointer to their reply as last arg
+// instead, filled by the method, like
+// func(r *http.Request, args *Args, reply *[]string) error.
+func methodSignature(mtype reflect.Type, first int) (*serviceMethod, bool) {
+    var args []reflect.Type
+
+    numIn := mtype.NumIn()
+
+    for i := first; i < numIn; i++ {
+        arg := mtype.In(i)
+        switch {
+        case arg == typeOfContext:
+        case arg.Kind() == reflect.Interface && arg.NumMethod() == 0:
+            // Other interfaces can't hold the pointer to the params.
+        case arg.Kind() == reflect.Ptr && isExportedOrBuiltin(arg):
+            arg = arg.Elem()
+        default:
             continue
         }
-        if returnType := mtype.Out(1); returnType != typeOfError {
-            continue
+        args = append(args, arg)
+    }
+    if numIn-first != len(args) {
+        return nil, false
+    }
+    if mtype.NumOut() == 0 || mtype.Out(mtype.NumOut()-1) != typeOfError {
+        return nil, false
+    }
+    switch mtype.NumOut() {
+    case 2:
+        // Method returns mixed, error.
+        return &serviceMethod{argsType: args, replyType: mtype.Out(0)}, true
+    case 1:
+        // Method fills its last arg and returns error.
+        if len(args) == 0 {
+            return nil, false
+        }
+        reply := args[len(args)-1]
+        if !isParamsArg(reply) {
+            return nil, false
+        }
+        return &serviceMethod{argsType: args[:len(args)-1], replyType: reply, replyArg: true}, true
+    default:
+        return nil, false
+    }
+}
+
+// registerDynamic adds a new service made of handlers known only at runtime.
+func (m *serviceMap) registerDynamic(name string, methods []DynamicMethod) error {
+    if name == "" {
+        return fmt.Errorf("rpc: no service name for dynamic service")
+    }
+    s := &service{
+        name:    name,
+        methods: make(map[string]*serviceMethod),
+    }
+    for _, method := range methods {
+        if method.Name == "" || method.Handler == nil {
+            return fmt.Errorf("rpc: dynamic method of %q needs a name and a handler", name)
         }
-        s.methods[method.Name] = &serviceMethod{
-            method:   method,
-            argsType: args,
+        if _, ok := s.methods[method.Name]; ok {
+            return fmt.Errorf("rpc: method already defined: %q", name+"."+method.Name)
         }
+        s.methods[method.Name] = &serviceMethod{dynamic: method.Handler}
     }
 
     if len(s.methods) == 0 {
-        return fmt.Errorf("rpc: %q has no exported methods of suitable type", s.name)
+        return fmt.Errorf("rpc: %q has no methods", name)
+    }
+
+    return m.add(s)
+}
+
+// add stores a service, refusing to replace one with the same name or one
+// whose name can't be told from the method name in requests.
+func (m *serviceMap) add(s *service) error {
+    if err := m.checkName(s.name); err != nil {
+        return err
     }
 
     m.mutex.Lock()
@@ -117,8 +485,23 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
 
     if m.services == nil {
         m.services = make(map[string]*service)
-    } else if _, ok := m.services[s.name]; ok {
-        return fmt.Errorf("rpc: service already defined: %q", s.name)
+    }
+    existing, ok := m.services[s.name]
+    if ok {
+        switch m.duplicates {
+        case DuplicateIgnore:
+            return nil
+        case DuplicateOverride:
+            m.unindex(existing)
+        default:
+            return m.duplicateError(existing, s)
+        }
+    }
+    if err := m.indexMethods(s); err != nil {
+        if ok {
+            m.indexMethods(existing)
+        }
+        return err
     }
 
     m.services[s.name] = s
@@ -126,24 +509,174 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
     return nil
 }
 
+// duplicateError returns the error of registering s while existing has its
+// name, naming a method of both if any.
+func (m *serviceMap) duplicateError(existing, s *service) error {
+    var common []string
+    for name := range s.methods {
+        if _, ok := existing.methods[name]; ok {
+            common = append(common, name)
+        }
+    }
+    if len(common) == 0 {
+        return fmt.Errorf("%w: service %q", ErrDuplicate, s.name)
+    }
+    sort.Strings(common)
+    return fmt.Errorf("%w: method %q", ErrDuplicate, s.name+m.methodSeparator()+common[0])
+}
+
+// unindex removes the methods of a replaced service from the
+// case-insensitive index.
+func (m *serviceMap) unindex(s *service) {
+    for name := range s.methods {
+        key := strings.ToLower(s.name + m.methodSeparator() + name)
+        if m.index[key] == (methodRef{s.name, name}) {
+            delete(m.index, key)
+        }
+    }
+}
+
+// checkName refuses service names containing the method separator, whose
+// methods couldn't be told apart in requests.
+func (m *serviceMap) checkName(name string) error {
+    if strings.Contains(name, m.methodSeparator()) {
+        return fmt.Errorf("rpc: service name %q contains the method separator %q", name, m.methodSeparator())
+    }
+    return nil
+}
+
+// indexMethods adds the methods of services to the case-insensitive index,
+// if used. Nothing is added if a full method name is an alias or differs
+// only by case from another method or alias. The caller holds the lock.
+func (m *serviceMap) indexMethods(services ...*service) error {
+    added := make(map[string]methodRef)
+    for _, s := range services {
+        for name := range s.methods {
+            fullName := s.name + m.methodSeparator() + name
+            if _, ok := m.aliases[fullName]; ok {
+                return fmt.Errorf("rpc: method %q is already an alias", fullName)
+            }
+            if !m.caseInsensitive {
+                continue
+            }
+            key := strings.ToLower(fullName)
+            other, ok := added[key]
+            if !ok {
+                other, ok = m.index[key]
+            }
+            if ok && other != (methodRef{s.name, name}) {
+                return fmt.Errorf("rpc: method %q differs only by case from %q", fullName, other.service+m.methodSeparator()+other.method)
+            }
+            added[key] = methodRef{s.name, name}
+        }
+    }
+
+    if len(added) > 0 && m.index == nil {
+        m.index = make(map[string]methodRef)
+    }
+    for key, ref := range added {
+        m.index[key] = ref
+    }
+    return nil
+}
+
+// alias makes alias resolve to the target method.
+func (m *serviceMap) alias(alias, target string) error {
+    separator := m.methodSeparator()
+    parts := strings.Split(alias, separator)
+    if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+        return fmt.Errorf("rpc: method name %q is not of the form \"Service%sMethod\"", alias, separator)
+    }
+    // Aliases of aliases resolve to the final target.
+    target = m.canonical(target)
+    if _, _, err := m.get(target); err != nil {
+        return fmt.Errorf("rpc: can't alias %q to %q: %v", alias, target, err)
+    }
+    targetParts := strings.SplitN(target, separator, 2)
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if s, ok := m.services[parts[0]]; ok && s.methods[parts[1]] != nil {
+        return fmt.Errorf("rpc: alias %q is already a method", alias)
+    }
+    if _, ok := m.aliases[alias]; ok {
+        return fmt.Errorf("rpc: alias already defined: %q", alias)
+    }
+    if m.caseInsensitive {
+        key := strings.ToLower(alias)
+        if other, ok := m.index[key]; ok {
+            return fmt.Errorf("rpc: alias %q differs only by case from %q", alias, other.service+separator+other.method)
+        }
+        m.index[key] = methodRef{targetParts[0], targetParts[1]}
+    }
+
+    if m.aliases == nil {
+        m.aliases = make(map[string]string)
+        atomic.StoreInt32(&m.hasAliases, 1)
+    }
+    m.aliases[alias] = target
+    return nil
+}
+
+// canonical returns the registered name of method: the target of an alias,
+// or the name differing by case when case is ignored. Other methods are
+// returned as is.
+func (m *serviceMap) canonical(method string) string {
+    // Spare the lock when neither feature is in use, the common case.
+    if !m.caseInsensitive && atomic.LoadInt32(&m.hasAliases) == 0 {
+        return method
+    }
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    if m.caseInsensitive {
+        if ref, ok := m.index[strings.ToLower(method)]; ok {
+            return ref.service + m.methodSeparator() + ref.method
+        }
+        return method
+    }
+    if target, ok := m.aliases[method]; ok {
+        return target
+    }
+    return method
+}
+
+// aliasTargets returns a copy of the aliases and their targets.
+func (m *serviceMap) aliasTargets() map[string]string {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    aliases := make(map[string]string, len(m.aliases))
+    for alias, target := range m.aliases {
+        aliases[alias] = target
+    }
+    return aliases
+}
+
 // get returns a registered service given a method name.
 //
-// The method name uses a dotted notation as in "Service.Method".
+// The method name uses a dotted notation as in "Service.Method", unless
+// another separator is set. Case is ignored if the index is used.
 func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
-    parts := strings.Split(method, ".")
-    if len(parts) != 2 {
+    method = m.canonical(method)
+    separator := m.methodSeparator()
+
+    // Split by hand, as this runs on every request.
+    i := strings.Index(method, separator)
+    if i < 0 || strings.Contains(method[i+len(separator):], separator) {
         return nil, nil, ErrRequestIllFormed
     }
 
-    m.mutex.Lock()
-    service := m.services[parts[0]]
-    m.mutex.Unlock()
+    m.mutex.RLock()
+    service := m.services[method[:i]]
+    m.mutex.RUnlock()
 
     if service == nil {
         return nil, nil, ErrServiceNotFound
     }
 
-    serviceMethod := service.methods[parts[1]]
+    serviceMethod := service.methods[method[i+len(separator):]]
     if serviceMethod == nil {
         return nil, nil, ErrMethodNotFound
     }
@@ -151,6 +684,52 @@ func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
     return service, serviceMethod, nil
 }
 
+// methodSeparator returns the separator between service and method names.
+func (m *serviceMap) methodSeparator() string {
+    if m.separator == "" {
+        return "."
+    }
+    return m.separator
+}
+
+// countParamsArgs returns the number of args decoded from the request
+// params, that is all but context.Context, *http.Request and header args.
+func countParamsArgs(args []reflect.Type) int {
+    n := 0
+    for _, arg := range args {
+        if isParamsArg(arg) {
+            n++
+        }
+    }
+    return n
+}
+
+// names returns the full names of all registered methods, unsorted.
+func (m *serviceMap) names() []string {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    var names []string
+    for _, s := range m.services {
+        for name := range s.methods {
+            names = append(names, s.name+m.methodSeparator()+name)
+        }
+    }
+    return names
+}
+
+// count returns the number of registered methods.
+func (m *serviceMap) count() int {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    n := 0
+    for _, s := range m.services {
+        n += len(s.methods)
+    }
+    return n
+}
+
 // isExported returns true of a string is an exported (upper case) name.
 func isExported(name string) bool {
     rune, _ := utf8.DecodeRuneInString(name)
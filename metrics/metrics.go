@@ -0,0 +1,109 @@
+// Package metrics records Prometheus metrics of the requests served by a
+// jsonrpc.Server.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/devimteam/jsonrpc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// unknownMethod is the method label of requests for methods that are not
+// registered, so clients can't grow the number of series.
+const unknownMethod = "unknown"
+
+// Outcomes of a request, as the outcome label of the latency histogram.
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+)
+
+type contextKey int
+
+const startKey contextKey = 0
+
+// collectors are the metrics shared by the servers using a registerer.
+type collectors struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// WithMetrics returns a server option recording, for each request:
+//
+//   - jsonrpc_requests_total, by method;
+//   - jsonrpc_errors_total, by method and JSON-RPC error code;
+//   - jsonrpc_request_duration_seconds, by method and outcome.
+//
+// The method label is the name of a registered method, or "unknown". Each
+// element of a batch is a request of its own. The metrics are registered
+// with registerer, prometheus.DefaultRegisterer if nil; servers sharing a
+// registerer share the metrics. It panics if other metrics with the same
+// names are registered.
+func WithMetrics(registerer prometheus.Registerer) jsonrpc.ServerOption {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	c := &collectors{
+		requests: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "jsonrpc",
+			Name:      "requests_total",
+			Help:      "Number of JSON-RPC requests, by method.",
+		}, []string{"method"})).(*prometheus.CounterVec),
+		errors: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "jsonrpc",
+			Name:      "errors_total",
+			Help:      "Number of JSON-RPC requests that failed, by method and error code.",
+		}, []string{"method", "code"})).(*prometheus.CounterVec),
+		duration: register(registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "jsonrpc",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to serve JSON-RPC requests, by method and outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "outcome"})).(*prometheus.HistogramVec),
+	}
+
+	return func(s *jsonrpc.Server) {
+		jsonrpc.ServerBefore(c.before)(s)
+		jsonrpc.ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			if !s.HasMethod(method) {
+				method = unknownMethod
+			}
+			c.after(ctx, method, err)
+		})(s)
+	}
+}
+
+// register registers collector, or returns the one already registered in
+// its place.
+func register(registerer prometheus.Registerer, collector prometheus.Collector) prometheus.Collector {
+	if err := registerer.Register(collector); err != nil {
+		if existing, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return existing.ExistingCollector
+		}
+		panic(err)
+	}
+	return collector
+}
+
+func (c *collectors) before(ctx context.Context, method string, header http.Header, req jsonrpc.CodecRequest) context.Context {
+	return context.WithValue(ctx, startKey, time.Now())
+}
+
+func (c *collectors) after(ctx context.Context, method string, err error) {
+	c.requests.WithLabelValues(method).Inc()
+
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeError
+		c.errors.WithLabelValues(method, strconv.Itoa(int(jsonrpc.ErrorCodeOf(err)))).Inc()
+	}
+
+	if start, ok := ctx.Value(startKey).(time.Time); ok {
+		c.duration.WithLabelValues(method, outcome).Observe(time.Since(start).Seconds())
+	}
+}
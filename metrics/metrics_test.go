@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devimteam/jsonrpc"
+	"github.com/devimteam/jsonrpc/json2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type Service1Request struct {
+	A int
+	B int
+}
+
+type Service1 struct {
+}
+
+func (t *Service1) Multiply(req *Service1Request) (int, error) {
+	return req.A * req.B, nil
+}
+
+func (t *Service1) Fail(req *Service1Request) (int, error) {
+	return 0, jsonrpc.NewError(jsonrpc.CodeBadParams, "no")
+}
+
+// counter returns the value of the counter or histogram sample count of
+// the metric called name with labels, zero if there is none.
+func counter(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if labels[pair.GetName()] != pair.GetValue() {
+					continue metrics
+				}
+			}
+			return value(metric)
+		}
+	}
+	return 0
+}
+
+func value(metric *dto.Metric) float64 {
+	if metric.Histogram != nil {
+		return float64(metric.Histogram.GetSampleCount())
+	}
+	return metric.Counter.GetValue()
+}
+
+func TestWithMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := jsonrpc.NewServer(WithMetrics(registry))
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `[
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 2, "B": 3}, "id": 1},
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 5}, "id": 2},
+		{"jsonrpc": "2.0", "method": "Service1.Fail", "params": {}, "id": 3},
+		{"jsonrpc": "2.0", "method": "Service1.Nope", "id": 4},
+		{"jsonrpc": "2.0", "method": "Random.Name", "id": 5}
+	]`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"jsonrpc_requests_total", map[string]string{"method": "Service1.Multiply"}, 2},
+		{"jsonrpc_requests_total", map[string]string{"method": "Service1.Fail"}, 1},
+		{"jsonrpc_requests_total", map[string]string{"method": "unknown"}, 2},
+		{"jsonrpc_requests_total", map[string]string{"method": "Random.Name"}, 0},
+		{"jsonrpc_errors_total", map[string]string{"method": "Service1.Fail", "code": "-32602"}, 1},
+		{"jsonrpc_errors_total", map[string]string{"method": "unknown", "code": "-32601"}, 2},
+		{"jsonrpc_errors_total", map[string]string{"method": "Service1.Multiply"}, 0},
+		{"jsonrpc_request_duration_seconds", map[string]string{"method": "Service1.Multiply", "outcome": "success"}, 2},
+		{"jsonrpc_request_duration_seconds", map[string]string{"method": "Service1.Fail", "outcome": "error"}, 1},
+	}
+	for _, test := range tests {
+		if got := counter(t, registry, test.name, test.labels); got != test.want {
+			t.Errorf("%s%v = %v, want %v", test.name, test.labels, got, test.want)
+		}
+	}
+
+	// A second server shares the metrics of the registerer.
+	jsonrpc.NewServer(WithMetrics(registry))
+}
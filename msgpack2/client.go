@@ -0,0 +1,65 @@
+package msgpack2
+
+import (
+	"io"
+	"math/rand"
+
+	"github.com/devimteam/jsonrpc"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// clientRequest represents a JSON-RPC request sent by a client, encoded
+// with msgpack.
+type clientRequest struct {
+	// JSON-RPC protocol.
+	Version string `msgpack:"jsonrpc"`
+
+	// A String containing the name of the method to be invoked.
+	Method string `msgpack:"method"`
+
+	// Object to pass as request parameter to the method.
+	Params interface{} `msgpack:"params"`
+
+	// The request id, used to match the response with the request.
+	ID uint64 `msgpack:"id"`
+}
+
+// clientResponse represents a JSON-RPC response returned to a client,
+// encoded with msgpack.
+type clientResponse struct {
+	Version string             `msgpack:"jsonrpc"`
+	Result  msgpack.RawMessage `msgpack:"result"`
+	Error   *errorObject       `msgpack:"error"`
+	ID      msgpack.RawMessage `msgpack:"id"`
+}
+
+// EncodeClientRequest encodes parameters for a JSON-RPC client request.
+func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
+	return msgpack.Marshal(&clientRequest{
+		Version: Version,
+		Method:  method,
+		Params:  args,
+		ID:      uint64(rand.Int63()),
+	})
+}
+
+// DecodeClientResponse decodes the response body of a client request into
+// the interface reply. It returns the error sent by the server as a
+// *jsonrpc.Error.
+func DecodeClientResponse(r io.Reader, reply interface{}) error {
+	var c clientResponse
+
+	if err := msgpack.NewDecoder(r).Decode(&c); err != nil {
+		return err
+	}
+
+	if c.Error != nil {
+		return &jsonrpc.Error{Code: c.Error.Code, Message: c.Error.Message, Data: c.Error.Data}
+	}
+
+	return msgpack.Unmarshal(c.Result, reply)
+}
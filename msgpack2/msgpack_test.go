@@ -0,0 +1,150 @@
+package msgpack2
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devimteam/jsonrpc"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var ErrResponseError = errors.New("response error")
+
+type Service1Request struct {
+	A int
+	B int
+}
+
+type Service1Response struct {
+	Result int
+}
+
+type Service1 struct {
+}
+
+func (t *Service1) Multiply(req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{Result: req.A * req.B}, nil
+}
+
+func (t *Service1) ResponseError(req *Service1Request) (*Service1Response, error) {
+	return nil, ErrResponseError
+}
+
+func newServer(t *testing.T) *jsonrpc.Server {
+	s := jsonrpc.NewServer()
+	s.RegisterCodec(NewCodec(), ContentType)
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func serve(s *jsonrpc.Server, body []byte) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", ContentType)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func execute(t *testing.T, s *jsonrpc.Server, method string, req, res interface{}) error {
+	buf, err := EncodeClientRequest(method, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(s, buf)
+	if ct := w.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, ContentType)
+	}
+	return DecodeClientResponse(w.Body, res)
+}
+
+func TestService(t *testing.T) {
+	s := newServer(t)
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	err := execute(t, s, "Service1.ResponseError", &Service1Request{4, 2}, &res)
+	if jsonErr, ok := err.(*jsonrpc.Error); !ok || jsonErr.Code != jsonrpc.CodeServer || jsonErr.Message != ErrResponseError.Error() {
+		t.Errorf("Wrong error: %#v.", err)
+	}
+
+	err = execute(t, s, "Service1.Missing", &Service1Request{4, 2}, &res)
+	if jsonErr, ok := err.(*jsonrpc.Error); !ok || jsonErr.Code != jsonrpc.CodeMethodNotFound {
+		t.Errorf("Wrong error: %#v.", err)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	s := newServer(t)
+
+	tests := []struct {
+		name string
+		body interface{}
+		code jsonrpc.ErrorCode
+	}{
+		{"parse", "\xc1", jsonrpc.CodeParse},
+		{"version", map[string]interface{}{"jsonrpc": "1.0", "method": "Service1.Multiply", "id": 1}, jsonrpc.CodeInvalidRequest},
+		{"params", map[string]interface{}{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": "x", "id": 1}, jsonrpc.CodeBadParams},
+	}
+	for _, test := range tests {
+		body, ok := test.body.(string)
+		if !ok {
+			b, _ := msgpack.Marshal(test.body)
+			body = string(b)
+		}
+
+		var res Service1Response
+		err := DecodeClientResponse(serve(s, []byte(body)).Body, &res)
+		if jsonErr, ok := err.(*jsonrpc.Error); !ok || jsonErr.Code != test.code {
+			t.Errorf("%s: wrong error: %#v.", test.name, err)
+		}
+	}
+}
+
+func TestNotification(t *testing.T) {
+	s := newServer(t)
+
+	body, _ := msgpack.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "Service1.Multiply",
+		"params":  &Service1Request{4, 2},
+	})
+	w := serve(s, body)
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("Expected an empty 204 response, got %d %q.", w.Code, w.Body.String())
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for _, tc := range []struct {
+		id   interface{}
+		want string
+	}{
+		{"abc", "abc"},
+		{12, "12"},
+		{nil, ""},
+	} {
+		body, _ := msgpack.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "Service1.Multiply",
+			"id":      tc.id,
+		})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+		req := NewCodec().NewRequest(r).(jsonrpc.IDCodecRequest)
+		if id := req.RequestID(); id != tc.want {
+			t.Errorf("id %#v: expected request id %q, got %q.", tc.id, tc.want, id)
+		}
+	}
+}
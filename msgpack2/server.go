@@ -0,0 +1,239 @@
+package msgpack2
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/devimteam/jsonrpc"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Version JSON RPC current version
+var Version = "2.0"
+
+// ContentType is the media type the codec is usually registered for.
+const ContentType = "application/msgpack"
+
+// nilID is the msgpack encoding of nil, sent as the id of responses to
+// requests whose id is unknown.
+var nilID = msgpack.RawMessage{0xc0}
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// serverRequest represents a JSON-RPC request received by the server,
+// encoded with msgpack.
+type serverRequest struct {
+	// JSON-RPC protocol.
+	Version string `msgpack:"jsonrpc"`
+
+	// A String containing the name of the method to be invoked.
+	Method string `msgpack:"method"`
+
+	// A Structured value to pass as arguments to the method.
+	Params msgpack.RawMessage `msgpack:"params"`
+
+	// The request id, copied as it is. Empty if the member is absent, which
+	// makes the request a notification.
+	ID msgpack.RawMessage `msgpack:"id"`
+}
+
+// serverResponse represents a JSON-RPC response returned by the server,
+// encoded with msgpack.
+type serverResponse struct {
+	// JSON-RPC protocol.
+	Version string `msgpack:"jsonrpc"`
+
+	// The Object that was returned by the invoked method, omitted if there
+	// was an error.
+	Result interface{} `msgpack:"result,omitempty"`
+
+	// An Error object if there was an error invoking the method, omitted
+	// if there was no error.
+	Error *errorObject `msgpack:"error,omitempty"`
+
+	// This must be the same id as the request it is responding to.
+	ID msgpack.RawMessage `msgpack:"id"`
+}
+
+// errorObject is the msgpack encoding of a jsonrpc.Error.
+type errorObject struct {
+	Code    jsonrpc.ErrorCode `msgpack:"code"`
+	Message string            `msgpack:"message"`
+	Data    interface{}       `msgpack:"data,omitempty"`
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+	encSel jsonrpc.EncoderSelector
+}
+
+// NewCustomCodec returns a new msgpack Codec based on passed encoder selector.
+func NewCustomCodec(encSel jsonrpc.EncoderSelector) *Codec {
+	return &Codec{encSel: encSel}
+}
+
+// NewCodec returns a new msgpack Codec.
+func NewCodec() *Codec {
+	return NewCustomCodec(jsonrpc.DefaultEncoderSelector)
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(r *http.Request) jsonrpc.CodecRequest {
+	return newCodecRequest(r, c.encSel.Select(r))
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// newCodecRequest returns a new CodecRequest.
+func newCodecRequest(r *http.Request, encoder jsonrpc.Encoder) jsonrpc.CodecRequest {
+	defer r.Body.Close()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	req := new(serverRequest)
+	var err error
+
+	dec := msgpack.NewDecoder(bytes.NewReader(body))
+	if errDecode := dec.Decode(req); errDecode != nil {
+		req = new(serverRequest)
+		err = &jsonrpc.Error{
+			Code:    jsonrpc.CodeParse,
+			Message: errDecode.Error(),
+		}
+	} else if dec.Buffered().(*bytes.Reader).Len() > 0 {
+		req = new(serverRequest)
+		err = &jsonrpc.Error{
+			Code:    jsonrpc.CodeParse,
+			Message: "trailing data after request",
+		}
+	} else if req.Version != Version {
+		err = &jsonrpc.Error{
+			Code:    jsonrpc.CodeInvalidRequest,
+			Message: "jsonrpc must be " + Version,
+		}
+	}
+	return &CodecRequest{request: req, err: err, encoder: encoder, body: body}
+}
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	request *serverRequest
+	err     error
+	encoder jsonrpc.Encoder
+	body    []byte
+}
+
+// Body returns the raw body of the request.
+func (c *CodecRequest) Body() []byte {
+	return c.body
+}
+
+// Method returns the RPC method for the current request.
+func (c *CodecRequest) Method() (string, error) {
+	if c.err == nil {
+		return c.request.Method, nil
+	}
+	return "", c.err
+}
+
+// IsNotification reports whether the request is a valid request without
+// an id member.
+func (c *CodecRequest) IsNotification() bool {
+	return c.err == nil && len(c.request.ID) == 0
+}
+
+// ID returns the id of the request as decoded by msgpack, nil for
+// notifications and null ids.
+func (c *CodecRequest) ID() interface{} {
+	var id interface{}
+	if len(c.request.ID) == 0 || msgpack.Unmarshal(c.request.ID, &id) != nil {
+		return nil
+	}
+	return id
+}
+
+// RequestID returns the id of the request formatted by jsonrpc.FormatID,
+// empty for notifications and null ids.
+func (c *CodecRequest) RequestID() string {
+	return jsonrpc.FormatID(c.ID())
+}
+
+// ReadRequest fills the request object for the RPC method.
+//
+// A *msgpack.RawMessage args gets the raw params.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil && c.request.Params != nil {
+		if raw, ok := args.(*msgpack.RawMessage); ok {
+			*raw = append((*raw)[:0], c.request.Params...)
+		} else if err := msgpack.Unmarshal(c.request.Params, args); err != nil {
+			c.err = &jsonrpc.Error{
+				Code:    jsonrpc.CodeBadParams,
+				Message: err.Error(),
+			}
+		}
+	}
+	return c.err
+}
+
+// WriteResponse encodes the response and writes it to the ResponseWriter.
+// It returns the error encoding the reply or writing the response.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) error {
+	return c.writeServerResponse(w, http.StatusOK, &serverResponse{
+		Version: Version,
+		Result:  reply,
+		ID:      c.responseID(),
+	})
+}
+
+// WriteError send error response.
+func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	jsonErr, ok := err.(*jsonrpc.Error)
+
+	if !ok {
+		code := jsonrpc.CodeInvalidRequest
+
+		if err == jsonrpc.ErrMethodNotFound || err == jsonrpc.ErrServiceNotFound {
+			code = jsonrpc.CodeMethodNotFound
+		}
+
+		jsonErr = &jsonrpc.Error{
+			Code:    code,
+			Message: err.Error(),
+		}
+	}
+
+	c.writeServerResponse(w, status, &serverResponse{
+		Version: Version,
+		Error:   &errorObject{Code: jsonErr.Code, Message: jsonErr.Message, Data: jsonErr.Data},
+		ID:      c.responseID(),
+	})
+}
+
+// responseID returns the id of the response, nil if the request has none.
+func (c *CodecRequest) responseID() msgpack.RawMessage {
+	if len(c.request.ID) == 0 {
+		return nilID
+	}
+	return c.request.ID
+}
+
+func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, status int, res *serverResponse) error {
+	body, err := msgpack.Marshal(res)
+	if err != nil {
+		jsonrpc.WriteError(w, 500, err.Error())
+		return err
+	}
+	w.Header().Set("Content-Type", ContentType)
+	ew := c.encoder.Encode(w)
+	w.WriteHeader(status)
+	_, err = ew.Write(body)
+	return err
+}
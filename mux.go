@@ -0,0 +1,84 @@
+package jsonrpc
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Handler returns the server as an http.Handler.
+func (s *Server) Handler() http.Handler {
+	return s
+}
+
+// Mux routes requests to several servers by URL path prefix, e.g. "/v1"
+// and "/v2" to different API versions.
+//
+// The prefix is stripped from the path before the server sees the request.
+// Requests matching no prefix get a 404. HTTP method checks are left to the
+// servers, so a mounted server answers non-POST requests as usual.
+type Mux struct {
+	routes []muxRoute // sorted by decreasing prefix length
+}
+
+type muxRoute struct {
+	prefix  string
+	handler http.Handler
+}
+
+// NewMux returns an empty Mux.
+func NewMux() *Mux {
+	return &Mux{}
+}
+
+// Handle mounts s under prefix. Trailing slashes are ignored, so "/v1" and
+// "/v1/" are the same prefix and match both "/v1" and "/v1/" requests.
+// Mounting a prefix twice replaces the previous server.
+func (m *Mux) Handle(prefix string, s *Server) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	for i := range m.routes {
+		if m.routes[i].prefix == prefix {
+			m.routes[i].handler = s
+			return
+		}
+	}
+	m.routes = append(m.routes, muxRoute{prefix: prefix, handler: s})
+	sort.SliceStable(m.routes, func(i, j int) bool {
+		return len(m.routes[i].prefix) > len(m.routes[j].prefix)
+	})
+}
+
+// ServeHTTP dispatches the request to the server with the longest matching
+// prefix.
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range m.routes {
+		rest, ok := stripPrefix(r.URL.Path, route.prefix)
+		if !ok {
+			continue
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		route.handler.ServeHTTP(w, r2)
+		return
+	}
+	WriteError(w, 404, "rpc: no server for path "+r.URL.Path)
+}
+
+// stripPrefix removes a path prefix ending on a segment boundary.
+func stripPrefix(path, prefix string) (string, bool) {
+	if prefix == "/" {
+		return path, true
+	}
+	if path == prefix {
+		return "/", true
+	}
+	if strings.HasPrefix(path, prefix+"/") {
+		return path[len(prefix):], true
+	}
+	return "", false
+}
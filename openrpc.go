@@ -0,0 +1,211 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenRPCVersion is the version of the OpenRPC specification followed by
+// the documents of Server.OpenRPC.
+const OpenRPCVersion = "1.2.6"
+
+// openRPCDocument is an OpenRPC document, limited to what the server knows.
+type openRPCDocument struct {
+	OpenRPC string          `json:"openrpc"`
+	Info    openRPCInfo     `json:"info"`
+	Methods []openRPCMethod `json:"methods"`
+}
+
+type openRPCInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openRPCMethod struct {
+	Name           string                     `json:"name"`
+	Params         []openRPCContentDescriptor `json:"params"`
+	Result         openRPCContentDescriptor   `json:"result"`
+	ParamStructure string                     `json:"paramStructure,omitempty"`
+}
+
+type openRPCContentDescriptor struct {
+	Name     string                 `json:"name"`
+	Required bool                   `json:"required,omitempty"`
+	Schema   map[string]interface{} `json:"schema"`
+}
+
+var typeOfTime = reflect.TypeOf(time.Time{})
+
+// OpenRPC returns an OpenRPC document describing the registered methods.
+//
+// The fields of the params argument of a method are its params, by name;
+// params arguments that are not structs make a single param. Schemas are
+// derived from the Go types, with the names given by json tags and the
+// fields tagged omitempty being optional. Dynamic methods are described
+// with params and results of any schema.
+func (s *Server) OpenRPC() (json.RawMessage, error) {
+	version := s.version
+	if version == "" {
+		version = "0.0.0"
+	}
+	doc := openRPCDocument{
+		OpenRPC: OpenRPCVersion,
+		Info:    openRPCInfo{Title: "JSON-RPC", Version: version},
+		Methods: []openRPCMethod{},
+	}
+
+	for _, name := range s.Methods() {
+		argType, replyType, ok := s.MethodInfo(name)
+		if !ok {
+			continue
+		}
+		method := openRPCMethod{
+			Name:   name,
+			Params: []openRPCContentDescriptor{},
+			Result: openRPCContentDescriptor{Name: "result", Schema: jsonSchema(replyType, nil)},
+		}
+		switch {
+		case argType == nil || argType == typeOfRawMessage:
+		case argType.Elem().Kind() == reflect.Struct && argType.Elem() != typeOfTime:
+			method.ParamStructure = "by-name"
+			for _, field := range structFields(argType.Elem(), map[reflect.Type]bool{argType.Elem(): true}) {
+				method.Params = append(method.Params, openRPCContentDescriptor{
+					Name:     field.name,
+					Required: field.required,
+					Schema:   field.schema,
+				})
+			}
+		default:
+			method.Params = append(method.Params, openRPCContentDescriptor{
+				Name:     "params",
+				Required: true,
+				Schema:   jsonSchema(argType, nil),
+			})
+		}
+		doc.Methods = append(doc.Methods, method)
+	}
+
+	return json.Marshal(doc)
+}
+
+// RegisterDiscover registers the OpenRPC method "rpc.discover", returning
+// the document of OpenRPC. The method name uses the method separator of
+// the server.
+func (s *Server) RegisterDiscover() error {
+	return s.RegisterFunc("rpc"+s.serviceMap().methodSeparator()+"discover", func(ctx context.Context) (json.RawMessage, error) {
+		return s.OpenRPC()
+	})
+}
+
+// jsonSchema returns the JSON schema of values of t as encoded by
+// encoding/json. Types being described are in seen, so recursive types end
+// up with an empty schema where they recur.
+func jsonSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == typeOfTime:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == typeOfRawMessage:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{}
+		}
+		if seen == nil {
+			seen = make(map[reflect.Type]bool)
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		properties := make(map[string]interface{})
+		var required []string
+		for _, field := range structFields(t, seen) {
+			properties[field.name] = field.schema
+			if field.required {
+				required = append(required, field.name)
+			}
+		}
+
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// schemaField is a property of the schema of a struct.
+type schemaField struct {
+	name     string
+	schema   map[string]interface{}
+	required bool
+}
+
+// structFields returns the properties of the fields of struct t in
+// declaration order, embedded structs being flattened as encoding/json
+// does. Fields not tagged omitempty are required.
+func structFields(t reflect.Type, seen map[reflect.Type]bool) []schemaField {
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if idx := strings.Index(tag, ","); idx != -1 {
+			name, options = tag[:idx], tag[idx+1:]
+		}
+
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, structFields(ft, seen)...)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fields = append(fields, schemaField{
+			name:     name,
+			schema:   jsonSchema(field.Type, seen),
+			required: !strings.Contains(","+options+",", ",omitempty,"),
+		})
+	}
+	return fields
+}
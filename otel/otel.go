@@ -0,0 +1,68 @@
+// Package otel traces the requests served by a jsonrpc.Server with
+// OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/devimteam/jsonrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes of the spans, following the semantic conventions for
+// JSON-RPC.
+const (
+	systemKey       = attribute.Key("rpc.system")
+	methodKey       = attribute.Key("rpc.method")
+	requestIDKey    = attribute.Key("rpc.jsonrpc.request_id")
+	errorCodeKey    = attribute.Key("rpc.jsonrpc.error_code")
+	errorMessageKey = attribute.Key("rpc.jsonrpc.error_message")
+)
+
+// Middleware returns a server option starting a server span named after
+// the method of each request, batch elements included, and ending it once
+// the method returned. The span is a child of the trace context found in
+// the W3C traceparent header, if any, and is in the context given to the
+// method. It carries the request id when the codec tells it, and the
+// JSON-RPC error code and message when the method fails.
+func Middleware(tracer trace.Tracer) jsonrpc.ServerOption {
+	return func(s *jsonrpc.Server) {
+		jsonrpc.ServerBefore(func(ctx context.Context, method string, header http.Header, req jsonrpc.CodecRequest) context.Context {
+			return start(ctx, tracer, method, header, req)
+		})(s)
+		jsonrpc.ServerAfter(end)(s)
+	}
+}
+
+func start(ctx context.Context, tracer trace.Tracer, method string, header http.Header, req jsonrpc.CodecRequest) context.Context {
+	ctx = propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(header))
+
+	attributes := []attribute.KeyValue{systemKey.String("jsonrpc"), methodKey.String(method)}
+	if idReq, ok := req.(jsonrpc.IDCodecRequest); ok {
+		if id := idReq.RequestID(); id != "" {
+			attributes = append(attributes, requestIDKey.String(id))
+		}
+	}
+
+	ctx, _ = tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attributes...),
+	)
+	return ctx
+}
+
+func end(ctx context.Context, method string, reply interface{}, err error) {
+	span := trace.SpanFromContext(ctx)
+	if err != nil {
+		span.SetAttributes(
+			errorCodeKey.Int(int(jsonrpc.ErrorCodeOf(err))),
+			errorMessageKey.String(err.Error()),
+		)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
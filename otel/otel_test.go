@@ -0,0 +1,97 @@
+package otel
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devimteam/jsonrpc"
+	"github.com/devimteam/jsonrpc/json2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Service1Request struct {
+	A int
+	B int
+}
+
+type Service1 struct {
+}
+
+func (t *Service1) Multiply(req *Service1Request) (int, error) {
+	return req.A * req.B, nil
+}
+
+func (t *Service1) Fail(req *Service1Request) (int, error) {
+	return 0, jsonrpc.NewError(jsonrpc.CodeBadParams, "no")
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	s := jsonrpc.NewServer(Middleware(provider.Tracer("test")))
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `[
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 2, "B": 3}, "id": "a"},
+		{"jsonrpc": "2.0", "method": "Service1.Fail", "params": {}, "id": 2}
+	]`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d.", len(spans))
+	}
+
+	for _, span := range spans {
+		if got := span.Parent().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%s: wrong parent trace: %s.", span.Name(), got)
+		}
+		if span.SpanKind() != trace.SpanKindServer {
+			t.Errorf("%s: wrong kind: %s.", span.Name(), span.SpanKind())
+		}
+	}
+
+	ok, failed := spans[0], spans[1]
+	if ok.Name() != "Service1.Multiply" || failed.Name() != "Service1.Fail" {
+		t.Fatalf("Wrong spans: %s, %s.", ok.Name(), failed.Name())
+	}
+
+	if got := attributes(ok)[requestIDKey].AsString(); got != "a" {
+		t.Errorf("Wrong request id: %q.", got)
+	}
+	if ok.Status().Code != codes.Unset {
+		t.Errorf("Wrong status: %v.", ok.Status())
+	}
+
+	attrs := attributes(failed)
+	if got := attrs[requestIDKey].AsString(); got != "2" {
+		t.Errorf("Wrong request id: %q.", got)
+	}
+	if got := attrs[errorCodeKey].AsInt64(); got != int64(jsonrpc.CodeBadParams) {
+		t.Errorf("Wrong error code: %d.", got)
+	}
+	if failed.Status().Code != codes.Error {
+		t.Errorf("Wrong status: %v.", failed.Status())
+	}
+}
@@ -0,0 +1,90 @@
+package jsonrpc
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is the rate of calls allowed to a client, with bursts of up to
+// Burst calls.
+type RateLimit struct {
+	Limit rate.Limit
+	Burst int
+}
+
+// rateLimitSweep is how often the limiters of idle clients are dropped.
+const rateLimitSweep = time.Minute
+
+// rateLimiter keeps a token bucket per client and method limit.
+type rateLimiter struct {
+	key       func(*http.Request) string
+	limit     RateLimit
+	mutex     sync.Mutex // protects the fields below
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+	idle    time.Duration // time after which the bucket is full again
+}
+
+func newRateLimiter(key func(*http.Request) string, limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		key:       key,
+		limit:     limit,
+		buckets:   make(map[string]*rateBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// reserve takes a token from the bucket of the client of r for method,
+// limited by limit if it has its own, and returns how long the client must
+// wait when the bucket is empty, zero otherwise.
+func (l *rateLimiter) reserve(r *http.Request, method string, limit *RateLimit) time.Duration {
+	key := l.key(r)
+	if limit == nil {
+		limit = &l.limit
+	} else {
+		key += "\x00" + method
+	}
+
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweep {
+		// A bucket left alone until full is as good as a new one.
+		for k, b := range l.buckets {
+			if now.Sub(b.seen) > b.idle {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{limiter: rate.NewLimiter(limit.Limit, limit.Burst)}
+		if limit.Limit > 0 && limit.Limit != rate.Inf {
+			b.idle = time.Duration(float64(limit.Burst) / float64(limit.Limit) * float64(time.Second))
+		}
+		l.buckets[key] = b
+	}
+	b.seen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		// No call is ever allowed.
+		return rateLimitSweep
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay
+	}
+	return 0
+}
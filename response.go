@@ -0,0 +1,61 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+)
+
+// errResponseTooLarge is returned by responseBuffer writes past its limit.
+var errResponseTooLarge = errors.New("rpc: response too large")
+
+// responseBuffer is an http.ResponseWriter keeping the response in memory,
+// so it can be checked or rewritten before reaching the client.
+type responseBuffer struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	limit    int64 // maximum body size, unlimited if zero
+	overflow bool
+}
+
+func newResponseBuffer(limit int64) *responseBuffer {
+	return &responseBuffer{header: make(http.Header), limit: limit}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.overflow || (b.limit > 0 && int64(b.body.Len()+len(p)) > b.limit) {
+		b.overflow = true
+		return 0, errResponseTooLarge
+	}
+	return b.body.Write(p)
+}
+
+// reset drops what was written so far.
+func (b *responseBuffer) reset() {
+	b.header = make(http.Header)
+	b.status = 0
+	b.body.Reset()
+	b.overflow = false
+}
+
+// flush copies the buffered response to w.
+func (b *responseBuffer) flush(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	if b.status != 0 {
+		w.WriteHeader(b.status)
+	}
+	w.Write(b.body.Bytes())
+}
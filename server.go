@@ -1,11 +1,26 @@
 package jsonrpc
 
 import (
+    "bytes"
     "context"
+    "encoding/json"
     "fmt"
+    "io"
+    "io/ioutil"
+    "math"
     "net/http"
+    "os"
     "reflect"
+    "runtime/debug"
+    "sort"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/pkg/errors"
+    "golang.org/x/time/rate"
 )
 
 // ----------------------------------------------------------------------------
@@ -22,41 +37,542 @@ type Codec interface {
 type CodecRequest interface {
     // Reads the request and returns the RPC method name.
     Method() (string, error)
+    // Returns the request id as decoded by the codec, nil if there is none.
+    ID() interface{}
     // Reads the request filling the RPC method args.
     ReadRequest(interface{}) error
-    // Writes the response using the RPC method reply.
-    WriteResponse(http.ResponseWriter, interface{})
+    // Writes the response using the RPC method reply. Returns the error
+    // encoding the reply or writing the response.
+    WriteResponse(http.ResponseWriter, interface{}) error
     // Writes an error produced by the server.
     WriteError(w http.ResponseWriter, status int, err error)
     // Get raw body
     Body() []byte
 }
 
+// NotificationCodecRequest is implemented by codec requests able to tell
+// notifications, requests whose client expects no response at all.
+type NotificationCodecRequest interface {
+    CodecRequest
+    // Reports whether the request is a notification.
+    IsNotification() bool
+}
+
+// BatchCodecRequest is implemented by codec requests able to carry several
+// requests in one body, like JSON-RPC 2.0 batches.
+type BatchCodecRequest interface {
+    CodecRequest
+    // Reports whether the body holds a batch.
+    IsBatch() bool
+    // Returns a CodecRequest for each request of the batch.
+    Requests() []CodecRequest
+    // Writes the responses of the batch requests, as written by their
+    // WriteResponse or WriteError, in a single response.
+    WriteBatch(w http.ResponseWriter, responses [][]byte)
+}
+
+// IDCodecRequest is implemented by codec requests able to tell the id of
+// the request, e.g. for logging or tracing.
+type IDCodecRequest interface {
+    CodecRequest
+    // Returns the id of the request, empty for notifications and null
+    // ids. Codecs should return FormatID(ID()).
+    RequestID() string
+}
+
+// FormatID formats a request id as returned by CodecRequest.ID, so that
+// codecs agree on RequestID: strings as is, numbers in decimal, and nil,
+// i.e. no id or a null one, as an empty string.
+func FormatID(id interface{}) string {
+    if id == nil {
+        return ""
+    }
+    return fmt.Sprint(id)
+}
+
+// StrictCodecRequest is implemented by codec requests able to reject params
+// naming fields the args don't have, see ServerDisallowUnknownFields.
+type StrictCodecRequest interface {
+    CodecRequest
+    // Makes ReadRequest fail with a CodeBadParams error on unknown fields.
+    DisallowUnknownFields()
+}
+
+// Version1CodecRequest is implemented by codec requests able to accept
+// requests of an older version of the protocol, see ServerAllowVersion1.
+type Version1CodecRequest interface {
+    CodecRequest
+    // Makes the request valid if it follows JSON-RPC 1.0.
+    AllowVersion1()
+}
+
+// LimitedBatchCodecRequest is implemented by batch codec requests able to
+// stop decoding a batch past a number of requests, see ServerMaxBatchSize.
+type LimitedBatchCodecRequest interface {
+    BatchCodecRequest
+    // Makes Requests return at most n+1 requests, so batches of more than
+    // n requests are told without decoding them fully.
+    LimitBatch(n int)
+}
+
+// Defaulter is implemented by method arguments that have non-zero defaults.
+//
+// SetDefaults is called on a freshly allocated argument right before the
+// params are decoded into it, so fields absent from the request keep their
+// default values while explicitly sent ones (including zero values) win.
+type Defaulter interface {
+    SetDefaults()
+}
+
+// Validator is implemented by method arguments that check their own values.
+//
+// Validate is called once the params are decoded into the argument. An
+// error it returns fails the call with a CodeBadParams error carrying its
+// message, or the field errors if it returns FieldErrors.
+type Validator interface {
+    Validate() error
+}
+
+// RPCNamer is implemented by service receivers exposing methods under other
+// names than their Go ones.
+//
+// RPCNames maps Go method names to the names the methods are called by, so
+// GetProfile may be exposed as "getProfile"; other methods keep their Go
+// name. It is called once, when the service is registered.
+type RPCNamer interface {
+    RPCNames() map[string]string
+}
+
 // ----------------------------------------------------------------------------
 // Server
 // ----------------------------------------------------------------------------
 
+// MethodHandler calls a method with its params argument and fills reply,
+// like the methods of a service taking a reply argument do.
+//
+// args points to the decoded params: it is nil for methods taking none, the
+// first params argument for methods taking several, and a *json.RawMessage
+// for dynamic methods. reply points to a value of the reply type of the
+// method, e.g. a **Reply for methods returning a *Reply. Middleware may
+// pass other args of the same type on, or fill reply without calling next.
+type MethodHandler func(ctx context.Context, args, reply interface{}) error
+
+// MethodMiddleware wraps the call of a method.
+type MethodMiddleware func(next MethodHandler) MethodHandler
+
+// methodMiddleware is a middleware registered for a method name pattern.
+type methodMiddleware struct {
+    pattern string
+    mw      MethodMiddleware
+}
+
 type ServerBeforeFunc func(ctx context.Context, method string, header http.Header, req CodecRequest) context.Context
 
+// ServerBeforeFuncV2 is a before hook that may answer the request itself:
+// when handled is true, reply or err is written as the response of the
+// method, which is not called.
+type ServerBeforeFuncV2 func(ctx context.Context, method string, header http.Header, req CodecRequest) (_ context.Context, handled bool, reply interface{}, err error)
+
+// ServerAfterFunc observes the outcome of a request once its method
+// returned, before the response is written. err is the error returned by
+// the method, or the one raised while finding it.
+type ServerAfterFunc func(ctx context.Context, method string, reply interface{}, err error)
+
+// ServerAuthFunc authorizes a request before its method is looked up. A
+// non-nil error rejects the request.
+type ServerAuthFunc func(ctx context.Context, method string, header http.Header) error
+
+// ServerRecoveryFunc is given the value and stack of a panic recovered in a
+// service method. A non-nil error it returns is sent to the client in place
+// of the default one.
+type ServerRecoveryFunc func(ctx context.Context, method string, recovered interface{}, stack []byte) error
+
+// ServerResponseErrorFunc is given the error writing the response of a
+// method, like a reply the codec can't encode or a client gone away.
+type ServerResponseErrorFunc func(ctx context.Context, method string, err error)
+
+// ServerSamplerFunc decides whether a request is sampled for tracing and
+// logging. It runs before the before hooks.
+type ServerSamplerFunc func(ctx context.Context, method string) bool
+
 // Server serves registered RPC services using registered codecs.
 type Server struct {
-    codecs   map[string]Codec
-    services *serviceMap
-    before   []ServerBeforeFunc
+    inFlight        int64 // accessed atomically, first for 64-bit alignment
+    codecs          map[string]Codec
+    soleCodec       Codec  // the codec when only one is registered
+    soleContentType string // its content type
+    codecMatchers   []func(contentType string) Codec
+    services        atomic.Value // *serviceMap
+    before          []ServerBeforeFuncV2
+    after           []ServerAfterFunc
+    auth            []ServerAuthFunc
+    responseErrors  []ServerResponseErrorFunc
+    bodyReadTimeout time.Duration
+    timeout         time.Duration
+    statusMapper    func(ErrorCode) int
+    middleware      []methodMiddleware
+    errorMappers    []func(error) (*Error, bool)
+    concurrency     chan struct{} // semaphore of ServerMaxConcurrent
+    rejectOverLimit bool
+    compression     bool
+    debug           bool
+    strictParams    bool
+    allowVersion1   bool
+    cors            *CORSConfig
+    allowGET        map[string]bool
+    maxBodyBytes    int64
+    maxBatch        int
+    batchParallel   int
+    stopBatch       bool
+    serviceCodecs   map[string]Codec
+    slowThreshold   time.Duration
+    slowLog         func(method string, d time.Duration)
+    rateLimiter     *rateLimiter
+    idempotency     *idempotency
+    readiness       []func(ctx context.Context) error
+    methodLimits    map[string]RateLimit
+    shutdownMutex   sync.RWMutex // protects shutdown
+    shutdown        bool
+    active          sync.WaitGroup // method calls running or waiting
+    panicError      *panicError
+    recovery        ServerRecoveryFunc
+    maxResponse     map[string]int64
+    version         string
+    sampler         ServerSamplerFunc
+    allowHEAD       bool
+}
+
+// panicError describes the error written in place of a recovered panic.
+type panicError struct {
+    code          ErrorCode
+    exposeMessage bool
 }
 
 type ServerOption func(*Server)
 
 func ServerBefore(before ServerBeforeFunc) ServerOption {
+    return ServerBeforeV2(func(ctx context.Context, method string, header http.Header, req CodecRequest) (context.Context, bool, interface{}, error) {
+        return before(ctx, method, header, req), false, nil, nil
+    })
+}
+
+// ServerBeforeV2 adds a before hook able to answer requests, e.g. from a
+// cache. It runs in registration order with those of ServerBefore; once a
+// hook handled the request, the next ones, the auth hooks and the method
+// are skipped. Its reply or error is sent as the method's would be, and
+// after hooks see it.
+func ServerBeforeV2(before ServerBeforeFuncV2) ServerOption {
     return func(s *Server) { s.before = append(s.before, before) }
 }
 
+// ServerAfter adds a hook run after every request that went through the
+// before hooks, errors included. Hooks run in registration order. When the
+// client went away before the method returned, they get the error of the
+// request context, like context.Canceled, and no response is written.
+func ServerAfter(after ServerAfterFunc) ServerOption {
+    return func(s *Server) { s.after = append(s.after, after) }
+}
+
+// ServerAuth adds a hook authorizing the requests once the before hooks
+// ran, so it sees the context they set. Hooks run in registration order and
+// the first error rejects the request with HTTP 401: an *Error is sent as
+// is, others as a CodeServer error with their message. After hooks see the
+// error.
+func ServerAuth(auth ServerAuthFunc) ServerOption {
+    return func(s *Server) { s.auth = append(s.auth, auth) }
+}
+
+// ServerResponseError adds a hook run when the response of a method can't be
+// written. Hooks run in registration order.
+func ServerResponseError(fn ServerResponseErrorFunc) ServerOption {
+    return func(s *Server) { s.responseErrors = append(s.responseErrors, fn) }
+}
+
+// ServerPanicErrorCode recovers panics of service methods and answers with
+// an error of the given code instead of letting the panic reach net/http.
+//
+// The client gets the panic value as the error message if exposeMessage is
+// true, which is handy in development; otherwise it gets a generic message.
+func ServerPanicErrorCode(code ErrorCode, exposeMessage bool) ServerOption {
+    return func(s *Server) { s.panicError = &panicError{code: code, exposeMessage: exposeMessage} }
+}
+
+// ServerRecovery recovers panics of service methods and calls fn with the
+// recovered value and stack, typically to log them. The client gets an
+// error of code CodeInternal unless fn returns one, or the code and message
+// set by ServerPanicErrorCode. Errors that are not *Error are sent with
+// that code and their message.
+func ServerRecovery(fn ServerRecoveryFunc) ServerOption {
+    return func(s *Server) { s.recovery = fn }
+}
+
+// ServerMaxMethodArgs makes RegisterService fail for methods taking more
+// than n arguments, not counting context.Context and *http.Request. Such
+// signatures are usually mistakes, so this surfaces them at startup with an
+// error naming the method. There is no limit by default.
+func ServerMaxMethodArgs(n int) ServerOption {
+    return func(s *Server) { s.serviceMap().maxArgs = n }
+}
+
+// ServerMethodSeparator sets the separator between the service and method
+// names of the requested method, e.g. "_" for "user_getProfile". It applies
+// to the lookup of incoming method names, HasMethod, Methods and the names
+// given to RegisterFunc; service names containing it are refused and
+// methods containing it are ignored. The default is ".".
+func ServerMethodSeparator(sep string) ServerOption {
+    return func(s *Server) { s.serviceMap().separator = sep }
+}
+
+// ServerCaseInsensitive makes the server look up method names ignoring
+// case, so "service1.multiply" calls "Service1.Multiply"; hooks and
+// per-method settings get the registered name. Registering a
+// method whose name differs only by case from another one is an error.
+// Method names are case-sensitive by default.
+func ServerCaseInsensitive() ServerOption {
+    return func(s *Server) { s.serviceMap().caseInsensitive = true }
+}
+
+// DuplicatePolicy tells what registering a service or method whose name is
+// already registered does.
+type DuplicatePolicy int
+
+const (
+    // DuplicateError makes the registration fail with an error wrapping
+    // ErrDuplicate and naming the method. It is the default.
+    DuplicateError DuplicatePolicy = iota
+    // DuplicateOverride replaces the registered service or method.
+    DuplicateOverride
+    // DuplicateIgnore keeps the registered service or method, and the
+    // registration succeeds.
+    DuplicateIgnore
+)
+
+// ServerOnDuplicate sets what registering a service or method whose name is
+// already registered does, e.g. when optional modules provide the same
+// service. Services are replaced or kept as a whole; functions registered
+// with RegisterFunc or RegisterTyped one by one.
+func ServerOnDuplicate(policy DuplicatePolicy) ServerOption {
+    return func(s *Server) { s.serviceMap().duplicates = policy }
+}
+
+// ServerSampler sets the function deciding which requests are sampled, e.g.
+// 1% of the traffic. Hooks read the decision with Sampled(ctx), so tracing
+// can be sampled while metrics still see every request; hooks running after
+// the call may also record unsampled requests that failed. Without a
+// sampler every request is sampled.
+func ServerSampler(sampler ServerSamplerFunc) ServerOption {
+    return func(s *Server) { s.sampler = sampler }
+}
+
+// ServerAllowHEAD makes the server answer HEAD requests with 200, no body
+// and the number of registered methods in the "X-RPC-Methods-Count" header,
+// so monitoring can tell a live endpoint from a missing one. By default HEAD
+// gets a 405 like any other non-POST request.
+func ServerAllowHEAD() ServerOption {
+    return func(s *Server) { s.allowHEAD = true }
+}
+
+// ServerAllowGET lets the given read-only methods be called with GET
+// requests, like "GET /rpc?method=Service.Read&params={"id":1}", for
+// cacheability. The optional params and id query parameters are JSON
+// values. The call goes through the codec registered for
+// "application/json" and gets the usual response envelope; GET requests
+// for other methods are refused with a 405 status.
+func ServerAllowGET(methods ...string) ServerOption {
+    return func(s *Server) {
+        if s.allowGET == nil {
+            s.allowGET = make(map[string]bool)
+        }
+        for _, method := range methods {
+            s.allowGET[method] = true
+        }
+    }
+}
+
+// ServerMaxBodyBytes limits request bodies to n bytes, once decompressed
+// if ServerCompression is set, batches included. Larger requests get a
+// CodeInvalidRequest error with a 413 status. There is no limit by default.
+func ServerMaxBodyBytes(n int64) ServerOption {
+    return func(s *Server) { s.maxBodyBytes = n }
+}
+
+// ServerSlowLog calls fn with the method and duration of the calls taking
+// longer than threshold, from the decoding of the params to the return of
+// the method, waits for ServerMaxConcurrent included. Each request of a
+// batch is timed on its own.
+func ServerSlowLog(threshold time.Duration, fn func(method string, d time.Duration)) ServerOption {
+    return func(s *Server) {
+        s.slowThreshold = threshold
+        s.slowLog = fn
+    }
+}
+
+// ServerRateLimit limits the calls of each client, told by key from the
+// request, e.g. by API key or remote address, to limit calls per second
+// with bursts of burst calls. Each request of a batch counts.
+//
+// Calls over the limit fail with a CodeServer error, sent with HTTP 429 and
+// a Retry-After header as for a RetryableError. The state of clients idle
+// long enough for their limit to be reset is dropped.
+func ServerRateLimit(key func(*http.Request) string, limit rate.Limit, burst int) ServerOption {
+    return func(s *Server) { s.rateLimiter = newRateLimiter(key, RateLimit{Limit: limit, Burst: burst}) }
+}
+
+// ServerMethodRateLimits gives methods their own limit in place of the one
+// of ServerRateLimit, counted apart from the other methods. It has no
+// effect without ServerRateLimit.
+func ServerMethodRateLimits(limits map[string]RateLimit) ServerOption {
+    return func(s *Server) { s.methodLimits = limits }
+}
+
+// ServerVersion sets the server version, e.g. a build tag, sent in the
+// "X-RPC-Server-Version" header of every response, errors included.
+func ServerVersion(version string) ServerOption {
+    return func(s *Server) { s.version = version }
+}
+
+// ServerBodyReadTimeout limits the time spent reading the request body, so
+// clients delivering it very slowly can't hold a goroutine forever. Requests
+// whose body isn't read in time get a 408 response with a CodeParse error,
+// and their connection is closed.
+//
+// The timeout sets the read deadline of the connection through
+// http.ResponseController, so the ResponseWriter must support it, as the
+// ones of net/http do. With other ResponseWriters the timeout is only
+// checked between reads of the body.
+func ServerBodyReadTimeout(d time.Duration) ServerOption {
+    return func(s *Server) { s.bodyReadTimeout = d }
+}
+
+// ServerTimeout sets a deadline on the context of each request, batch
+// elements included, covering the before hooks and the method call. A
+// request still running past it gets a CodeTimeout error, its reply being
+// dropped.
+//
+// The server doesn't abandon a running method: only methods taking a
+// context.Context argument and watching it can be interrupted, the others
+// run to completion before the timeout error is written.
+func ServerTimeout(d time.Duration) ServerOption {
+    return func(s *Server) { s.timeout = d }
+}
+
+// ServerStatusMapper sets the HTTP status of error responses from their
+// error code, in place of ErrorStatus. A zero status falls back to
+// ErrorStatus. Errors of methods that are not *Error keep a 400 status.
+func ServerStatusMapper(mapper func(ErrorCode) int) ServerOption {
+    return func(s *Server) { s.statusMapper = mapper }
+}
+
+// ServerMaxConcurrent limits the number of method calls running at once,
+// batch elements included. Calls over the limit wait for a free slot, or
+// for their context to be done. n <= 0 lifts the limit.
+func ServerMaxConcurrent(n int) ServerOption {
+    return func(s *Server) {
+        s.concurrency = nil
+        if n > 0 {
+            s.concurrency = make(chan struct{}, n)
+        }
+    }
+}
+
+// ServerMaxConcurrentReject makes calls over the limit of
+// ServerMaxConcurrent fail at once with a CodeServer error and a 503
+// status, instead of waiting.
+func ServerMaxConcurrentReject() ServerOption {
+    return func(s *Server) { s.rejectOverLimit = true }
+}
+
+// defaultMaxBatch is the number of requests a batch may hold by default.
+const defaultMaxBatch = 100
+
+// ServerMaxBatchSize sets the number of requests a batch may hold, 100 by
+// default. Larger batches are refused with a CodeInvalidRequest error
+// before any of their requests is dispatched. Codec requests implementing
+// LimitedBatchCodecRequest stop decoding them past the limit. n <= 0 lifts
+// the limit.
+func ServerMaxBatchSize(n int) ServerOption {
+    return func(s *Server) { s.maxBatch = n }
+}
+
+// ServerBatchParallel makes the server dispatch the requests of a batch
+// concurrently, up to max at a time, rather than one after the other. Their
+// responses are still written in the order of the requests. Panics are
+// recovered from as with ServerRecovery, even without it: a panic in one
+// of them gets it a CodeInternal error, or the one of ServerPanicErrorCode,
+// without failing the others.
+// Hooks and methods may then run concurrently for the same HTTP request:
+// servers whose methods share mutable state or rely on the order of the
+// requests of a batch should keep the default sequential dispatch.
+func ServerBatchParallel(max int) ServerOption {
+    return func(s *Server) { s.batchParallel = max }
+}
+
+// ServerStopBatchOnError makes the server stop dispatching the requests of
+// a batch once one of them fails: the requests after it are not called and
+// get a CodeServer error "skipped due to prior error" at their place in the
+// response, notifications none. This departs from the specification, for
+// which the requests of a batch are independent, and suits batches meant to
+// run as a sequence of steps. With ServerBatchParallel, the requests
+// already running when the first one fails still complete.
+func ServerStopBatchOnError() ServerOption {
+    return func(s *Server) { s.stopBatch = true }
+}
+
+// ServerSuffixCodecs makes requests with a structured syntax suffix media
+// type, like "application/vnd.myapp+json", use the codec of its base type,
+// here "application/json", when they have no codec of their own.
+func ServerSuffixCodecs() ServerOption {
+    return func(s *Server) {
+        s.RegisterCodecMatcher(func(contentType string) Codec {
+            slash, plus := strings.Index(contentType, "/"), strings.LastIndex(contentType, "+")
+            if slash < 0 || plus < slash {
+                return nil
+            }
+            return s.codecs[contentType[:slash+1]+contentType[plus+1:]]
+        })
+    }
+}
+
+// ServerCompression makes the server decompress request bodies sent with
+// "Content-Encoding: gzip", and gzip responses for clients sending
+// "Accept-Encoding: gzip". Codec requests see the decompressed body, and no
+// Accept-Encoding header so their encoders don't compress twice. Other
+// content encodings are refused with a 415 status.
+func ServerCompression() ServerOption {
+    return func(s *Server) { s.compression = true }
+}
+
+// ServerDisallowUnknownFields makes the server reject params with fields
+// the method args don't have, typically client typos, with a CodeBadParams
+// error. It applies to codecs implementing StrictCodecRequest; others
+// ignore unknown fields as usual.
+func ServerDisallowUnknownFields() ServerOption {
+    return func(s *Server) { s.strictParams = true }
+}
+
+// ServerAllowVersion1 makes the server accept JSON-RPC 1.0 requests, without
+// a jsonrpc member or with "1.0", from codecs implementing
+// Version1CodecRequest. Other versions are still rejected.
+func ServerAllowVersion1() ServerOption {
+    return func(s *Server) { s.allowVersion1 = true }
+}
+
+// ServerDebug makes the server attach a *DebugData to the errors it builds
+// from errors returned by methods that are not *Error, and from panics. It
+// holds the Go error or panic value, and the stack trace when known. This
+// leaks internals, so it is meant for development only. Errors returned as
+// *Error are sent as they are, with their own Data.
+func ServerDebug(enabled bool) ServerOption {
+    return func(s *Server) { s.debug = enabled }
+}
+
 // NewServer returns a new RPC server.
 func NewServer(options ...ServerOption) *Server {
     s := &Server{
         codecs:   make(map[string]Codec),
-        services: new(serviceMap),
+        maxBatch: defaultMaxBatch,
     }
+    s.services.Store(new(serviceMap))
     for _, option := range options {
         option(s)
     }
@@ -70,6 +586,35 @@ func NewServer(options ...ServerOption) *Server {
 // excluding the charset definition.
 func (s *Server) RegisterCodec(codec Codec, contentType string) {
     s.codecs[strings.ToLower(contentType)] = codec
+    s.soleCodec, s.soleContentType = nil, ""
+    if len(s.codecs) == 1 {
+        s.soleCodec, s.soleContentType = codec, strings.ToLower(contentType)
+    }
+}
+
+// RegisterCodecMatcher adds a function choosing the codec of requests whose
+// Content-Type has no codec registered, e.g. for families of vendor media
+// types. It is given the media type, lower cased and without parameters,
+// and returns nil if it has no codec for it. Matchers are tried in
+// registration order once the exact lookup failed.
+func (s *Server) RegisterCodecMatcher(matcher func(contentType string) Codec) {
+    s.codecMatchers = append(s.codecMatchers, matcher)
+}
+
+// RegisterServiceCodec makes the requests for the methods of the named
+// service use codec, whatever their Content-Type, e.g. for a service
+// speaking a legacy format.
+//
+// The service is found from the method name read by the codec chosen from
+// the Content-Type, so the method must be readable by that codec; the body
+// is then decoded again by codec. Requests within batches keep the codec of
+// the batch. RegisterServiceCodec must not be called while serving
+// requests.
+func (s *Server) RegisterServiceCodec(name string, codec Codec) {
+    if s.serviceCodecs == nil {
+        s.serviceCodecs = make(map[string]Codec)
+    }
+    s.serviceCodecs[name] = codec
 }
 
 // RegisterService adds a new service to the server.
@@ -82,110 +627,1230 @@ func (s *Server) RegisterCodec(codec Codec, contentType string) {
 //    - The receiver is exported (begins with an upper case letter) or local
 //      (defined in the package registering the service).
 //    - The method name is exported.
-//    - The method has three arguments: *http.Request, *args, *reply.
-//    - All three arguments are pointers.
-//    - The second and third arguments are exported or local.
-//    - The method has return type error.
+//    - The arguments are context.Context, *http.Request or *args, each
+//      optional, so func(ctx context.Context) (*Reply, error) is fine.
+//    - The *args are exported or local. An interface{} argument gets a
+//      pointer to the params decoded into an interface{}.
+//    - The method returns a reply and an error, or only an error when its
+//      last argument is a *reply it fills, as with gorilla/rpc, e.g.
+//      func(r *http.Request, args *Args, reply *[]string) error.
 //
-// All other methods are ignored.
+// All other methods are ignored. Args structs with fields tagged header,
+// like `header:"Authorization"`, are filled from the HTTP headers of the
+// request instead of the params. Receivers implementing RPCNamer choose
+// the names of their methods.
 func (s *Server) RegisterService(receiver interface{}, name string) error {
-    return s.services.register(receiver, name)
+    return s.serviceMap().register(receiver, name)
+}
+
+// RegisterServices adds several services at once, each named after the type
+// of its receiver as with an empty name for RegisterService. If any of them
+// can't be registered, none is and the first error is returned.
+//
+// To register a receiver under another name, use RegisterService.
+func (s *Server) RegisterServices(receivers ...interface{}) error {
+    return s.serviceMap().registerAll(receivers)
+}
+
+// RegisterInterface adds a new service made of the methods of an interface,
+// called on impl. iface is a pointer to the interface, e.g.
+// (*UserService)(nil), and impl must implement it.
+//
+// Only the methods of the interface are exposed, whatever other methods impl
+// has, so implementations can be swapped, e.g. for mocks in tests. The
+// methods follow the signature rules of RegisterService, except that an
+// unsuitable method is an error. The name parameter is optional: if empty
+// it will be the name of the interface.
+func (s *Server) RegisterInterface(iface interface{}, impl interface{}, name string) error {
+    return s.serviceMap().registerInterface(iface, impl, name)
+}
+
+// RegisterFunc adds a function as a method, given its full name like
+// "Service.Method", sparing a receiver type for one-off methods.
+//
+// The function follows the rules of the methods of RegisterService, e.g.
+// func(ctx context.Context, args *Args) (*Reply, error). Several functions
+// can be registered under the same service name, but not under the name of
+// a service registered otherwise.
+func (s *Server) RegisterFunc(name string, fn interface{}) error {
+    return s.serviceMap().registerFunc(name, fn)
+}
+
+// Use adds a middleware around the calls of the methods whose full name
+// matches pattern, where "*" matches any sequence of characters, like
+// "Admin.*". Middleware runs in registration order once the params are
+// decoded. Use must not be called while serving requests.
+func (s *Server) Use(pattern string, mw MethodMiddleware) {
+    s.middleware = append(s.middleware, methodMiddleware{pattern: pattern, mw: mw})
+}
+
+// MapError adds a matcher translating errors returned by methods, like
+// domain errors, into JSON-RPC errors. Errors that are not *Error,
+// FieldErrors or RetryableError go through the matchers in registration
+// order; the first one returning true gives the error sent to the client
+// and seen by the after hooks. Unmatched errors are sent as CodeServer
+// errors. MapError must not be called while serving requests.
+func (s *Server) MapError(match func(error) (*Error, bool)) {
+    s.errorMappers = append(s.errorMappers, match)
+}
+
+// DynamicHandler handles a call to a dynamic method. It gets the raw params
+// of the request and returns the raw result.
+type DynamicHandler func(ctx context.Context, params json.RawMessage) (json.RawMessage, error)
+
+// DynamicMethod is a method whose handler is only known at runtime.
+type DynamicMethod struct {
+    Name    string
+    Handler DynamicHandler
+}
+
+// RegisterDynamic adds a new service made of methods that are not declared
+// as Go methods, e.g. when proxying to a schema discovered at runtime.
+//
+// The codec must be able to read params into a *json.RawMessage. Dynamic
+// methods are looked up and dispatched like the ones of RegisterService.
+func (s *Server) RegisterDynamic(name string, methods []DynamicMethod) error {
+    return s.serviceMap().registerDynamic(name, methods)
+}
+
+// RegisterServiceLazy adds a new service whose receiver is built by factory
+// when one of its methods is first called, then reused.
+//
+// The methods are extracted from the type of sample, following the rules of
+// RegisterService; a typed nil pointer such as (*Service)(nil) will do. The
+// factory must return a value of that same type. If it fails, the call gets
+// a CodeInternal error and the factory is tried again on the next call.
+func (s *Server) RegisterServiceLazy(sample interface{}, name string, factory func() (interface{}, error)) error {
+    return s.serviceMap().registerLazy(sample, name, factory)
+}
+
+// ReplaceServices replaces all registered services at once.
+//
+// fn registers the new set of services into a fresh registry, using the
+// registration methods of the server it is given; other methods of that
+// server must not be used. If fn succeeds the new registry is swapped in
+// atomically, so requests see either the old or the new set of services
+// and never a partial one. If fn fails, the current services are kept.
+func (s *Server) ReplaceServices(fn func(s *Server) error) error {
+    staged := &Server{}
+    staged.services.Store(s.serviceMap().empty())
+    if err := fn(staged); err != nil {
+        return err
+    }
+    s.services.Store(staged.serviceMap())
+    return nil
+}
+
+// ValidateRegistrations checks the registered method names for ones that
+// collide once case and separators are ignored, like "Service.getUser" and
+// "Service.GetUser" or "Service.get_user". Such names are usually a
+// mistake, and they break clients that normalize method names. The error
+// lists every group of colliding names.
+func (s *Server) ValidateRegistrations() error {
+    groups := make(map[string][]string)
+    for _, name := range s.serviceMap().names() {
+        key := strings.ToLower(strings.NewReplacer(".", "", "_", "", "/", "", "-", "").Replace(name))
+        groups[key] = append(groups[key], name)
+    }
+
+    var conflicts []string
+    for _, names := range groups {
+        if len(names) > 1 {
+            sort.Strings(names)
+            conflicts = append(conflicts, strings.Join(names, ", "))
+        }
+    }
+    if len(conflicts) == 0 {
+        return nil
+    }
+    sort.Strings(conflicts)
+    return fmt.Errorf("rpc: conflicting method names: %s", strings.Join(conflicts, "; "))
+}
+
+// serviceMap returns the current registry of services.
+func (s *Server) serviceMap() *serviceMap {
+    return s.services.Load().(*serviceMap)
+}
+
+// SetMethodMaxResponseBytes limits the size of the responses of a method.
+//
+// The response is buffered; a response exceeding n bytes is dropped and the
+// client gets a CodeInternal error instead. This guards against methods
+// accidentally returning huge results. Like RegisterCodec, it must be called
+// before the server starts serving requests.
+func (s *Server) SetMethodMaxResponseBytes(method string, n int64) {
+    if s.maxResponse == nil {
+        s.maxResponse = make(map[string]int64)
+    }
+    s.maxResponse[method] = n
 }
 
 // HasMethod returns true if the given method is registered.
 //
-// The method uses a dotted notation as in "Service.Method".
+// The method uses a dotted notation as in "Service.Method", unless another
+// separator is set with ServerMethodSeparator.
 func (s *Server) HasMethod(method string) bool {
-    if _, _, err := s.services.get(method); err == nil {
+    if _, _, err := s.serviceMap().get(method); err == nil {
         return true
     }
     return false
 }
 
+// Shutdown makes new method calls fail with a CodeServer error and a 503
+// status, then waits for the running ones to return. It returns the error
+// of ctx if it is done first.
+func (s *Server) Shutdown(ctx context.Context) error {
+    s.shutdownMutex.Lock()
+    s.shutdown = true
+    s.shutdownMutex.Unlock()
+
+    done := make(chan struct{})
+    go func() {
+        s.active.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// InFlight returns the number of method calls running.
+func (s *Server) InFlight() int {
+    return int(atomic.LoadInt64(&s.inFlight))
+}
+
+// Methods returns the full names of all registered methods, sorted.
+func (s *Server) Methods() []string {
+    names := s.serviceMap().names()
+    sort.Strings(names)
+    return names
+}
+
+// AliasMethod makes alias call the target method, e.g. to keep an old
+// method name working after a rename. Both are full method names. The
+// alias is known to HasMethod and MethodInfo but not listed by Methods;
+// hooks and per-method settings get the target name.
+//
+// It fails if the target doesn't exist or the alias is already a method or
+// an alias. Registering a method named like an alias fails as well.
+func (s *Server) AliasMethod(alias, target string) error {
+    return s.serviceMap().alias(alias, target)
+}
+
+// Aliases returns the aliases added with AliasMethod and their targets.
+func (s *Server) Aliases() map[string]string {
+    return s.serviceMap().aliasTargets()
+}
+
+// MethodInfo returns the types of the params argument and of the reply of
+// a registered method. argType is nil if the method takes no params; for
+// methods taking several, it is the type of the first one. Dynamic methods
+// take and return a json.RawMessage.
+func (s *Server) MethodInfo(method string) (argType, replyType reflect.Type, ok bool) {
+    _, methodSpec, err := s.serviceMap().get(method)
+    if err != nil {
+        return nil, nil, false
+    }
+    if methodSpec.dynamic != nil {
+        return typeOfRawMessage, typeOfRawMessage, true
+    }
+    for _, arg := range methodSpec.argsType {
+        if isParamsArg(arg) {
+            argType = reflect.PtrTo(arg)
+            break
+        }
+    }
+    return argType, methodSpec.replyType, true
+}
+
 // ServeHTTP
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-    ctx := r.Context()
+    if s.version != "" {
+        w.Header().Set("X-RPC-Server-Version", s.version)
+    }
+
+    // Preflight requests are answered before the POST check.
+    if s.cors != nil && s.cors.handle(w, r) {
+        return
+    }
+
+    if r.Method == "HEAD" && s.allowHEAD {
+        w.Header().Set("X-RPC-Methods-Count", strconv.Itoa(s.serviceMap().count()))
+        w.WriteHeader(200)
+        return
+    }
+
+    if r.Method == "GET" && s.allowGET[r.URL.Query().Get("method")] {
+        var err error
+        if r, err = getRequest(r); err != nil {
+            WriteError(w, 400, "rpc: "+err.Error())
+            return
+        }
+    }
 
     if r.Method != "POST" {
         WriteError(w, 405, "rpc: POST method required, received "+r.Method)
         return
     }
+    codec, contentType := s.codec(r)
+    if codec == nil {
+        WriteError(w, 415, "rpc: unrecognized Content-Type: "+contentType)
+        return
+    }
+
+    var ok bool
+    if r, ok = s.limitBody(w, r, codec); !ok {
+        return
+    }
+    if s.compression {
+        if gw := newGzipResponseWriter(w, r); gw != nil {
+            defer gw.Close()
+            w = gw
+            r = withoutAcceptEncoding(r)
+        }
+    }
+
+    // Create a new codec request.
+    var body []byte
+    if len(s.serviceCodecs) > 0 {
+        // Kept for the codec of the service.
+        body, _ = ioutil.ReadAll(r.Body)
+        r.Body = ioutil.NopCloser(bytes.NewReader(body))
+    }
+    codecReq := codec.NewRequest(r)
+
+    if batch, ok := codecReq.(BatchCodecRequest); ok && batch.IsBatch() {
+        s.serveBatch(w, r, batch)
+        return
+    }
+
+    if serviceCodec := s.serviceCodec(codecReq); serviceCodec != nil {
+        r.Body = ioutil.NopCloser(bytes.NewReader(body))
+        codecReq = serviceCodec.NewRequest(r)
+    }
+
+    s.serveRequest(w, r, codecReq)
+}
+
+// limitBody applies the limits of ServerMaxBodyBytes and
+// ServerBodyReadTimeout to the body of r, and decompresses it with
+// ServerCompression. It answers the requests failing and returns false,
+// or else the request with the body to decode.
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request, codec Codec) (*http.Request, bool) {
+    var deadline *http.ResponseController
+    if s.bodyReadTimeout > 0 {
+        t := time.Now().Add(s.bodyReadTimeout)
+        if deadline = http.NewResponseController(w); deadline.SetReadDeadline(t) != nil {
+            deadline = nil
+        }
+        r.Body = &deadlineReader{ReadCloser: r.Body, deadline: t}
+    }
+    if s.maxBodyBytes > 0 {
+        r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+    }
+
+    if s.bodyReadTimeout > 0 || s.maxBodyBytes > 0 {
+        body, err := ioutil.ReadAll(r.Body)
+        var tooLarge *http.MaxBytesError
+        if err == errBodyReadTimeout {
+            // The deadline stays, so that net/http gives up on the rest of
+            // the body and closes the connection.
+            writeBodyError(w, r, codec, 408, NewError(CodeParse, "rpc: "+err.Error()))
+            return r, false
+        } else if errors.As(err, &tooLarge) {
+            s.writeTooLarge(w, r, codec)
+            return r, false
+        } else if err != nil {
+            WriteError(w, 400, "rpc: "+err.Error())
+            return r, false
+        }
+        r.Body = ioutil.NopCloser(bytes.NewReader(body))
+        if deadline != nil {
+            // net/http reads the connection in the background while the
+            // method runs and cancels the request on a read error.
+            deadline.SetReadDeadline(time.Time{})
+        }
+    }
+
+    if s.compression {
+        var err error
+        if r, err = decompressRequest(r, s.maxBodyBytes); err == errUnsupportedEncoding {
+            WriteError(w, 415, "rpc: "+err.Error())
+            return r, false
+        } else if err == errBodyTooLarge {
+            s.writeTooLarge(w, r, codec)
+            return r, false
+        } else if err != nil {
+            WriteError(w, 400, "rpc: "+err.Error())
+            return r, false
+        }
+    }
+    return r, true
+}
+
+// codec returns the codec registered for the media type of the request,
+// nil if there is none, and the media type.
+func (s *Server) codec(r *http.Request) (Codec, string) {
     contentType := r.Header.Get("Content-Type")
+    // Most servers have a single codec, usually asked for by its exact
+    // content type.
+    if s.soleCodec != nil && (contentType == "" || contentType == s.soleContentType) {
+        return s.soleCodec, contentType
+    }
     idx := strings.Index(contentType, ";")
 
     if idx != -1 {
         contentType = contentType[:idx]
     }
 
-    var codec Codec
-
     if contentType == "" && len(s.codecs) == 1 {
         // If Content-Type is not set and only one codec has been registered,
         // then default to that codec.
         for _, c := range s.codecs {
-            codec = c
+            return c, contentType
         }
-    } else if codec = s.codecs[strings.ToLower(contentType)]; codec == nil {
-        WriteError(w, 415, "rpc: unrecognized Content-Type: "+contentType)
+    }
+    mediaType := strings.ToLower(contentType)
+    if codec, ok := s.codecs[mediaType]; ok {
+        return codec, contentType
+    }
+    for _, match := range s.codecMatchers {
+        if codec := match(mediaType); codec != nil {
+            return codec, contentType
+        }
+    }
+    return nil, contentType
+}
+
+// serviceCodec returns the codec registered for the service of the method
+// of codecReq, nil if there is none.
+func (s *Server) serviceCodec(codecReq CodecRequest) Codec {
+    if len(s.serviceCodecs) == 0 {
+        return nil
+    }
+    if v1, ok := codecReq.(Version1CodecRequest); ok && s.allowVersion1 {
+        v1.AllowVersion1()
+    }
+    method, err := codecReq.Method()
+    if err != nil {
+        return nil
+    }
+    separator := s.serviceMap().methodSeparator()
+    if i := strings.Index(method, separator); i >= 0 {
+        method = method[:i]
+    }
+    return s.serviceCodecs[method]
+}
+
+// serveBatch dispatches the requests of a batch one after the other and
+// writes their responses together. Notifications have no response, so a
+// batch made only of notifications gets an empty 204 response.
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request, batch BatchCodecRequest) {
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+
+    if limited, ok := batch.(LimitedBatchCodecRequest); ok && s.maxBatch > 0 {
+        limited.LimitBatch(s.maxBatch)
+    }
+    requests := batch.Requests()
+    if len(requests) == 0 {
+        batch.WriteError(w, 400, NewError(CodeInvalidRequest, "rpc: empty batch"))
+        return
+    }
+    if s.maxBatch > 0 && len(requests) > s.maxBatch {
+        batch.WriteError(w, 400, NewError(CodeInvalidRequest, fmt.Sprintf("rpc: batch too large, at most %d requests allowed", s.maxBatch)))
         return
     }
 
-    // Create a new codec request.
-    codecReq := codec.NewRequest(r)
+    bufs := make([]*responseBuffer, len(requests))
+    if s.batchParallel > 1 {
+        s.serveParallel(bufs, r, requests)
+    } else {
+        failed := false
+        for i, codecReq := range requests {
+            bufs[i] = newResponseBuffer(0)
+            if failed {
+                s.skipRequest(bufs[i], codecReq)
+                continue
+            }
+            failed = s.serveRequest(bufs[i], r, codecReq) != nil && s.stopBatch
+        }
+    }
+
+    responses := make([][]byte, 0, len(requests))
+    for _, buf := range bufs {
+        if buf.body.Len() == 0 {
+            continue
+        }
+        for k, v := range buf.header {
+            w.Header()[k] = v
+        }
+        responses = append(responses, buf.body.Bytes())
+    }
+
+    if len(responses) == 0 {
+        w.WriteHeader(204)
+        return
+    }
+    batch.WriteBatch(w, responses)
+}
+
+// serveParallel dispatches the requests of a batch concurrently, up to the
+// limit of ServerBatchParallel, each into its buffer of bufs.
+func (s *Server) serveParallel(bufs []*responseBuffer, r *http.Request, requests []CodecRequest) {
+    sem := make(chan struct{}, s.batchParallel)
+    var wg sync.WaitGroup
+    var failed int32 // set once a request failed, with ServerStopBatchOnError
+    // Nothing recovers the panics of the goroutines below, so methods are
+    // recovered from as with ServerRecovery.
+    r = r.WithContext(context.WithValue(r.Context(), recoverPanicsKey, true))
+    for i, codecReq := range requests {
+        bufs[i] = newResponseBuffer(0)
+        sem <- struct{}{}
+        if atomic.LoadInt32(&failed) != 0 {
+            <-sem
+            s.skipRequest(bufs[i], codecReq)
+            continue
+        }
+        wg.Add(1)
+        go func(buf *responseBuffer, codecReq CodecRequest) {
+            defer func() {
+                if recovered := recover(); recovered != nil {
+                    // Panics out of methods, e.g. in hooks, still fail
+                    // this request only.
+                    method, _ := codecReq.Method()
+                    errPanic := s.recoverError(r.Context(), method, recovered)
+                    buf.reset()
+                    if n, ok := codecReq.(NotificationCodecRequest); !ok || !n.IsNotification() {
+                        codecReq.WriteError(buf, s.errorStatus(errPanic), errPanic)
+                    }
+                    if s.stopBatch {
+                        atomic.StoreInt32(&failed, 1)
+                    }
+                }
+                <-sem
+                wg.Done()
+            }()
+            if s.serveRequest(buf, r, codecReq) != nil && s.stopBatch {
+                atomic.StoreInt32(&failed, 1)
+            }
+        }(bufs[i], codecReq)
+    }
+    wg.Wait()
+}
+
+// errSkipped is the error of the requests of a batch skipped after a prior
+// one failed, see ServerStopBatchOnError.
+var errSkipped = NewError(CodeServer, "rpc: skipped due to prior error")
+
+// skipRequest writes the response of a request of a batch that is not
+// dispatched because a prior one failed.
+func (s *Server) skipRequest(w http.ResponseWriter, codecReq CodecRequest) {
+    if n, ok := codecReq.(NotificationCodecRequest); ok && n.IsNotification() {
+        w.WriteHeader(204)
+        return
+    }
+    codecReq.WriteError(w, s.errorStatus(errSkipped), errSkipped)
+}
+
+// serveRequest dispatches a single request and writes its response.
+// Notifications are still dispatched, but get an empty 204 response
+// whatever the outcome. It returns the error the request failed with, nil
+// if it succeeded or its response was replayed.
+func (s *Server) serveRequest(w http.ResponseWriter, r *http.Request, codecReq CodecRequest) error {
+    ctx := r.Context()
+
+    if v1, ok := codecReq.(Version1CodecRequest); ok && s.allowVersion1 {
+        v1.AllowVersion1()
+    }
 
     // Get service method to be called.
     method, errMethod := codecReq.Method()
     if errMethod != nil {
-        codecReq.WriteError(w, 400, errMethod)
-        return
+        codecReq.WriteError(w, s.errorStatus(errMethod), errMethod)
+        return errMethod
+    }
+    // Hooks and per-method settings see the registered name.
+    method = s.serviceMap().canonical(method)
+
+    if strict, ok := codecReq.(StrictCodecRequest); ok && s.strictParams {
+        strict.DisallowUnknownFields()
+    }
+
+    notification := false
+    if n, ok := codecReq.(NotificationCodecRequest); ok {
+        notification = n.IsNotification()
     }
 
+    if s.timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, s.timeout)
+        defer cancel()
+    }
+
+    ctx, state := withRequestState(ctx)
+    state.info = CallInfo{
+        Method:       method,
+        Notification: notification,
+        BytesRead:    len(codecReq.Body()),
+        Start:        time.Now(),
+    }
+    if idReq, ok := codecReq.(IDCodecRequest); ok {
+        state.info.ID = idReq.RequestID()
+    }
+    state.sampled = s.sampler == nil || s.sampler(ctx, method)
+
     for _, before := range s.before {
-        ctx = before(ctx, method, r.Header, codecReq)
+        var handled bool
+        var reply interface{}
+        var errResult error
+        ctx, handled, reply, errResult = before(ctx, method, r.Header, codecReq)
+        if handled {
+            state.info.Handled = true
+            if errResult != nil && len(s.errorMappers) > 0 {
+                errResult = s.mapError(errResult)
+            }
+            s.finish(ctx, w, codecReq, method, notification, state, reply, errResult)
+            return errResult
+        }
     }
 
-    serviceSpec, methodSpec, errGet := s.services.get(method)
-    if errGet != nil {
-        codecReq.WriteError(w, 400, errGet)
-        return
+    for _, auth := range s.auth {
+        errAuth := auth(ctx, method, r.Header)
+        if errAuth == nil {
+            continue
+        }
+        for _, after := range s.after {
+            after(ctx, method, nil, errAuth)
+        }
+        if notification {
+            w.WriteHeader(204)
+            return errAuth
+        }
+        var jsonErr *Error
+        if !errors.As(errAuth, &jsonErr) {
+            jsonErr = NewError(CodeServer, errAuth.Error())
+        }
+        codecReq.WriteError(w, 401, jsonErr)
+        return errAuth
     }
-    refValue := []reflect.Value{serviceSpec.rcvr}
-    // Decode the args.
-    if len(methodSpec.argsType) > 0 {
-        for i := 0; i < len(methodSpec.argsType); i++ {
-            arg := reflect.New(methodSpec.argsType[i])
-            if methodSpec.argsType[i] != typeOfContext {
-                if errRead := codecReq.ReadRequest(arg.Interface()); errRead != nil {
-                    codecReq.WriteError(w, 400, errRead)
-                    return
+
+    if s.idempotency != nil && !notification {
+        if key := s.idempotency.key(r, method, codecReq); key != "" {
+            var err error
+            errWait := s.idempotency.serve(ctx, w, key, func(w http.ResponseWriter) {
+                err = s.serveMethod(ctx, w, r, codecReq, method, notification, state)
+            })
+            if errWait == nil {
+                return err
+            }
+            // The request of the same key being served took too long.
+            if errClient := r.Context().Err(); errClient != nil {
+                for _, after := range s.after {
+                    after(ctx, method, nil, errClient)
                 }
-            } else {
-                arg = reflect.ValueOf(ctx)
+                return errClient
             }
-            refValue = append(refValue, arg)
+            errTimeout := NewError(CodeTimeout, "rpc: request timed out")
+            s.finish(ctx, w, codecReq, method, notification, state, nil, errTimeout)
+            return errTimeout
         }
     }
+    return s.serveMethod(ctx, w, r, codecReq, method, notification, state)
+}
 
-    retValues := methodSpec.method.Func.Call(refValue)
+// serveMethod calls the method of an authorized request, writes its
+// response and returns the error it failed with.
+func (s *Server) serveMethod(ctx context.Context, w http.ResponseWriter, r *http.Request, codecReq CodecRequest, method string, notification bool, state *requestState) error {
+    serviceSpec, methodSpec, errGet := s.serviceMap().get(method)
+    if errGet != nil {
+        for _, after := range s.after {
+            after(ctx, method, nil, errGet)
+        }
+        if notification {
+            w.WriteHeader(204)
+            return errGet
+        }
+        // Unknown services, methods and ill-formed names are all methods
+        // that don't exist for the client.
+        errNotFound := NewError(CodeMethodNotFound, "rpc: method not found: "+method)
+        codecReq.WriteError(w, s.errorStatus(errNotFound), errNotFound)
+        return errNotFound
+    }
+    state.info.Found = true
 
-    // Cast the result to error if needed.
+    var reply interface{}
     var errResult error
-    errInter := retValues[1].Interface()
-    if errInter != nil {
-        errResult = errInter.(error)
+    if errLimit := s.rateLimit(r, method); errLimit != nil {
+        errResult = errLimit
+    } else {
+        start := time.Now()
+        reply, errResult = s.dispatch(ctx, r, codecReq, method, serviceSpec, methodSpec)
+        state.info.Duration = time.Since(start)
+        if s.slowLog != nil && state.info.Duration > s.slowThreshold {
+            s.slowLog(method, state.info.Duration)
+        }
+    }
+    if s.timeout > 0 && ctx.Err() == context.DeadlineExceeded && !state.streamed {
+        reply, errResult = nil, NewError(CodeTimeout, "rpc: request timed out")
+    }
+    if errClient := r.Context().Err(); errClient != nil {
+        // The client went away: nobody reads the response.
+        for _, after := range s.after {
+            after(ctx, method, nil, errClient)
+        }
+        return errClient
+    }
+    if errResult != nil && len(s.errorMappers) > 0 {
+        errResult = s.mapError(errResult)
+    }
+    s.finish(ctx, w, codecReq, method, notification, state, reply, errResult)
+    return errResult
+}
+
+// finish runs the after hooks with the outcome of the method and writes
+// its response.
+func (s *Server) finish(ctx context.Context, w http.ResponseWriter, codecReq CodecRequest, method string, notification bool, state *requestState, reply interface{}, errResult error) {
+    for _, after := range s.after {
+        after(ctx, method, reply, errResult)
+    }
+
+    if notification {
+        w.WriteHeader(204)
+        return
     }
 
     // Prevents Internet Explorer from MIME-sniffing a response away
     // from the declared content-type
-    w.Header().Set("x-content-type-options", "nosniff")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+
+    if state.uncacheable {
+        w.Header().Set("Cache-Control", "no-store")
+    }
 
     // Encode the response.
-    if errResult == nil {
-        valRet := retValues[0].Interface()
-        codecReq.WriteResponse(w, valRet)
+    if errResult != nil {
+        var fields FieldErrors
+        if errors.As(errResult, &fields) {
+            errResult = &Error{Code: CodeBadParams, Message: fields.Error(), Data: fields}
+        }
+        var retryable *RetryableError
+        if errors.As(errResult, &retryable) {
+            after := int(math.Ceil(retryable.After.Seconds()))
+            w.Header().Set("Retry-After", strconv.Itoa(after))
+            codecReq.WriteError(w, 429, retryable.sent())
+            return
+        }
+        // Errors of the method are sent as is when they are *Error, with
+        // their code and data; others are server errors, with a 400
+        // status still.
+        status := s.errorStatus(errResult)
+        var jsonErr *Error
+        if !errors.As(errResult, &jsonErr) {
+            jsonErr = NewError(CodeServer, errResult.Error())
+            if s.debug {
+                jsonErr.Data = newDebugData(errResult)
+            }
+        }
+        codecReq.WriteError(w, status, jsonErr)
+        return
+    }
+
+    if limit, ok := s.maxResponse[method]; ok {
+        buf := newResponseBuffer(limit)
+        err := codecReq.WriteResponse(buf, reply)
+        if buf.overflow {
+            codecReq.WriteError(w, 500, NewError(CodeInternal, errResponseTooLarge))
+            return
+        }
+        buf.flush(w)
+        s.responseError(ctx, method, err)
+        return
+    }
+
+    s.responseError(ctx, method, codecReq.WriteResponse(w, reply))
+}
+
+// responseError passes the error writing the response of method, if any, to
+// the response error hooks.
+func (s *Server) responseError(ctx context.Context, method string, err error) {
+    if err == nil {
+        return
+    }
+    for _, fn := range s.responseErrors {
+        fn(ctx, method, err)
+    }
+}
+
+// rateLimit returns a RetryableError if the client of r is over its limit
+// for method, nil otherwise.
+func (s *Server) rateLimit(r *http.Request, method string) error {
+    if s.rateLimiter == nil {
+        return nil
+    }
+    var limit *RateLimit
+    if l, ok := s.methodLimits[method]; ok {
+        limit = &l
+    }
+    if after := s.rateLimiter.reserve(r, method, limit); after > 0 {
+        return &RetryableError{After: after, Err: NewError(CodeServer, "rpc: rate limit exceeded")}
+    }
+    return nil
+}
+
+// dispatch calls a method within the limit of concurrent calls, unless the
+// server is shutting down.
+func (s *Server) dispatch(ctx context.Context, r *http.Request, codecReq CodecRequest, method string, serviceSpec *service, methodSpec *serviceMethod) (interface{}, error) {
+    s.shutdownMutex.RLock()
+    if s.shutdown {
+        s.shutdownMutex.RUnlock()
+        return nil, errShuttingDown
+    }
+    s.active.Add(1)
+    s.shutdownMutex.RUnlock()
+    defer s.active.Done()
+
+    if s.concurrency != nil {
+        if s.rejectOverLimit {
+            select {
+            case s.concurrency <- struct{}{}:
+            default:
+                return nil, errTooManyRequests
+            }
+        } else {
+            select {
+            case s.concurrency <- struct{}{}:
+            case <-ctx.Done():
+                return nil, ctx.Err()
+            }
+        }
+        defer func() { <-s.concurrency }()
+    }
+
+    atomic.AddInt64(&s.inFlight, 1)
+    defer atomic.AddInt64(&s.inFlight, -1)
+
+    reply, err := s.call(ctx, r, codecReq, method, serviceSpec, methodSpec)
+    if sse, ok := codecReq.(*sseCodecRequest); ok && err == nil {
+        if streamer, ok := reply.(Streamer); ok {
+            // Streams are part of the call, see SSEHandler.
+            if state := getRequestState(ctx); state != nil {
+                state.streamed = true
+            }
+            return reply, sse.stream(streamer, s.maxResponse[method])
+        }
+    }
+    return reply, err
+}
+
+// call decodes the arguments of a method and invokes it.
+func (s *Server) call(ctx context.Context, r *http.Request, codecReq CodecRequest, method string, serviceSpec *service, methodSpec *serviceMethod) (reply interface{}, err error) {
+    if s.panicError != nil || s.recovery != nil || ctx.Value(recoverPanicsKey) != nil {
+        defer func() {
+            if recovered := recover(); recovered != nil {
+                reply, err = nil, s.recoverError(ctx, method, recovered)
+            }
+        }()
+    }
+
+    if methodSpec.dynamic != nil {
+        var params json.RawMessage
+        if errRead := codecReq.ReadRequest(&params); errRead != nil {
+            return nil, errRead
+        }
+        if len(s.middleware) == 0 {
+            return methodSpec.dynamic(ctx, params)
+        }
+        invoke := func(ctx context.Context, args, reply interface{}) error {
+            params, ok := args.(*json.RawMessage)
+            if !ok {
+                return NewError(CodeInternal, fmt.Sprintf("rpc: middleware passed args of type %T, want *json.RawMessage", args))
+            }
+            result, err := methodSpec.dynamic(ctx, *params)
+            if err != nil {
+                return err
+            }
+            return setReply(reply, typeOfRawMessage, result)
+        }
+        return s.handle(ctx, method, typeOfRawMessage, &params, invoke)
+    }
+
+    if methodSpec.typed != nil {
+        args, errRead := methodSpec.typed.read(codecReq)
+        if errRead != nil {
+            return nil, errRead
+        }
+        if len(s.middleware) == 0 {
+            return methodSpec.typed.call(ctx, args)
+        }
+        invoke := func(ctx context.Context, args, reply interface{}) error {
+            if _, err := handlerArg("args", args, reflect.PtrTo(methodSpec.argsType[0])); err != nil {
+                return err
+            }
+            result, err := methodSpec.typed.call(ctx, args)
+            if err != nil {
+                return err
+            }
+            return setReply(reply, methodSpec.replyType, result)
+        }
+        return s.handle(ctx, method, methodSpec.replyType, args, invoke)
+    }
+
+    refValue := make([]reflect.Value, 0, len(methodSpec.argsType)+1)
+    var ctxIndexes []int
+    var params interface{}
+    paramsIndex := -1
+    fn := methodSpec.fn
+    if !fn.IsValid() {
+        rcvr, errRcvr := serviceSpec.receiver()
+        if errRcvr != nil {
+            return nil, NewError(CodeInternal, fmt.Sprintf("rpc: can't initialize service %q: %v", serviceSpec.name, errRcvr))
+        }
+        refValue = append(refValue, rcvr)
+        fn = methodSpec.method.Func
+    }
+
+    // Decode the args. Methods taking no params args leave the params
+    // alone, so codecs decoding them lazily never do.
+    for i := 0; i < len(methodSpec.argsType); i++ {
+        var arg reflect.Value
+        switch methodSpec.argsType[i] {
+        case typeOfContext:
+            arg = reflect.ValueOf(ctx)
+            ctxIndexes = append(ctxIndexes, len(refValue))
+        case typeOfRequest:
+            arg = reflect.ValueOf(r)
+        default:
+            arg = reflect.New(methodSpec.argsType[i])
+            if isHeaderArgs(methodSpec.argsType[i]) {
+                if errRead := readHeader(r.Header, arg); errRead != nil {
+                    return nil, errRead
+                }
+                break
+            }
+            if errRead := readArgs(codecReq, arg.Interface()); errRead != nil {
+                return nil, errRead
+            }
+            if params == nil {
+                params = arg.Interface()
+                paramsIndex = len(refValue)
+            }
+        }
+        refValue = append(refValue, arg)
+    }
+    if methodSpec.replyArg {
+        refValue = append(refValue, reflect.New(methodSpec.replyType))
+    }
+
+    if len(s.middleware) == 0 {
+        return callFunc(fn, refValue)
+    }
+
+    invoke := func(ctx context.Context, args, reply interface{}) error {
+        // Middleware may have replaced the context and the args.
+        for _, i := range ctxIndexes {
+            refValue[i] = reflect.ValueOf(ctx)
+        }
+        if paramsIndex >= 0 {
+            arg, err := handlerArg("args", args, refValue[paramsIndex].Type())
+            if err != nil {
+                return err
+            }
+            refValue[paramsIndex] = arg
+        }
+        if methodSpec.replyArg {
+            arg, err := handlerArg("reply", reply, refValue[len(refValue)-1].Type())
+            if err != nil {
+                return err
+            }
+            refValue[len(refValue)-1] = arg
+        }
+        result, err := callFunc(fn, refValue)
+        if err != nil || methodSpec.replyArg {
+            return err
+        }
+        return setReply(reply, methodSpec.replyType, result)
+    }
+    return s.handle(ctx, method, methodSpec.replyType, params, invoke)
+}
+
+// readArgs decodes the params into a freshly allocated argument, setting
+// its defaults before and validating it after.
+func readArgs(codecReq CodecRequest, arg interface{}) error {
+    if d, ok := arg.(Defaulter); ok {
+        d.SetDefaults()
+    }
+    if err := codecReq.ReadRequest(arg); err != nil {
+        return err
+    }
+    if v, ok := arg.(Validator); ok {
+        if err := v.Validate(); err != nil {
+            var fields FieldErrors
+            if errors.As(err, &fields) {
+                return fields
+            }
+            return NewError(CodeBadParams, err.Error())
+        }
+    }
+    return nil
+}
+
+// callFunc calls a method or function and returns its reply and error.
+// Methods returning only an error have filled the reply their last arg
+// points to.
+func callFunc(fn reflect.Value, in []reflect.Value) (interface{}, error) {
+    retValues := fn.Call(in)
+
+    // Cast the result to error if needed.
+    if errInter := retValues[len(retValues)-1].Interface(); errInter != nil {
+        return nil, errInter.(error)
+    }
+    if len(retValues) == 1 {
+        return in[len(in)-1].Elem().Interface(), nil
+    }
+    return retValues[0].Interface(), nil
+}
+
+// handle calls a method through the middleware matching it, invoke being
+// the innermost handler, and returns the reply it filled.
+func (s *Server) handle(ctx context.Context, method string, replyType reflect.Type, args interface{}, invoke MethodHandler) (interface{}, error) {
+    reply := reflect.New(replyType)
+    if err := s.wrap(method, invoke)(ctx, args, reply.Interface()); err != nil {
+        return nil, err
+    }
+    return reply.Elem().Interface(), nil
+}
+
+// handlerArg returns the args or reply passed on by middleware as a value
+// of type t, the type the method takes.
+func handlerArg(name string, v interface{}, t reflect.Type) (reflect.Value, error) {
+    value := reflect.ValueOf(v)
+    if !value.IsValid() || value.Type() != t {
+        return reflect.Value{}, NewError(CodeInternal, fmt.Sprintf("rpc: middleware passed %s of type %T, want %v", name, v, t))
+    }
+    return value, nil
+}
+
+// setReply stores the result of a method in the reply its handler got, a
+// pointer to a replyType.
+func setReply(reply interface{}, replyType reflect.Type, result interface{}) error {
+    value, err := handlerArg("reply", reply, reflect.PtrTo(replyType))
+    if err != nil {
+        return err
+    }
+    if result == nil {
+        value.Elem().Set(reflect.Zero(replyType))
     } else {
-        codecReq.WriteError(w, 400, errResult)
+        value.Elem().Set(reflect.ValueOf(result))
+    }
+    return nil
+}
+
+// wrap wraps a method handler with the middleware whose pattern matches
+// the method, the first registered being the outermost.
+func (s *Server) wrap(method string, handler MethodHandler) MethodHandler {
+    for i := len(s.middleware) - 1; i >= 0; i-- {
+        if matchPattern(s.middleware[i].pattern, method) {
+            handler = s.middleware[i].mw(handler)
+        }
+    }
+    return handler
+}
+
+// matchPattern reports whether name matches pattern, where "*" matches any
+// sequence of characters.
+func matchPattern(pattern, name string) bool {
+    parts := strings.Split(pattern, "*")
+    if len(parts) == 1 {
+        return pattern == name
+    }
+    if !strings.HasPrefix(name, parts[0]) {
+        return false
+    }
+    name = name[len(parts[0]):]
+    for _, part := range parts[1 : len(parts)-1] {
+        i := strings.Index(name, part)
+        if i < 0 {
+            return false
+        }
+        name = name[i+len(part):]
+    }
+    return strings.HasSuffix(name, parts[len(parts)-1])
+}
+
+// recoverError builds the error returned to the client for a recovered
+// panic, giving the recovery function a chance to replace it.
+func (s *Server) recoverError(ctx context.Context, method string, recovered interface{}) *Error {
+    p := s.panicError
+    if p == nil {
+        p = &panicError{code: CodeInternal}
+    }
+    stack := debug.Stack()
+    var jsonErr *Error
+    if s.recovery != nil {
+        if err := s.recovery(ctx, method, recovered, stack); err != nil {
+            if jsonErr, ok := err.(*Error); ok {
+                return jsonErr
+            }
+            jsonErr = NewError(p.code, err.Error())
+        }
+    }
+    if jsonErr == nil {
+        jsonErr = p.newError(recovered)
+    }
+    if s.debug {
+        jsonErr.Data = &DebugData{Error: fmt.Sprintf("panic: %v", recovered), Stack: string(stack)}
+    }
+    return jsonErr
+}
+
+// newError builds the default error returned to the client for a recovered
+// panic.
+func (p *panicError) newError(recovered interface{}) *Error {
+    if p.exposeMessage {
+        return NewError(p.code, fmt.Sprintf("rpc: panic: %v", recovered))
+    }
+    return NewError(p.code, "rpc: internal error")
+}
+
+// ErrorStatus returns the default HTTP status of error responses with the
+// given code.
+func ErrorStatus(code ErrorCode) int {
+    switch {
+    case code == CodeMethodNotFound:
+        return 404
+    case code == CodeInternal:
+        return 500
+    case code == CodeTimeout:
+        return 504
+    case code <= CodeServer && code > CodeServer-100:
+        return 500
+    default:
+        return 400
+    }
+}
+
+// mapError returns the error of the first matcher of MapError matching err,
+// or err if none does or it already is a JSON-RPC error.
+func (s *Server) mapError(err error) error {
+    var jsonErr *Error
+    var fields FieldErrors
+    var retryable *RetryableError
+    if errors.As(err, &jsonErr) || errors.As(err, &fields) || errors.As(err, &retryable) {
+        return err
+    }
+    for _, match := range s.errorMappers {
+        if mapped, ok := match(err); ok && mapped != nil {
+            return mapped
+        }
+    }
+    return err
+}
+
+// errTooManyRequests is returned for calls over the concurrency limit.
+var errTooManyRequests = NewError(CodeServer, "rpc: too many concurrent requests")
+
+// errShuttingDown is returned for calls once the server is shutting down.
+var errShuttingDown = NewError(CodeServer, "rpc: server is shutting down")
+
+// errorStatus returns the HTTP status of the response to an error: the
+// status of its code for *Error, see ServerStatusMapper, and 400 for other
+// errors. Calls rejected over the concurrency limit or during shutdown get
+// 503.
+func (s *Server) errorStatus(err error) int {
+    if err == errTooManyRequests || err == errShuttingDown {
+        return 503
+    }
+    var jsonErr *Error
+    if !errors.As(err, &jsonErr) {
+        return 400
+    }
+    if s.statusMapper != nil {
+        if status := s.statusMapper(jsonErr.Code); status != 0 {
+            return status
+        }
+    }
+    return ErrorStatus(jsonErr.Code)
+}
+
+// getRequest returns the POST request equivalent to a GET request with the
+// method, params and id in the query string.
+func getRequest(r *http.Request) (*http.Request, error) {
+    query := r.URL.Query()
+    request := struct {
+        Version string          `json:"jsonrpc"`
+        Method  string          `json:"method"`
+        Params  json.RawMessage `json:"params,omitempty"`
+        ID      json.RawMessage `json:"id"`
+    }{Version: "2.0", Method: query.Get("method"), ID: json.RawMessage("null")}
+
+    // Params and id are checked to be single JSON values, so they can't
+    // change the method.
+    if params := query.Get("params"); params != "" {
+        if !json.Valid([]byte(params)) {
+            return nil, errors.New("params must be JSON")
+        }
+        request.Params = json.RawMessage(params)
+    }
+    if id := query.Get("id"); id != "" {
+        if !json.Valid([]byte(id)) {
+            return nil, errors.New("id must be JSON")
+        }
+        request.ID = json.RawMessage(id)
+    }
+    body, err := json.Marshal(request)
+    if err != nil {
+        return nil, err
+    }
+
+    post := r.Clone(r.Context())
+    post.Method = "POST"
+    post.Header.Set("Content-Type", "application/json")
+    post.Body = ioutil.NopCloser(bytes.NewReader(body))
+    post.ContentLength = int64(len(body))
+    return post, nil
+}
+
+// errBodyTooLarge is returned for bodies over the limit of
+// ServerMaxBodyBytes once decompressed.
+var errBodyTooLarge = errors.New("request body too large")
+
+// writeTooLarge answers a request whose body is over the limit of
+// ServerMaxBodyBytes with an error written by codec.
+func (s *Server) writeTooLarge(w http.ResponseWriter, r *http.Request, codec Codec) {
+    writeBodyError(w, r, codec, 413, NewError(CodeInvalidRequest, "rpc: "+errBodyTooLarge.Error()))
+}
+
+// writeBodyError answers a request whose body could not be read with err,
+// written by codec so that clients can parse it.
+func writeBodyError(w http.ResponseWriter, r *http.Request, codec Codec, status int, err *Error) {
+    r.Body = ioutil.NopCloser(bytes.NewReader(nil))
+    codec.NewRequest(r).WriteError(w, status, err)
+}
+
+var errBodyReadTimeout = errors.New("timeout reading request body")
+
+// deadlineReader fails the reads of a request body past the deadline of
+// ServerBodyReadTimeout. The read deadline set on the connection makes a
+// read waiting for a slow client fail; when the ResponseWriter can't set
+// one, the deadline is only checked between reads.
+type deadlineReader struct {
+    io.ReadCloser
+    deadline time.Time
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+    if !time.Now().Before(r.deadline) {
+        return 0, errBodyReadTimeout
+    }
+    n, err := r.ReadCloser.Read(p)
+    if errors.Is(err, os.ErrDeadlineExceeded) {
+        err = errBodyReadTimeout
     }
+    return n, err
 }
 
 // WriteError send error to client
@@ -1,10 +1,18 @@
 package jsonrpc
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Service1Request struct {
@@ -28,6 +36,16 @@ func (t *Service1) Multiply(
 type Service2 struct {
 }
 
+type Service3 struct {
+}
+
+func (t *Service3) Sum(
+	r *http.Request,
+	a *Service1Request,
+	b *Service1Request) (*Service1Response, error) {
+	return &Service1Response{Result: a.A + a.B + b.A + b.B}, nil
+}
+
 func TestRegisterService(t *testing.T) {
 	var err error
 
@@ -58,6 +76,498 @@ func TestRegisterService(t *testing.T) {
 	}
 }
 
+func TestRegisterServices(t *testing.T) {
+	s := NewServer()
+
+	if err := s.RegisterServices(new(Service1), new(Service3)); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("Service1.Multiply") || !s.HasMethod("Service3.Sum") {
+		t.Errorf("Expected to be registered: Service1.Multiply, Service3.Sum")
+	}
+
+	// A failure registers none of the services.
+	for _, receivers := range [][]interface{}{
+		{new(Service4), new(Service1)},
+		{new(Service4), new(Service2)},
+		{new(Service4), new(Service4)},
+	} {
+		if err := s.RegisterServices(receivers...); err == nil {
+			t.Errorf("Expected error registering %T and %T", receivers[0], receivers[1])
+		}
+		if s.HasMethod("Service4.GetUser") {
+			t.Fatalf("Expected not to be registered: Service4.GetUser")
+		}
+	}
+}
+
+type Multiplier interface {
+	Multiply(r *http.Request, req *Service1Request) (*Service1Response, error)
+}
+
+type BadMultiplier interface {
+	Multiply(req Service1Request) (*Service1Response, error)
+}
+
+type tenTimes struct {
+}
+
+func (t *tenTimes) Multiply(r *http.Request, req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{Result: req.A * req.B * 10}, nil
+}
+
+func (t *tenTimes) Helper(r *http.Request, req *Service1Request) (*Service1Response, error) {
+	return nil, nil
+}
+
+func TestRegisterInterface(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	if err := s.RegisterInterface((*Multiplier)(nil), new(tenTimes), "Service1"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("Service1.Multiply") || s.HasMethod("Service1.Helper") {
+		t.Errorf("Expected only the methods of the interface, got %v", s.Methods())
+	}
+
+	// Inferred name.
+	if err := s.RegisterInterface((*Multiplier)(nil), new(tenTimes), ""); err != nil || !s.HasMethod("Multiplier.Multiply") {
+		t.Errorf("Expected to be registered: Multiplier.Multiply %v", err)
+	}
+
+	for name, args := range map[string][2]interface{}{
+		"NotInterface": {new(tenTimes), new(tenTimes)},
+		"NotPointer":   {Multiplier(new(tenTimes)), new(tenTimes)},
+		"NotImpl":      {(*Multiplier)(nil), new(Service3)},
+		"NilImpl":      {(*Multiplier)(nil), nil},
+		"BadSignature": {(*BadMultiplier)(nil), new(tenTimes)},
+	} {
+		if err := s.RegisterInterface(args[0], args[1], name); err == nil {
+			t.Errorf("Expected error registering %s", name)
+		}
+	}
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+
+	if w.Body != "60" {
+		t.Errorf("Response body was %s, should be 60.", w.Body)
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	multiply := func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{Result: req.A * req.B * 10}, nil
+	}
+
+	if err := s.RegisterFunc("Service1.Multiply", multiply); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RegisterFunc("Service1.Other", multiply); err != nil || !s.HasMethod("Service1.Other") {
+		t.Error("Expected to be registered: Service1.Other", err)
+	}
+
+	s.RegisterService(new(Service3), "")
+
+	for name, fn := range map[string]interface{}{
+		"Service1.Multiply": multiply,
+		"Service3.Multiply": multiply,
+		"Multiply":          multiply,
+		"Service1.NotFunc":  42,
+		"Service1.BadFunc":  func(ctx context.Context) error { return nil },
+	} {
+		if err := s.RegisterFunc(name, fn); err == nil {
+			t.Errorf("Expected error registering %s", name)
+		}
+	}
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+
+	if w.Body != "60" {
+		t.Errorf("Response body was %s, should be 60.", w.Body)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service3), "")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(Service1), "Alias")
+
+	expected := "Alias.Multiply, Service1.Multiply, Service3.Sum"
+	if got := strings.Join(s.Methods(), ", "); got != expected {
+		t.Errorf("Methods were %q, should be %q.", got, expected)
+	}
+
+	argType, replyType, ok := s.MethodInfo("Service1.Multiply")
+	if !ok || argType != reflect.TypeOf(&Service1Request{}) || replyType != reflect.TypeOf(&Service1Response{}) {
+		t.Errorf("Wrong info for Service1.Multiply: %v, %v, %v", argType, replyType, ok)
+	}
+
+	if _, _, ok := s.MethodInfo("Service1.Unknown"); ok {
+		t.Error("Expected no info for Service1.Unknown")
+	}
+}
+
+type Service5 struct {
+}
+
+func (t *Service5) Multiply(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{Result: req.A * req.B}, nil
+}
+
+func (t *Service5) Ping(ctx context.Context) (*Service1Response, error) {
+	return &Service1Response{}, nil
+}
+
+func (t *Service5) Read(r io.Reader) (*Service1Response, error) {
+	return &Service1Response{}, nil
+}
+
+func (t *Service5) Echo(ctx context.Context, args interface{}) (interface{}, error) {
+	return *args.(*interface{}), nil
+}
+
+func TestContextMethods(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	if err := s.RegisterService(new(Service5), "Service1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.HasMethod("Service1.Ping") {
+		t.Error("Expected to be registered: Service1.Ping")
+	}
+
+	if s.HasMethod("Service1.Read") {
+		t.Error("Expected not to be registered: Service1.Read")
+	}
+
+	// interface{} args get a pointer to the params, as they always did.
+	var echo interface{}
+	if err := s.Invoke(context.Background(), "Service1.Echo", "hello", &echo); err != nil || echo != "hello" {
+		t.Errorf("Expected the params echoed, got %v, %v", echo, err)
+	}
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+
+	if w.Body != "6" {
+		t.Errorf("Response body was %s, should be 6.", w.Body)
+	}
+}
+
+func TestUse(t *testing.T) {
+	var calls []string
+
+	trace := func(name string) MethodMiddleware {
+		return func(next MethodHandler) MethodHandler {
+			return func(ctx context.Context, args, reply interface{}) error {
+				calls = append(calls, name)
+				if req, ok := args.(*Service1Request); !ok || req.A != 2 || req.B != 3 {
+					t.Errorf("Wrong args: %v", args)
+				}
+				return next(ctx, args, reply)
+			}
+		}
+	}
+
+	s := NewServer()
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	s.RegisterService(new(Service1), "")
+
+	s.Use("Service1.*", trace("first"))
+	s.Use("*.Other", trace("other"))
+	s.Use("*", trace("second"))
+	s.Use("Service1.Multiply", func(next MethodHandler) MethodHandler {
+		return func(ctx context.Context, args, reply interface{}) error {
+			req := *args.(*Service1Request)
+			req.A *= 2
+			if err := next(ctx, &req, reply); err != nil {
+				return err
+			}
+			(*reply.(**Service1Response)).Result++
+			return nil
+		}
+	})
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+
+	if w.Body != "13" {
+		t.Errorf("Response body was %s, should be 13.", w.Body)
+	}
+
+	if got := strings.Join(calls, ", "); got != "first, second" {
+		t.Errorf("Middleware calls were %q, should be \"first, second\".", got)
+	}
+
+	s.Use("*", func(next MethodHandler) MethodHandler {
+		return func(ctx context.Context, args, reply interface{}) error {
+			return next(ctx, "2x3", reply)
+		}
+	})
+	var res Service1Response
+	err = s.Invoke(context.Background(), "Service1.Multiply", &Service1Request{2, 3}, &res)
+	if ErrorCodeOf(err) != CodeInternal {
+		t.Errorf("Expected an internal error for args of another type, got %v", err)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"Admin.*", "Admin.Delete", true},
+		{"Admin.*", "Users.Delete", false},
+		{"*.Delete", "Admin.Delete", true},
+		{"*", "Admin.Delete", true},
+		{"A*.D*e", "Admin.Delete", true},
+		{"A*.D*x", "Admin.Delete", false},
+		{"Admin.Delete", "Admin.Delete", true},
+		{"Admin.Delete", "Admin.DeleteAll", false},
+	} {
+		if got := matchPattern(tc.pattern, tc.name); got != tc.match {
+			t.Errorf("matchPattern(%q, %q) = %v, should be %v", tc.pattern, tc.name, got, tc.match)
+		}
+	}
+}
+
+func TestRegisterServiceLazy(t *testing.T) {
+	var built int
+
+	s := NewServer()
+
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	err := s.RegisterServiceLazy((*Service1)(nil), "", func() (interface{}, error) {
+		built++
+		if built == 1 {
+			return nil, errors.New("not yet")
+		}
+		return new(Service1), nil
+	})
+
+	if err != nil || !s.HasMethod("Service1.Multiply") {
+		t.Fatal("Expected to be registered: Service1.Multiply", err)
+	}
+
+	if built != 0 {
+		t.Error("Expected receiver not to be built on registration")
+	}
+
+	for i, status := range []int{500, 200, 200} {
+		r, err := http.NewRequest("POST", "", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Content-Type", "mock")
+
+		w := NewMockResponseWriter()
+
+		s.ServeHTTP(w, r)
+
+		if w.Status != status {
+			t.Errorf("Call %d: status was %d, should be %d.", i, w.Status, status)
+		}
+	}
+
+	if built != 2 {
+		t.Errorf("Receiver was built %d times, should be 2.", built)
+	}
+}
+
+type Service4 struct {
+}
+
+func (t *Service4) GetUser(r *http.Request, req *Service1Request) (*Service1Response, error) {
+	return nil, nil
+}
+
+func (t *Service4) Get_User(r *http.Request, req *Service1Request) (*Service1Response, error) {
+	return nil, nil
+}
+
+func TestValidateRegistrations(t *testing.T) {
+	s := NewServer()
+
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(Service1), "Foo")
+
+	if err := s.ValidateRegistrations(); err != nil {
+		t.Error("Expected no conflicts, but got:", err)
+	}
+
+	s.RegisterService(new(Service4), "")
+	s.RegisterService(new(Service1), "service1")
+
+	err := s.ValidateRegistrations()
+
+	expected := "rpc: conflicting method names: Service1.Multiply, service1.Multiply; Service4.GetUser, Service4.Get_User"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q, but got: %v", expected, err)
+	}
+}
+
+func TestMaxMethodArgs(t *testing.T) {
+	s := NewServer(ServerMaxMethodArgs(1))
+
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Error("Expected Service1 to be registered, but got:", err)
+	}
+
+	err := s.RegisterService(new(Service3), "")
+
+	if err == nil || !strings.Contains(err.Error(), `"Service3.Sum"`) {
+		t.Error("Expected error naming Service3.Sum, but got:", err)
+	}
+
+	// The limit also applies to replaced services.
+	err = s.ReplaceServices(func(s *Server) error {
+		return s.RegisterService(new(Service3), "")
+	})
+
+	if err == nil {
+		t.Error("Expected error on Service3")
+	}
+
+	if err := NewServer().RegisterService(new(Service3), ""); err != nil {
+		t.Error("Expected no limit by default, but got:", err)
+	}
+}
+
+func TestMethodSeparator(t *testing.T) {
+	s := NewServer(ServerMethodSeparator("/"))
+
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.HasMethod("Service1/Multiply") {
+		t.Error("Expected to be registered: Service1/Multiply")
+	}
+
+	if s.HasMethod("Service1.Multiply") {
+		t.Error("Expected not to be registered: Service1.Multiply")
+	}
+}
+
+// Under_score has a method unreachable with the "_" separator.
+type Under_score struct{}
+
+func (u *Under_score) Get(req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{Result: req.A}, nil
+}
+
+func (u *Under_score) Get_All(req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{Result: req.A}, nil
+}
+
+func TestMethodSeparatorUnderscore(t *testing.T) {
+	s := NewServer(ServerMethodSeparator("_"))
+
+	if err := s.RegisterService(new(Service1), "user"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("user_Multiply") || s.HasMethod("user.Multiply") {
+		t.Error("Expected user_Multiply to be registered")
+	}
+	if err := s.RegisterFunc("user_getProfile", func(req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{Result: req.A}, nil
+	}); err == nil {
+		t.Error("Expected user to be a service of its own")
+	}
+	if err := s.RegisterFunc("profile_get", func(req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{Result: req.A}, nil
+	}); err != nil || !reflect.DeepEqual(s.Methods(), []string{"profile_get", "user_Multiply"}) {
+		t.Errorf("Unexpected methods %v, %v", s.Methods(), err)
+	}
+
+	if err := s.RegisterService(new(Under_score), ""); err == nil {
+		t.Error("Expected an error on a service name containing the separator")
+	}
+	if err := s.RegisterServices(new(Under_score)); err == nil {
+		t.Error("Expected an error on a service name containing the separator")
+	}
+	if err := s.RegisterService(new(Under_score), "under"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("under_Get") || s.HasMethod("under_Get_All") {
+		t.Error("Expected the method containing the separator to be ignored")
+	}
+
+	var res Service1Response
+	if err := s.Invoke(context.Background(), "user_Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+}
+
+func TestReplaceServices(t *testing.T) {
+	s := NewServer()
+
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failed replacement keeps the current services.
+	err := s.ReplaceServices(func(s *Server) error {
+		if err := s.RegisterService(new(Service1), "Foo"); err != nil {
+			return err
+		}
+		return s.RegisterService(new(Service2), "")
+	})
+
+	if err == nil {
+		t.Error("Expected error on service2")
+	}
+
+	if !s.HasMethod("Service1.Multiply") || s.HasMethod("Foo.Multiply") {
+		t.Error("Expected services to be kept")
+	}
+
+	err = s.ReplaceServices(func(s *Server) error {
+		return s.RegisterService(new(Service1), "Foo")
+	})
+
+	if err != nil || !s.HasMethod("Foo.Multiply") || s.HasMethod("Service1.Multiply") {
+		t.Error("Expected services to be replaced")
+	}
+}
+
 // MockCodec decodes to Service1.Multiply.
 type MockCodec struct {
 	A, B int
@@ -80,6 +590,10 @@ func (r MockCodecRequest) Method() (string, error) {
 	return "Service1.Multiply", nil
 }
 
+func (r MockCodecRequest) ID() interface{} {
+	return nil
+}
+
 func (r MockCodecRequest) ReadRequest(args interface{}) error {
 	req := args.(*Service1Request)
 	req.A, req.B = r.A, r.B
@@ -87,10 +601,11 @@ func (r MockCodecRequest) ReadRequest(args interface{}) error {
 	return nil
 }
 
-func (r MockCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+func (r MockCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) error {
 	res := reply.(*Service1Response)
 
-	w.Write([]byte(strconv.Itoa(res.Result)))
+	_, err := w.Write([]byte(strconv.Itoa(res.Result)))
+	return err
 }
 
 func (r MockCodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
@@ -195,3 +710,894 @@ func TestServeHTTP(t *testing.T) {
 		t.Errorf("Response body was %s, should be %s.", w.Body, strconv.Itoa(expected))
 	}
 }
+
+// slowReader delivers its data after a delay.
+type slowReader struct {
+	delay time.Duration
+	r     *strings.Reader
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p)
+}
+
+func TestBodyReadTimeout(t *testing.T) {
+	s := NewServer(ServerBodyReadTimeout(20 * time.Millisecond))
+
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	for delay, status := range map[time.Duration]int{
+		0:                      200,
+		200 * time.Millisecond: 408,
+	} {
+		r, err := http.NewRequest("POST", "", &slowReader{delay, strings.NewReader("{}")})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Content-Type", "mock")
+
+		w := NewMockResponseWriter()
+
+		s.ServeHTTP(w, r)
+
+		if w.Status != status {
+			t.Errorf("Status was %d, should be %d.", w.Status, status)
+		}
+	}
+}
+
+func TestMux(t *testing.T) {
+	v1 := NewServer()
+	v1.RegisterService(new(Service1), "")
+	v1.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	v2 := NewServer()
+	v2.RegisterService(new(Service1), "")
+	v2.RegisterCodec(MockCodec{4, 5}, "mock")
+
+	m := NewMux()
+	m.Handle("/v1", v1)
+	m.Handle("/v2/", v2)
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"POST", "/v1", 200, "6"},
+		{"POST", "/v1/", 200, "6"},
+		{"POST", "/v2", 200, "20"},
+		{"POST", "/v2/rpc", 200, "20"},
+		{"POST", "/v10", 404, "rpc: no server for path /v10"},
+		{"POST", "/", 404, "rpc: no server for path /"},
+		{"GET", "/v1", 405, "rpc: POST method required, received GET"},
+	} {
+		r, err := http.NewRequest(test.method, "http://localhost:8080"+test.path, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Content-Type", "mock")
+
+		w := NewMockResponseWriter()
+
+		m.ServeHTTP(w, r)
+
+		if w.Status != test.status || w.Body != test.body {
+			t.Errorf("%s %s: got %d %q, should be %d %q.", test.method, test.path, w.Status, w.Body, test.status, test.body)
+		}
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	s := NewServer(ServerVersion("1.2.3"))
+
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	for contentType, status := range map[string]int{
+		"mock":    200,
+		"invalid": 415,
+	} {
+		r, err := http.NewRequest("POST", "", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Content-Type", contentType)
+
+		w := NewMockResponseWriter()
+
+		s.ServeHTTP(w, r)
+
+		if w.Status != status {
+			t.Errorf("Status was %d, should be %d.", w.Status, status)
+		}
+
+		if version := w.Header().Get("X-RPC-Server-Version"); version != "1.2.3" {
+			t.Errorf("Version was %q, should be 1.2.3.", version)
+		}
+	}
+}
+
+func TestServerSampler(t *testing.T) {
+	var traced int
+
+	trace := func(ctx context.Context, method string, header http.Header, req CodecRequest) context.Context {
+		if Sampled(ctx) {
+			traced++
+		}
+		return ctx
+	}
+
+	for sample, expected := range map[bool]int{false: 0, true: 1} {
+		traced = 0
+		sample := sample
+
+		s := NewServer(
+			ServerSampler(func(ctx context.Context, method string) bool { return sample }),
+			ServerBefore(trace),
+		)
+
+		s.RegisterService(new(Service1), "")
+		s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+		r, err := http.NewRequest("POST", "", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Content-Type", "mock")
+
+		s.ServeHTTP(NewMockResponseWriter(), r)
+
+		if traced != expected {
+			t.Errorf("Traced %d requests, should be %d.", traced, expected)
+		}
+	}
+}
+
+func TestServerAfter(t *testing.T) {
+	var calls []string
+	var result int
+	var resultErr error
+
+	s := NewServer(
+		ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			calls = append(calls, "first "+method)
+			if res, ok := reply.(*Service1Response); ok {
+				result = res.Result
+			}
+			resultErr = err
+		}),
+		ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			calls = append(calls, "second "+method)
+		}),
+	)
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	serve := func() {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		s.ServeHTTP(NewMockResponseWriter(), r)
+	}
+
+	serve()
+
+	if resultErr != ErrServiceNotFound {
+		t.Errorf("Expected %v, but got %v", ErrServiceNotFound, resultErr)
+	}
+
+	s.RegisterService(new(Service1), "")
+	serve()
+
+	if result != 6 || resultErr != nil {
+		t.Errorf("Expected result 6, but got %d, %v", result, resultErr)
+	}
+
+	expected := "first Service1.Multiply, second Service1.Multiply, first Service1.Multiply, second Service1.Multiply"
+	if got := strings.Join(calls, ", "); got != expected {
+		t.Errorf("Expected calls %q, but got %q", expected, got)
+	}
+}
+
+func TestAllowHEAD(t *testing.T) {
+	for allow, status := range map[bool]int{false: 405, true: 200} {
+		var options []ServerOption
+		if allow {
+			options = append(options, ServerAllowHEAD())
+		}
+
+		s := NewServer(options...)
+
+		s.RegisterService(new(Service1), "")
+		s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+		r, err := http.NewRequest("HEAD", "", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := NewMockResponseWriter()
+
+		s.ServeHTTP(w, r)
+
+		if w.Status != status {
+			t.Errorf("Status was %d, should be %d.", w.Status, status)
+		}
+
+		if allow && (w.Body != "" || w.Header().Get("X-RPC-Methods-Count") != "1") {
+			t.Errorf("Wrong HEAD response: %q %v", w.Body, w.Header())
+		}
+	}
+}
+
+func TestServerCORS(t *testing.T) {
+	s := NewServer(ServerCORS(CORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		MaxAge:         10 * time.Minute,
+	}))
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	serve := func(method, origin string) *MockResponseWriter {
+		r, err := http.NewRequest(method, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock")
+		r.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("OPTIONS", "https://app.example.com")
+	if w.Status != 204 {
+		t.Errorf("Preflight status was %d, should be 204.", w.Status)
+	}
+	for name, value := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "POST",
+		"Access-Control-Allow-Headers": "Content-Type, Authorization",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s was %q, should be %q.", name, got, value)
+		}
+	}
+
+	w = serve("POST", "https://app.example.com")
+	if w.Body != "6" || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("Wrong response: %q %v", w.Body, w.Header())
+	}
+
+	for _, method := range []string{"OPTIONS", "POST"} {
+		w = serve(method, "https://evil.example.com")
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%s from another origin got Access-Control-Allow-Origin %q.", method, got)
+		}
+	}
+
+	// Any origin, without credentials, is allowed with a wildcard.
+	s = NewServer(ServerCORS(CORSConfig{AllowedOrigins: []string{"*"}}))
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	if got := serve("OPTIONS", "https://other.example.com").Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin was %q, should be *.", got)
+	}
+
+	// Credentials are only allowed for the origins listed by name.
+	s = NewServer(ServerCORS(CORSConfig{
+		AllowedOrigins:   []string{"*", "https://app.example.com"},
+		AllowCredentials: true,
+	}))
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	for origin, want := range map[string][2]string{
+		"https://app.example.com":   {"https://app.example.com", "true"},
+		"https://other.example.com": {"*", ""},
+	} {
+		header := serve("OPTIONS", origin).Header()
+		if got := [2]string{header.Get("Access-Control-Allow-Origin"), header.Get("Access-Control-Allow-Credentials")}; got != want {
+			t.Errorf("%s: origin and credentials were %q, should be %q.", origin, got, want)
+		}
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	s := NewServer()
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	s.RegisterService(new(Service1), "")
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s.ServeHTTP(NewMockResponseWriter(), r)
+	}
+}
+
+func TestCodecSelection(t *testing.T) {
+	mock, other := MockCodec{2, 3}, MockCodec{3, 4}
+	single := NewServer()
+	single.RegisterCodec(mock, "Mock")
+	multi := NewServer()
+	multi.RegisterCodec(mock, "mock")
+	multi.RegisterCodec(other, "other")
+
+	for _, tc := range []struct {
+		server      *Server
+		contentType string
+		codec       Codec
+	}{
+		{single, "mock", mock},
+		{single, "MOCK; charset=utf-8", mock},
+		{single, "", mock},
+		{single, "other", nil},
+		{multi, "mock", mock},
+		{multi, "Other; charset=utf-8", other},
+		{multi, "", nil},
+		{multi, "invalid", nil},
+	} {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", tc.contentType)
+		if codec, _ := tc.server.codec(r); codec != tc.codec {
+			t.Errorf("%q: expected codec %v, got %v", tc.contentType, tc.codec, codec)
+		}
+	}
+}
+
+func TestSuffixCodecs(t *testing.T) {
+	mock, other := MockCodec{2, 3}, MockCodec{3, 4}
+	s := NewServer(ServerSuffixCodecs())
+	s.RegisterCodec(mock, "application/json")
+	s.RegisterCodec(other, "application/vnd.other+json")
+	s.RegisterCodecMatcher(func(contentType string) Codec {
+		if strings.HasPrefix(contentType, "text/") {
+			return other
+		}
+		return nil
+	})
+
+	for _, tc := range []struct {
+		contentType string
+		codec       Codec
+	}{
+		{"application/json", mock},
+		{"application/vnd.myapp+json", mock},
+		{"Application/Vnd.MyApp+JSON; charset=utf-8", mock},
+		{"application/vnd.other+json", other},
+		{"application/vnd.myapp+xml", nil},
+		{"application/+json", mock},
+		{"json+", nil},
+		{"text/plain", other},
+		{"", nil},
+	} {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", tc.contentType)
+		if codec, _ := s.codec(r); codec != tc.codec {
+			t.Errorf("%q: expected codec %v, got %v", tc.contentType, tc.codec, codec)
+		}
+	}
+
+	// Without the option, only exact matches count.
+	s = NewServer()
+	s.RegisterCodec(mock, "application/json")
+	s.RegisterCodec(other, "text/plain")
+	r, _ := http.NewRequest("POST", "", nil)
+	r.Header.Set("Content-Type", "application/vnd.myapp+json")
+	if codec, _ := s.codec(r); codec != nil {
+		t.Errorf("Expected no codec, got %v", codec)
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	single := NewServer()
+	single.RegisterCodec(MockCodec{2, 3}, "mock")
+	multi := NewServer()
+	multi.RegisterCodec(MockCodec{2, 3}, "mock")
+	multi.RegisterCodec(MockCodec{3, 4}, "other")
+
+	for _, bc := range []struct {
+		name        string
+		server      *Server
+		contentType string
+	}{
+		{"single", single, "mock"},
+		{"single/params", single, "mock; charset=utf-8"},
+		{"multi", multi, "mock"},
+	} {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r.Header.Set("Content-Type", bc.contentType)
+
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if codec, _ := bc.server.codec(r); codec == nil {
+					b.Fatal("no codec")
+				}
+			}
+		})
+	}
+}
+
+type Service6 struct {
+}
+
+type Service6Embedded struct {
+	Tags []string `json:"tags,omitempty"`
+}
+
+type Service6Request struct {
+	Service6Embedded
+	Name    string    `json:"name"`
+	Age     int       `json:"age,omitempty"`
+	Born    time.Time `json:"born"`
+	Parent  *Service6Request
+	private int
+}
+
+func (t *Service6) Get(ctx context.Context, req *Service6Request) (*Service6Request, error) {
+	return req, nil
+}
+
+func TestOpenRPC(t *testing.T) {
+	s := NewServer(ServerVersion("1.2.3"))
+	s.RegisterService(new(Service6), "")
+	if err := s.RegisterDiscover(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := s.OpenRPC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed struct {
+		OpenRPC string `json:"openrpc"`
+		Info    struct {
+			Version string `json:"version"`
+		} `json:"info"`
+		Methods []struct {
+			Name   string `json:"name"`
+			Params []struct {
+				Name     string                 `json:"name"`
+				Required bool                   `json:"required"`
+				Schema   map[string]interface{} `json:"schema"`
+			} `json:"params"`
+			Result struct {
+				Schema map[string]interface{} `json:"schema"`
+			} `json:"result"`
+		} `json:"methods"`
+	}
+	if err := json.Unmarshal(doc, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.OpenRPC != OpenRPCVersion || parsed.Info.Version != "1.2.3" || len(parsed.Methods) != 2 {
+		t.Fatalf("Wrong document: %s", doc)
+	}
+
+	get := parsed.Methods[0]
+	if get.Name != "Service6.Get" || parsed.Methods[1].Name != "rpc.discover" {
+		t.Fatalf("Wrong methods: %s", doc)
+	}
+
+	var params []string
+	for _, param := range get.Params {
+		params = append(params, fmt.Sprintf("%s:%v:%v", param.Name, param.Schema["type"], param.Required))
+	}
+	// The recursive Parent gets an empty schema.
+	expected := "tags:array:false, name:string:true, age:integer:false, born:string:true, Parent:<nil>:true"
+	if got := strings.Join(params, ", "); got != expected {
+		t.Errorf("Params were %q, should be %q.", got, expected)
+	}
+
+	if get.Result.Schema["type"] != "object" {
+		t.Errorf("Wrong result schema: %v", get.Result.Schema)
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("lookup: %w", NewError(CodeBadParams, "A must be positive"))
+	if !errors.Is(err, ErrBadParams) || errors.Is(err, ErrInternal) {
+		t.Errorf("Expected %v to match ErrBadParams only", err)
+	}
+	var jsonErr *Error
+	if !errors.As(err, &jsonErr) || jsonErr.Code != CodeBadParams {
+		t.Errorf("Expected %v to unwrap to an *Error", err)
+	}
+	if ErrorCodeOf(err) != CodeBadParams {
+		t.Errorf("Expected code %d, got %d", CodeBadParams, ErrorCodeOf(err))
+	}
+
+	retryable := &RetryableError{After: time.Second, Err: NewError(CodeServer, "busy")}
+	if !errors.Is(retryable, ErrServer) {
+		t.Errorf("Expected %v to match ErrServer", retryable)
+	}
+
+	if errors.Is(ErrServiceNotFound, ErrMethodNotFound) || errors.Is(ErrMethodNotFound, ErrServiceNotFound) {
+		t.Error("Expected the not found errors to be told apart")
+	}
+	if notFound := NewError(CodeMethodNotFound, "not found"); !errors.Is(notFound, ErrMethodNotFound) || !errors.Is(notFound, ErrServiceNotFound) {
+		t.Errorf("Expected %v to match both not found errors", notFound)
+	}
+	if ErrorCodeOf(fmt.Errorf("lookup: %w", ErrServiceNotFound)) != CodeMethodNotFound {
+		t.Error("Expected the not found errors to have CodeMethodNotFound")
+	}
+}
+
+func TestErrorConstructors(t *testing.T) {
+	for _, tc := range []struct {
+		err  *Error
+		code ErrorCode
+	}{
+		{NewParseError("m"), CodeParse},
+		{NewInvalidRequestError("m"), CodeInvalidRequest},
+		{NewMethodNotFoundError("m"), CodeMethodNotFound},
+		{NewInvalidParamsError(errors.New("m")), CodeBadParams},
+		{NewInternalError("m"), CodeInternal},
+		{NewServerError(-32042, "m"), -32042},
+	} {
+		if tc.err.Code != tc.code || tc.err.Message != "m" {
+			t.Errorf("Expected code %d and message m, got %d %q", tc.code, tc.err.Code, tc.err.Message)
+		}
+	}
+
+	err := ErrBadParams.WithData(map[string]int{"min": 1})
+	if err.Code != CodeBadParams || err.Message != ErrBadParams.Message || err.Data == nil {
+		t.Errorf("Wrong error with data: %#v", err)
+	}
+	if ErrBadParams.Data != nil {
+		t.Error("Expected WithData to leave the original error untouched")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := newRateLimiter(func(r *http.Request) string {
+		return r.Header.Get("X-Api-Key")
+	}, RateLimit{Limit: 1000, Burst: 1})
+
+	for _, key := range []string{"a", "b"} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", nil)
+		r.Header.Set("X-Api-Key", key)
+		if after := l.reserve(r, "Service1.Multiply", nil); after != 0 {
+			t.Fatalf("Expected the first call of %s to be allowed, got %s", key, after)
+		}
+	}
+	if len(l.buckets) != 2 {
+		t.Fatalf("Expected 2 buckets, got %d", len(l.buckets))
+	}
+
+	// Both buckets are full again after 1ms; b is used after the sweep
+	// is due, so only a is dropped.
+	time.Sleep(5 * time.Millisecond)
+	l.lastSweep = time.Now().Add(-2 * rateLimitSweep)
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", nil)
+	r.Header.Set("X-Api-Key", "b")
+	l.reserve(r, "Service1.Multiply", nil)
+	if _, ok := l.buckets["a"]; ok || len(l.buckets) != 1 {
+		t.Errorf("Expected the idle bucket to be dropped, got %d buckets", len(l.buckets))
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	var hooks []string
+	s := NewServer(
+		ServerBefore(func(ctx context.Context, method string, header http.Header, req CodecRequest) context.Context {
+			hooks = append(hooks, "before "+method)
+			return ctx
+		}),
+		ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+			hooks = append(hooks, "after "+method)
+		}),
+	)
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := s.Invoke(context.Background(), "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+	if !reflect.DeepEqual(hooks, []string{"before Service1.Multiply", "after Service1.Multiply"}) {
+		t.Errorf("Expected the hooks to run, got %v", hooks)
+	}
+
+	var reply map[string]int
+	if err := s.Invoke(context.Background(), "Service1.Multiply", map[string]int{"A": 3, "B": 5}, &reply); err != nil || reply["Result"] != 15 {
+		t.Errorf("Expected 15 through conversion, got %v, %v", reply, err)
+	}
+
+	err := s.Invoke(context.Background(), "Service1.Divide", &Service1Request{4, 2}, nil)
+	if ErrorCodeOf(err) != CodeMethodNotFound {
+		t.Errorf("Expected a method not found error, got %v", err)
+	}
+
+	err = s.Invoke(context.Background(), "Service1.Multiply", "four", nil)
+	if ErrorCodeOf(err) != CodeBadParams {
+		t.Errorf("Expected a bad params error, got %v", err)
+	}
+}
+
+// MixedCase has methods differing only by case.
+type MixedCase struct{}
+
+func (m *MixedCase) Get(req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{Result: req.A}, nil
+}
+
+func (m *MixedCase) GET(req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{Result: req.B}, nil
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	var methods []string
+	s := NewServer(ServerCaseInsensitive(), ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+		methods = append(methods, method)
+	}))
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterFunc("Tools.Echo", func(req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{Result: req.A}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{"Service1.Multiply", "service1.multiply", "SERVICE1.MULTIPLY", "tools.echo"} {
+		if !s.HasMethod(method) {
+			t.Errorf("Expected %s to be found", method)
+		}
+	}
+	var res Service1Response
+	if err := s.Invoke(context.Background(), "service1.multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+	if !reflect.DeepEqual(methods, []string{"Service1.Multiply"}) {
+		t.Errorf("Expected the hooks to get the registered name, got %v", methods)
+	}
+	if !reflect.DeepEqual(s.Methods(), []string{"Service1.Multiply", "Tools.Echo"}) {
+		t.Errorf("Expected the registered names, got %v", s.Methods())
+	}
+
+	if err := s.RegisterService(new(Service1), "SERVICE1"); err == nil {
+		t.Error("Expected an error on a service differing only by case")
+	}
+	if err := s.RegisterFunc("tools.ECHO", func(req *Service1Request) (*Service1Response, error) {
+		return nil, nil
+	}); err == nil {
+		t.Error("Expected an error on a function differing only by case")
+	}
+	if err := s.RegisterService(new(MixedCase), ""); err == nil {
+		t.Error("Expected an error on methods differing only by case")
+	}
+	if err := s.RegisterServices(new(Service3), new(MixedCase)); err == nil || s.HasMethod("Service3.Sum") {
+		t.Errorf("Expected no service to be registered, got %v", err)
+	}
+
+	if NewServer().RegisterService(new(MixedCase), "") != nil {
+		t.Error("Expected methods differing by case to be fine by default")
+	}
+}
+
+func TestAliasMethod(t *testing.T) {
+	var methods []string
+	s := NewServer(ServerAfter(func(ctx context.Context, method string, reply interface{}, err error) {
+		methods = append(methods, method)
+	}))
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AliasMethod("Legacy.Mul", "Service1.Multiply"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AliasMethod("Legacy.Times", "Legacy.Mul"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("Legacy.Mul") || !s.HasMethod("Legacy.Times") {
+		t.Error("Expected the aliases to be found")
+	}
+	if !reflect.DeepEqual(s.Methods(), []string{"Service1.Multiply"}) {
+		t.Errorf("Expected aliases not to be listed, got %v", s.Methods())
+	}
+	want := map[string]string{"Legacy.Mul": "Service1.Multiply", "Legacy.Times": "Service1.Multiply"}
+	if !reflect.DeepEqual(s.Aliases(), want) {
+		t.Errorf("Expected aliases %v, got %v", want, s.Aliases())
+	}
+
+	var res Service1Response
+	if err := s.Invoke(context.Background(), "Legacy.Times", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+	if !reflect.DeepEqual(methods, []string{"Service1.Multiply"}) {
+		t.Errorf("Expected the hooks to get the target, got %v", methods)
+	}
+
+	for _, tc := range []struct{ alias, target string }{
+		{"Legacy.Div", "Service1.Divide"},
+		{"Service1.Multiply", "Legacy.Mul"},
+		{"Legacy.Mul", "Service1.Multiply"},
+		{"Legacy", "Service1.Multiply"},
+	} {
+		if err := s.AliasMethod(tc.alias, tc.target); err == nil {
+			t.Errorf("Expected an error aliasing %s to %s", tc.alias, tc.target)
+		}
+	}
+	if err := s.RegisterFunc("Legacy.Mul", func(req *Service1Request) (*Service1Response, error) {
+		return nil, nil
+	}); err == nil {
+		t.Error("Expected an error registering a method named like an alias")
+	}
+
+	ci := NewServer(ServerCaseInsensitive())
+	ci.RegisterService(new(Service1), "")
+	if err := ci.AliasMethod("Legacy.Mul", "service1.multiply"); err != nil {
+		t.Fatal(err)
+	}
+	if !ci.HasMethod("legacy.mul") || ci.AliasMethod("LEGACY.MUL", "Service1.Multiply") == nil {
+		t.Error("Expected aliases to ignore case too")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	var notReady error
+	s := NewServer(ServerReadiness(func(ctx context.Context) error {
+		return notReady
+	}))
+	s.RegisterCodec(MockCodec{}, "application/mock")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(Service3), "")
+	h := s.HealthHandler()
+
+	serve := func(method string) *MockResponseWriter {
+		r, _ := http.NewRequest(method, "http://localhost:8080/health", nil)
+		w := NewMockResponseWriter()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("GET")
+	if w.Status != 200 || w.Body != `{"status":"ok","codecs":["application/mock"],"methods":2}`+"\n" {
+		t.Errorf("Unexpected health: %d %s", w.Status, w.Body)
+	}
+
+	notReady = errors.New("database down")
+	w = serve("GET")
+	if w.Status != 503 || !strings.Contains(w.Body, `"error":"database down"`) {
+		t.Errorf("Expected the server to be unavailable, got %d %s", w.Status, w.Body)
+	}
+	notReady = nil
+
+	if w := serve("POST"); w.Status != 405 {
+		t.Errorf("Expected status 405, got %d", w.Status)
+	}
+
+	s.Shutdown(context.Background())
+	if w := serve("HEAD"); w.Status != 503 || w.Body != "" {
+		t.Errorf("Expected an empty 503 once shut down, got %d %q", w.Status, w.Body)
+	}
+}
+
+type UserService struct {
+	names map[string]string
+}
+
+func (u *UserService) GetProfile(req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{Result: req.A}, nil
+}
+
+func (u *UserService) Delete(req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{}, nil
+}
+
+func (u *UserService) RPCNames() map[string]string {
+	return u.names
+}
+
+func TestRPCNames(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(&UserService{names: map[string]string{"GetProfile": "getProfile"}}, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"user.Delete", "user.getProfile"}; !reflect.DeepEqual(s.Methods(), want) {
+		t.Errorf("Expected methods %v, got %v", want, s.Methods())
+	}
+
+	for _, names := range []map[string]string{
+		{"Missing": "missing"},
+		{"names": "names"},
+		{"GetProfile": ""},
+		{"GetProfile": "get.profile"},
+		{"GetProfile": "Delete"},
+		{"RPCNames": "names"},
+	} {
+		if err := NewServer().RegisterService(&UserService{names: names}, "user"); err == nil {
+			t.Errorf("Expected an error registering with names %v", names)
+		}
+	}
+}
+
+func TestOnDuplicate(t *testing.T) {
+	multiply := func(req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{Result: 42}, nil
+	}
+	call := func(s *Server) int {
+		var res Service1Response
+		if err := s.Invoke(context.Background(), "calc.Multiply", &Service1Request{A: 2, B: 3}, &res); err != nil {
+			return -1
+		}
+		return res.Result
+	}
+
+	// Errors name the method.
+	s := NewServer()
+	if err := s.RegisterService(new(Service1), "calc"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		s.RegisterService(new(Service1), "calc"),
+		s.RegisterFunc("calc.Multiply", multiply),
+	} {
+		if !errors.Is(err, ErrDuplicate) || !strings.Contains(err.Error(), `"calc.Multiply"`) {
+			t.Errorf("Expected ErrDuplicate naming calc.Multiply, got %v", err)
+		}
+	}
+	if err := s.RegisterServices(new(Service3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterServices(new(Service3)); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Expected ErrDuplicate, got %v", err)
+	}
+
+	// Overridden services are replaced as a whole, methods one by one.
+	s = NewServer(ServerOnDuplicate(DuplicateOverride), ServerCaseInsensitive())
+	s.RegisterService(new(Service1), "calc")
+	if err := s.RegisterFunc("calc.Multiply", multiply); err != nil || call(s) != 42 {
+		t.Errorf("Expected calc.Multiply to be replaced, got %d, %v", call(s), err)
+	}
+	if err := s.RegisterService(new(Service3), "calc"); err != nil || !reflect.DeepEqual(s.Methods(), []string{"calc.Sum"}) {
+		t.Errorf("Expected calc to be replaced, got %v, %v", s.Methods(), err)
+	}
+	if err := s.RegisterService(new(Service1), "CALC"); err != nil {
+		t.Errorf("Expected no collision with the replaced methods, got %v", err)
+	}
+
+	// Ignored registrations keep what is registered.
+	s = NewServer(ServerOnDuplicate(DuplicateIgnore))
+	s.RegisterService(new(Service1), "calc")
+	if err := s.RegisterFunc("calc.Multiply", multiply); err != nil || call(s) != 6 {
+		t.Errorf("Expected calc.Multiply to be kept, got %d, %v", call(s), err)
+	}
+	if err := s.RegisterService(new(Service3), "calc"); err != nil || !reflect.DeepEqual(s.Methods(), []string{"calc.Multiply"}) {
+		t.Errorf("Expected calc to be kept, got %v, %v", s.Methods(), err)
+	}
+}
@@ -0,0 +1,180 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+// Streamer is implemented by replies producing a stream of values, sent by
+// SSEHandler as they come. The channel is closed by the producer once done;
+// ctx is cancelled when the client goes away.
+type Streamer interface {
+	Stream(ctx context.Context) <-chan interface{}
+}
+
+// SSEHandler returns a handler serving requests whose reply may be a
+// Streamer as Server-Sent Events.
+//
+// The POST body holds a single request, decoded by the codec of its
+// Content-Type, and the method is called as by ServeHTTP, hooks included.
+// When the reply is a Streamer, the connection is kept open and each value
+// of the stream is sent as the data of an event, holding the response the
+// codec writes for it with the id of the request. The connection closes
+// once the channel is closed or the client goes away. Errors and other
+// replies are answered as by ServeHTTP.
+//
+// The stream is part of the call: it holds its ServerMaxConcurrent slot,
+// Shutdown waits for it, and the after hooks run once it ends. The limit of
+// SetMethodMaxResponseBytes applies to each event; an event over it ends
+// the stream with an error event, as does a later error of the call.
+// ServerTimeout doesn't bound the stream.
+//
+// The body gets the limits, read timeout and decompression of ServeHTTP.
+// Batches are refused. CORS, GET requests, compressed responses and the
+// codecs of RegisterServiceCodec are left to ServeHTTP.
+func SSEHandler(s *Server) http.Handler {
+	return &sseHandler{server: s}
+}
+
+type sseHandler struct {
+	server *Server
+}
+
+func (h *sseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, 405, "rpc: POST method required, received "+r.Method)
+		return
+	}
+	codec, contentType := h.server.codec(r)
+	if codec == nil {
+		WriteError(w, 415, "rpc: unrecognized Content-Type: "+contentType)
+		return
+	}
+	r, ok := h.server.limitBody(w, r, codec)
+	if !ok {
+		return
+	}
+
+	codecReq := codec.NewRequest(r)
+	if batch, ok := codecReq.(BatchCodecRequest); ok && batch.IsBatch() {
+		batch.WriteError(w, 400, NewError(CodeInvalidRequest, "rpc: batches are not supported over SSE"))
+		return
+	}
+	h.server.serveRequest(w, r, &sseCodecRequest{CodecRequest: codecReq, ctx: r.Context(), w: w})
+}
+
+// sseCodecRequest writes Streamer replies as events, forwarding the
+// optional interfaces of the codec request it wraps.
+type sseCodecRequest struct {
+	CodecRequest
+	ctx       context.Context
+	w         http.ResponseWriter
+	streaming bool // the event stream has started
+}
+
+func (c *sseCodecRequest) IsNotification() bool {
+	n, ok := c.CodecRequest.(NotificationCodecRequest)
+	return ok && n.IsNotification()
+}
+
+func (c *sseCodecRequest) RequestID() string {
+	if idReq, ok := c.CodecRequest.(IDCodecRequest); ok {
+		return idReq.RequestID()
+	}
+	return ""
+}
+
+func (c *sseCodecRequest) DisallowUnknownFields() {
+	if strict, ok := c.CodecRequest.(StrictCodecRequest); ok {
+		strict.DisallowUnknownFields()
+	}
+}
+
+func (c *sseCodecRequest) AllowVersion1() {
+	if v1, ok := c.CodecRequest.(Version1CodecRequest); ok {
+		v1.AllowVersion1()
+	}
+}
+
+func (c *sseCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) error {
+	if c.streaming {
+		// The reply was streamed during the call.
+		return nil
+	}
+	if streamer, ok := reply.(Streamer); ok {
+		// Replies of before hooks are not dispatched.
+		return c.stream(streamer, 0)
+	}
+	return c.CodecRequest.WriteResponse(w, reply)
+}
+
+func (c *sseCodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	if !c.streaming {
+		c.CodecRequest.WriteError(w, status, err)
+		return
+	}
+	buf := newResponseBuffer(0)
+	c.CodecRequest.WriteError(buf, status, err)
+	c.writeEvent(buf.body.Bytes())
+}
+
+// stream sends the values of streamer as events until the channel is
+// closed or the client goes away. Events over limit, unless zero, end the
+// stream with an error.
+func (c *sseCodecRequest) stream(streamer Streamer, limit int64) error {
+	c.streaming = true
+	c.w.Header().Set("Content-Type", "text/event-stream")
+	c.w.Header().Set("Cache-Control", "no-cache")
+	c.w.WriteHeader(http.StatusOK)
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	values := streamer.Stream(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case v, ok := <-values:
+			if !ok {
+				return nil
+			}
+			buf := newResponseBuffer(limit)
+			if err := c.CodecRequest.WriteResponse(buf, v); buf.overflow {
+				return NewError(CodeInternal, errResponseTooLarge)
+			} else if err != nil {
+				return err
+			}
+			if err := c.writeEvent(buf.body.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeEvent sends a response body as an event.
+func (c *sseCodecRequest) writeEvent(body []byte) error {
+	if _, err := c.w.Write(sseEvent(body)); err != nil {
+		return err
+	}
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// sseEvent returns an event whose data is the response body, one data field
+// per line.
+func sseEvent(body []byte) []byte {
+	var event bytes.Buffer
+	for _, line := range bytes.Split(bytes.TrimSpace(body), []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(line)
+		event.WriteString("\n")
+	}
+	event.WriteString("\n")
+	return event.Bytes()
+}
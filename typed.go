@@ -0,0 +1,35 @@
+//go:build go1.18
+
+package jsonrpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// RegisterTyped adds a function as a method given its full name like
+// "Service.Method", as RegisterFunc does, but with its signature checked at
+// compile time. The params are decoded into a new Args and fn is called
+// directly, without reflection.
+func RegisterTyped[Args any, Reply any](s *Server, name string, fn func(context.Context, *Args) (*Reply, error)) error {
+	if fn == nil {
+		return fmt.Errorf("rpc: no function for %q", name)
+	}
+	return s.serviceMap().addMethod(name, &serviceMethod{
+		typed: &typedMethod{
+			read: func(codecReq CodecRequest) (interface{}, error) {
+				args := new(Args)
+				if err := readArgs(codecReq, args); err != nil {
+					return nil, err
+				}
+				return args, nil
+			},
+			call: func(ctx context.Context, args interface{}) (interface{}, error) {
+				return fn(ctx, args.(*Args))
+			},
+		},
+		argsType:  []reflect.Type{reflect.TypeOf((*Args)(nil)).Elem()},
+		replyType: reflect.TypeOf((*Reply)(nil)),
+	})
+}
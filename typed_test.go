@@ -0,0 +1,68 @@
+//go:build go1.18
+
+package jsonrpc
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRegisterTyped(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	err := RegisterTyped(s, "Service1.Multiply", func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{Result: req.A * req.B * 100}, nil
+	})
+	if err != nil || !s.HasMethod("Service1.Multiply") {
+		t.Fatal("Expected to be registered: Service1.Multiply", err)
+	}
+
+	argType, replyType, ok := s.MethodInfo("Service1.Multiply")
+	if !ok || argType != reflect.TypeOf(&Service1Request{}) || replyType != reflect.TypeOf(&Service1Response{}) {
+		t.Errorf("Wrong info for Service1.Multiply: %v, %v, %v", argType, replyType, ok)
+	}
+
+	s.RegisterService(new(Service3), "")
+	if err := RegisterTyped(s, "Service3.Multiply", func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return nil, nil
+	}); err == nil {
+		t.Error("Expected error registering into Service3")
+	}
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+
+	if w.Body != "600" {
+		t.Errorf("Response body was %s, should be 600.", w.Body)
+	}
+}
+
+func BenchmarkServeHTTPTyped(b *testing.B) {
+	s := NewServer()
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	RegisterTyped(s, "Service1.Multiply", func(ctx context.Context, req *Service1Request) (*Service1Response, error) {
+		return &Service1Response{Result: req.A * req.B}, nil
+	})
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s.ServeHTTP(NewMockResponseWriter(), r)
+	}
+}
@@ -0,0 +1,130 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketHandler returns a handler serving the server over WebSocket
+// connections, where each message holds a request, a notification or a
+// batch, as the body of an HTTP request would.
+//
+// Messages are served concurrently through ServeHTTP, with the headers of
+// the upgrade request, so the codec is chosen from its Content-Type as
+// usual. Responses are sent back as messages of the same type, in the order
+// they are ready; clients match them with their requests by id. Requests
+// still running when the connection closes get their context cancelled.
+//
+// Messages over the limit of ServerMaxBodyBytes close the connection. A
+// connection runs at most as many messages at once as ServerMaxConcurrent
+// allows, 100 by default; it isn't read further until one of them is
+// answered. A response that can't be written within 10 seconds closes the
+// connection.
+//
+// Cross-origin upgrade requests are refused.
+func WebSocketHandler(s *Server) http.Handler {
+	return &webSocketHandler{server: s}
+}
+
+const (
+	// defaultWebSocketInFlight is the number of messages a connection runs
+	// at once when the server has no concurrency limit.
+	defaultWebSocketInFlight = 100
+
+	// webSocketWriteTimeout bounds the time spent writing a response.
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+type webSocketHandler struct {
+	server   *Server
+	upgrader websocket.Upgrader
+}
+
+func (h *webSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if codec, contentType := h.server.codec(r); codec == nil {
+		WriteError(w, 415, "rpc: unrecognized Content-Type: "+contentType)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered.
+		return
+	}
+	defer conn.Close()
+	if h.server.maxBodyBytes > 0 {
+		conn.SetReadLimit(h.server.maxBodyBytes)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	inFlight := make(chan struct{}, defaultWebSocketInFlight)
+	if h.server.concurrency != nil {
+		inFlight = make(chan struct{}, cap(h.server.concurrency))
+	}
+
+	var wg sync.WaitGroup
+	var writeMutex sync.Mutex
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+
+			res := h.serve(ctx, r, message)
+			if len(res) == 0 {
+				return
+			}
+
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+			if err := conn.WriteMessage(messageType, res); err != nil {
+				// The connection is unusable: stop reading it and cancel
+				// the requests still running.
+				cancel()
+				conn.Close()
+			}
+		}()
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+// serve serves a message as the body of a POST request and returns the
+// response body.
+func (h *webSocketHandler) serve(ctx context.Context, upgrade *http.Request, message []byte) []byte {
+	r := upgrade.Clone(ctx)
+	r.Method = "POST"
+	r.Body = ioutil.NopCloser(bytes.NewReader(message))
+	r.ContentLength = int64(len(message))
+	// Messages are sent and answered uncompressed.
+	r.Header.Del("Accept-Encoding")
+	r.Header.Del("Content-Encoding")
+
+	buf := newResponseBuffer(0)
+	h.server.ServeHTTP(buf, r)
+	return bytes.TrimSpace(buf.body.Bytes())
+}